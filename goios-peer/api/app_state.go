@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+)
+
+// AppStateFilter отбирает уведомления о состоянии приложений. Несколько значений одного параметра
+// объединяются через ИЛИ, разные параметры — через И. Пустой фильтр пропускает всё.
+type AppStateFilter struct {
+	BundleIDs []string
+	// States сравниваются с state_description без учёта регистра и по подстроке:
+	// foreground подходит к "Foreground Running".
+	States []string
+}
+
+// AppStateNotification — уведомление из истории устройства.
+type AppStateNotification struct {
+	ID           uint64                 `json:"id"`
+	Time         time.Time              `json:"time"`
+	Notification map[string]interface{} `json:"notification"`
+}
+
+func parseAppStateFilter(c *gin.Context) AppStateFilter {
+	return AppStateFilter{BundleIDs: queryList(c, "bundleID"), States: queryList(c, "state")}
+}
+
+func (f AppStateFilter) empty() bool {
+	return len(f.BundleIDs) == 0 && len(f.States) == 0
+}
+
+// match применяет фильтр к уведомлению instruments: bundleID приходит в displayID,
+// состояние — в state_description.
+func (f AppStateFilter) match(notification map[string]interface{}) bool {
+	if len(f.BundleIDs) > 0 {
+		bundleID, _ := notification["displayID"].(string)
+		if !containsFold(f.BundleIDs, bundleID) {
+			return false
+		}
+	}
+	if len(f.States) > 0 {
+		state, _ := notification["state_description"].(string)
+		state = strings.ToLower(state)
+		matched := false
+		for _, s := range f.States {
+			if strings.Contains(state, strings.ToLower(s)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// accept применяет фильтр к событию потока уведомлений. Служебные события проходят всегда.
+func (f AppStateFilter) accept(e feedEvent) bool {
+	if e.Event != "notification" || f.empty() {
+		return true
+	}
+	var notification map[string]interface{}
+	if err := json.Unmarshal([]byte(e.Data), &notification); err != nil {
+		return false
+	}
+	return f.match(notification)
+}
+
+// notificationHistoryEnabled сообщает, нужно ли записывать уведомления всех подключённых устройств
+// без клиентов. Включено по умолчанию; NOTIFICATION_HISTORY=false оставляет запись только на время,
+// пока поток кто-то читает.
+func notificationHistoryEnabled() bool {
+	return os.Getenv("NOTIFICATION_HISTORY") != "false"
+}
+
+func init() {
+	onDeviceAttached(func(udid string) {
+		if notificationHistoryEnabled() {
+			retainBusFeed(EventAppState, udid)
+		}
+	})
+	onDeviceDetached(func(udid string) {
+		if notificationHistoryEnabled() {
+			releaseBusFeed(EventAppState, udid)
+		}
+	})
+}
+
+// NotificationHistory godoc
+// @Summary      История состояний приложений
+// @Description  Возвращает уведомления о состоянии приложений из памяти peer (до 1000 последних на устройство) от старых к новым. История пополняется всё время, пока устройство подключено; при NOTIFICATION_HISTORY=false — только пока открыт поток /notifications или подписка app.state.
+// @Tags         general
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        bundleID  query  string  false  "bundleID приложения, несколько через запятую"
+// @Param        state  query  string  false  "Состояние, например foreground, background, suspended, terminated; несколько через запятую"
+// @Param        since  query  string  false  "Не раньше: RFC3339, unix-миллисекунды или отрицательная длительность"
+// @Param        limit  query  int  false  "Только последние limit уведомлений"
+// @Success      200  {array}  AppStateNotification
+// @Failure      422  {object}  GenericResponse
+// @Router       /device/{udid}/notifications/history [get]
+func NotificationHistory(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	filter := parseAppStateFilter(c)
+	var since time.Time
+	if value := c.Query("since"); value != "" {
+		t, err := parseTimeQuery(value)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "since: " + err.Error()})
+			return
+		}
+		since = t
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+
+	feed := getEventFeed("notifications", device.Properties.SerialNumber, defaultFeedHistory, defaultFeedClientBuffer)
+	history := []AppStateNotification{}
+	for _, e := range feed.snapshot() {
+		if e.Event != "notification" || e.At.Before(since) {
+			continue
+		}
+		var notification map[string]interface{}
+		if err := json.Unmarshal([]byte(e.Data), &notification); err != nil || !filter.match(notification) {
+			continue
+		}
+		history = append(history, AppStateNotification{ID: e.ID, Time: e.At.UTC(), Notification: notification})
+	}
+	if limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	c.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,477 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/afc"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// crashPollInterval — как часто наблюдатель проверяет новые отчёты: сервис отчётов
+	// не присылает уведомлений, его можно только опрашивать.
+	crashPollInterval = 5 * time.Second
+	// crashMaxPollInterval ограничивает паузу между опросами после ошибок.
+	crashMaxPollInterval = time.Minute
+	// crashFeedHistory меньше обычного: в событиях лежат целые отчёты.
+	crashFeedHistory = 100
+
+	crashMoverService      = "com.apple.crashreportmover"
+	crashCopyMobileService = "com.apple.crashreportcopymobile"
+)
+
+var errCrashNotFound = errors.New("crash report not found")
+
+// crashNamePattern разбирает имя отчёта вида "MyApp-2026-10-18-150405.ips",
+// "com.apple.WebKit.WebContent-2026-10-18-150405.ips" или
+// "ExcUserFault_MyApp.cpu_resource-2026-10-18-150405.ips". Имя процесса может содержать точки,
+// поэтому отбрасывается только суффикс вида ресурса (.cpu_resource, .diskwrites_resource и т. п.).
+var crashNamePattern = regexp.MustCompile(`^(?:ExcUserFault_)?(.+?)(?:\.\w+_resource)?-(\d{4}-\d{2}-\d{2}-\d{6})\.(ips|crash)$`)
+
+// CrashReport — отчёт о сбое на устройстве. Process и Date берутся из имени файла,
+// BundleID и остальные поля — из заголовка отчёта .ips, если он был прочитан.
+type CrashReport struct {
+	Name       string `json:"name"`
+	Process    string `json:"process"`
+	Date       string `json:"date"`
+	BundleID   string `json:"bundleId,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	BugType    string `json:"bugType,omitempty"`
+	IncidentID string `json:"incidentId,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	OSVersion  string `json:"osVersion,omitempty"`
+	// Content — текст отчёта, только в событиях /crashes/watch.
+	Content string `json:"content,omitempty"`
+}
+
+// ParsedCrashReport — отчёт .ips: первая строка — заголовок JSON, остальное — тело JSON.
+type ParsedCrashReport struct {
+	Header map[string]interface{} `json:"header"`
+	Report map[string]interface{} `json:"report"`
+}
+
+// ipsHeader — поля заголовка .ips, которые попадают в CrashReport.
+type ipsHeader struct {
+	BundleID   string `json:"bundleID"`
+	AppVersion string `json:"app_version"`
+	BugType    string `json:"bug_type"`
+	IncidentID string `json:"incident_id"`
+	Timestamp  string `json:"timestamp"`
+	OSVersion  string `json:"os_version"`
+}
+
+// crashReportFromName разбирает имя файла. Для файлов, которые не похожи на отчёт (каталоги
+// Retired, служебные файлы), возвращает false.
+func crashReportFromName(name string) (CrashReport, bool) {
+	match := crashNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return CrashReport{}, false
+	}
+	return CrashReport{Name: name, Process: match[1], Date: match[2]}, true
+}
+
+// withHeader дополняет отчёт полями заголовка .ips.
+func (r CrashReport) withHeader(content []byte) CrashReport {
+	line, _, _ := bytes.Cut(content, []byte("\n"))
+	var header ipsHeader
+	if json.Unmarshal(line, &header) != nil {
+		return r
+	}
+	r.BundleID = header.BundleID
+	r.AppVersion = header.AppVersion
+	r.BugType = header.BugType
+	r.IncidentID = header.IncidentID
+	r.Timestamp = header.Timestamp
+	r.OSVersion = header.OSVersion
+	return r
+}
+
+func parseCrashReport(content []byte) (ParsedCrashReport, error) {
+	var parsed ParsedCrashReport
+	line, body, _ := bytes.Cut(content, []byte("\n"))
+	if err := json.Unmarshal(line, &parsed.Header); err != nil {
+		return parsed, fmt.Errorf("not an .ips report: %w", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return parsed, nil
+	}
+	if err := json.Unmarshal(body, &parsed.Report); err != nil {
+		return parsed, fmt.Errorf("not an .ips report: %w", err)
+	}
+	return parsed, nil
+}
+
+// openCrashStore переносит новые отчёты в доступный каталог и открывает соединение AFC
+// с хранилищем отчётов. Соединение закрывает вызывающий. Функции go-ios crashreport
+// не закрывают свои соединения, поэтому сервисы открываются здесь.
+func openCrashStore(device ios.DeviceEntry) (*afc.Connection, error) {
+	if err := moveCrashReports(device); err != nil {
+		return nil, err
+	}
+	conn, err := ios.ConnectToService(device, crashCopyMobileService)
+	if err != nil {
+		return nil, err
+	}
+	return afc.NewFromConn(conn), nil
+}
+
+// moveCrashReports запускает перенос отчётов: сервис отвечает "ping", когда перенос закончен.
+func moveCrashReports(device ios.DeviceEntry) error {
+	conn, err := ios.ConnectToService(device, crashMoverService)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ping := make([]byte, 4)
+	if _, err := io.ReadFull(conn.Reader(), ping); err != nil {
+		return err
+	}
+	if string(ping) != "ping" {
+		return fmt.Errorf("did not receive ping from crash report mover: %x", ping)
+	}
+	return nil
+}
+
+// listCrashReports возвращает отчёты в корне хранилища.
+func listCrashReports(store *afc.Connection) ([]CrashReport, error) {
+	names, err := store.ListFiles(".", "*")
+	if err != nil {
+		return nil, err
+	}
+	reports := []CrashReport{}
+	for _, name := range names {
+		if report, ok := crashReportFromName(name); ok {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// downloadCrashReport читает отчёт name из хранилища.
+func downloadCrashReport(store *afc.Connection, name string) ([]byte, error) {
+	if _, err := store.Stat(name); err != nil {
+		return nil, errCrashNotFound
+	}
+	dir, err := os.MkdirTemp("", "goios-crash")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, name)
+	if err := store.PullSingleFile(name, target); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(target)
+}
+
+// crashReportName проверяет имя из пути: оно передаётся в go-ios как шаблон, поэтому
+// символы шаблона и пути запрещены.
+func crashReportName(c *gin.Context) (string, bool) {
+	name := c.Param("name")
+	if _, ok := crashReportFromName(name); !ok || strings.ContainsAny(name, `/\*?[`) {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: name + " is not a crash report name"})
+		return "", false
+	}
+	return name, true
+}
+
+// crashBundleFilter возвращает отбор отчётов по ?bundleID=. Отчёт подходит, если его процесс —
+// исполняемый файл приложения или bundleID в заголовке совпадает. Nil — параметр не задан.
+// При ошибке возвращается и код ответа.
+func crashBundleFilter(c *gin.Context, device ios.DeviceEntry) (func(CrashReport) bool, int, error) {
+	bundleID := c.Query("bundleID")
+	if bundleID == "" {
+		return nil, 0, nil
+	}
+	app, err := findInstalledApp(device, bundleID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if app == nil || app.CFBundleExecutable() == "" {
+		return nil, http.StatusNotFound, errors.New(bundleID + " is not installed")
+	}
+	executable := app.CFBundleExecutable()
+	return func(r CrashReport) bool {
+		return r.BundleID == bundleID || r.Process == executable
+	}, 0, nil
+}
+
+// crashSource опрашивает отчёты устройства и публикует событие crash для каждого нового.
+// Отчёты, которые были на устройстве при запуске, событий не создают. Каждый опрос открывает
+// и закрывает свои соединения; после ошибки опрос повторяется с растущей паузой.
+func crashSource(device ios.DeviceEntry) feedSource {
+	return func(stop <-chan struct{}, ready func(), publish func(event string, data string)) error {
+		seen := make(map[string]bool)
+		store, err := openCrashStore(device)
+		if err != nil {
+			return err
+		}
+		reports, err := listCrashReports(store)
+		store.Close()
+		if err != nil {
+			return err
+		}
+		for _, r := range reports {
+			seen[r.Name] = true
+		}
+		ready()
+		interval := crashPollInterval
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(interval):
+			}
+			if err := pollCrashReports(device, seen, publish); err != nil {
+				interval = min(interval*2, crashMaxPollInterval)
+				log.WithField("udid", device.Properties.SerialNumber).WithError(err).Warnf("failed polling crash reports, retrying in %s", interval)
+				continue
+			}
+			interval = crashPollInterval
+		}
+	}
+}
+
+// pollCrashReports публикует отчёты, которых нет в seen, и добавляет их туда.
+func pollCrashReports(device ios.DeviceEntry, seen map[string]bool, publish func(event string, data string)) error {
+	store, err := openCrashStore(device)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	reports, err := listCrashReports(store)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		if seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		content, err := downloadCrashReport(store, r.Name)
+		if err != nil {
+			log.WithField("udid", device.Properties.SerialNumber).WithError(err).Warnf("failed downloading crash report %s", r.Name)
+		} else {
+			r = r.withHeader(content)
+			r.Content = string(content)
+		}
+		publish("crash", MustMarshal(r))
+	}
+	return nil
+}
+
+// ListCrashReports godoc
+// @Summary      Список отчётов о сбоях
+// @Description  Возвращает отчёты о сбоях с устройства через сервис crash report. Имя отчёта используется для скачивания и удаления.
+// @Tags         crashes
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        bundleID  query  string  false  "Только отчёты процесса приложения с этим bundleID"
+// @Success      200  {array}  CrashReport
+// @Failure      404  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/crashes [get]
+func ListCrashReports(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	filter, status, err := crashBundleFilter(c, device)
+	if err != nil {
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	store, err := openCrashStore(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	defer store.Close()
+	reports, err := listCrashReports(store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if filter != nil {
+		matching := []CrashReport{}
+		for _, r := range reports {
+			if filter(r) {
+				matching = append(matching, r)
+			}
+		}
+		reports = matching
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+// GetCrashReport godoc
+// @Summary      Скачать отчёт о сбое
+// @Description  Отдаёт отчёт файлом как есть. С format=json отчёт .ips разбирается: заголовок и тело возвращаются объектами JSON.
+// @Tags         crashes
+// @Produce      octet-stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        name  path      string  true  "Имя отчёта"
+// @Param        format  query  string  false  "raw (по умолчанию) или json"
+// @Success      200  {object}  ParsedCrashReport
+// @Failure      404  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/crashes/{name} [get]
+func GetCrashReport(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	name, ok := crashReportName(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "raw")
+	if format != "raw" && format != "json" {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "format must be raw or json"})
+		return
+	}
+	store, err := openCrashStore(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	defer store.Close()
+	content, err := downloadCrashReport(store, name)
+	if errors.Is(err, errCrashNotFound) {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if format == "json" {
+		parsed, err := parseCrashReport(content)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, parsed)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Data(http.StatusOK, "application/octet-stream", content)
+}
+
+// DeleteCrashReport godoc
+// @Summary      Удалить отчёт о сбое
+// @Tags         crashes
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        name  path      string  true  "Имя отчёта"
+// @Success      200  {object}  GenericResponse
+// @Failure      404  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/crashes/{name} [delete]
+func DeleteCrashReport(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	name, ok := crashReportName(c)
+	if !ok {
+		return
+	}
+	store, err := openCrashStore(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	defer store.Close()
+	if _, err := store.Stat(name); err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errCrashNotFound.Error()})
+		return
+	}
+	if err := store.Remove(name); err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: name + " deleted"})
+}
+
+// DeleteCrashReports godoc
+// @Summary      Удалить отчёты о сбоях
+// @Description  Удаляет все отчёты или только отчёты процесса приложения bundleID.
+// @Tags         crashes
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        bundleID  query  string  false  "Удалить только отчёты приложения с этим bundleID"
+// @Success      200  {array}  CrashReport
+// @Failure      404  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/crashes [delete]
+func DeleteCrashReports(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	filter, status, err := crashBundleFilter(c, device)
+	if err != nil {
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	store, err := openCrashStore(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	defer store.Close()
+	reports, err := listCrashReports(store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	deleted := []CrashReport{}
+	for _, r := range reports {
+		if filter != nil && !filter(r) {
+			continue
+		}
+		if err := store.Remove(r.Name); err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		deleted = append(deleted, r)
+	}
+	c.JSON(http.StatusOK, deleted)
+}
+
+// WatchCrashReports godoc
+// @Summary      Поток новых отчётов о сбоях
+// @Description  Поток SSE с event: crash для каждого нового отчёта на устройстве; в data — CrashReport вместе с текстом отчёта в content. Отчёты, которые уже были на устройстве, не отправляются. Устройство опрашивается раз в 5 секунд одним наблюдателем на всех клиентов, после ошибок опроса пауза растёт до минуты; с заголовком Last-Event-ID пропущенные события отправляются из истории.
+// @Tags         crashes
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        bundleID  query  string  false  "Только отчёты приложения с этим bundleID"
+// @Param        format  query  string  false  "sse (по умолчанию) или ndjson"
+// @Param        lastEventId  query  int  false  "Номер последнего полученного события, если нельзя передать Last-Event-ID"
+// @Success      200  {object}  CrashReport
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/crashes/watch [get]
+func WatchCrashReports(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	filter, status, err := crashBundleFilter(c, device)
+	if err != nil {
+		feedErrorResponse(c, status, err)
+		return
+	}
+	var accept func(feedEvent) bool
+	if filter != nil {
+		accept = func(e feedEvent) bool {
+			var r CrashReport
+			if e.Event != "crash" {
+				return true
+			}
+			return json.Unmarshal([]byte(e.Data), &r) == nil && filter(r)
+		}
+	}
+	feed := getEventFeed("crashes", device.Properties.SerialNumber, crashFeedHistory, defaultFeedClientBuffer)
+	serveFeed(c, feed, crashSource(device), accept)
+}
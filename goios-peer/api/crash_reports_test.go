@@ -0,0 +1,26 @@
+package api
+
+import "testing"
+
+func TestCrashReportFromName(t *testing.T) {
+	tests := []struct {
+		name    string
+		process string
+		date    string
+		ok      bool
+	}{
+		{"MyApp-2026-10-18-150405.ips", "MyApp", "2026-10-18-150405", true},
+		{"com.apple.WebKit.WebContent-2026-10-18-150405.ips", "com.apple.WebKit.WebContent", "2026-10-18-150405", true},
+		{"ExcUserFault_MyApp.cpu_resource-2026-10-18-150405.ips", "MyApp", "2026-10-18-150405", true},
+		{"My-App.diskwrites_resource-2026-10-18-150405.ips", "My-App", "2026-10-18-150405", true},
+		{"SpringBoard-2026-10-18-150405.crash", "SpringBoard", "2026-10-18-150405", true},
+		{"Retired", "", "", false},
+		{"MyApp-2026-10-18.ips", "", "", false},
+	}
+	for _, tt := range tests {
+		report, ok := crashReportFromName(tt.name)
+		if ok != tt.ok || report.Process != tt.process || report.Date != tt.date {
+			t.Errorf("crashReportFromName(%q) = %q, %q, %v; want %q, %q, %v", tt.name, report.Process, report.Date, ok, tt.process, tt.date, tt.ok)
+		}
+	}
+}
@@ -2,11 +2,14 @@ package api
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/danielpaulus/go-ios/ios/imagemounter"
 	"github.com/danielpaulus/go-ios/ios/mobileactivation"
@@ -58,6 +61,30 @@ func GetImages(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 
 }
+
+// ImageMountResult — результат монтирования образа разработчика в событиях ddi.mount.
+type ImageMountResult struct {
+	Udid    string `json:"udid"`
+	Auto    bool   `json:"auto"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// mountImage монтирует образ и сообщает результат подписчикам ddi.mount.
+func mountImage(device ios.DeviceEntry, path string, auto bool) error {
+	err := imagemounter.MountImage(device, path)
+	notifyImageMount(device, auto, err)
+	return err
+}
+
+func notifyImageMount(device ios.DeviceEntry, auto bool, err error) {
+	result := ImageMountResult{Udid: device.Properties.SerialNumber, Auto: auto, Success: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	publishEvent(EventImageMount, result.Udid, result)
+}
+
 func InstallImage(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
 	auto := c.Query("auto")
@@ -69,10 +96,11 @@ func InstallImage(c *gin.Context) {
 
 		path, err := imagemounter.DownloadImageFor(device, basedir)
 		if err != nil {
+			notifyImageMount(device, true, err)
 			c.JSON(http.StatusInternalServerError, err)
 			return
 		}
-		err = imagemounter.MountImage(device, path)
+		err = mountImage(device, path, true)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, err)
 			return
@@ -100,7 +128,7 @@ func InstallImage(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, err)
 		return
 	}
-	err = imagemounter.MountImage(device, tempfilepath)
+	err = mountImage(device, tempfilepath, false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err)
 		return
@@ -149,30 +177,51 @@ func Info(c *gin.Context) {
 // Скриншот с устройства
 // Screenshot                godoc
 // @Summary      Получить скриншот устройства
-// @Description Делает скриншот в формате PNG и возвращает его.
+// @Description Делает скриншот и возвращает его в PNG или JPEG. Можно обрезать область экрана и уменьшить изображение. WebP отдаётся как JPEG, пока нет кодировщика WebP.
 // @Tags         general_device_specific
 // @Produce      png
+// @Produce      jpeg
 // @Param        udid  path      string  true  "UDID устройства"
+// @Param        format  query  string  false  "Формат: png, jpeg или webp (если доступен), по умолчанию png"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 80"
+// @Param        scale  query  number  false  "Коэффициент уменьшения, (0, 1]"
+// @Param        width  query  int  false  "Ширина результата с сохранением пропорций"
+// @Param        crop  query  string  false  "Область x,y,w,h в пикселях устройства"
 // @Success      200  {object}  []byte
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Header       200  {int}  X-Device-Width  "Ширина экрана в пикселях устройства"
+// @Header       200  {int}  X-Device-Height  "Высота экрана в пикселях устройства"
+// @Header       200  {string}  X-Capture-Timestamp  "Время захвата, RFC3339"
 // @Router       /device/{udid}/screenshot [get]
 func Screenshot(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	opts, err := parseScreenshotOptions(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
 
-	screenshotService, err := instruments.NewScreenshotService(device)
+	imageBytes, capturedAt, err := getStreamManager(device).Screenshot()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
 		return
 	}
-	defer screenshotService.Close()
-
-	imageBytes, err := screenshotService.TakeScreenshot()
+	rendered, err := renderScreenshot(imageBytes, opts)
+	if errors.Is(err, errInvalidScreenshotOptions) {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
 		return
 	}
 
-	c.Header("Content-Type", "image/png")
-	c.Data(http.StatusOK, "application/octet-stream", imageBytes)
+	c.Header("X-Device-Width", strconv.Itoa(rendered.DeviceWidth))
+	c.Header("X-Device-Height", strconv.Itoa(rendered.DeviceHeight))
+	c.Header("X-Capture-Timestamp", capturedAt.UTC().Format(time.RFC3339Nano))
+	c.Header("Content-Length", strconv.Itoa(len(rendered.Data)))
+	c.Data(http.StatusOK, rendered.ContentType, rendered.Data)
 }
 
 // Изменение текущего местоположения устройства
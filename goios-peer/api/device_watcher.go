@@ -0,0 +1,380 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+type DeviceState string
+
+const (
+	DeviceStateAttached DeviceState = "attached"
+	DeviceStateDetached DeviceState = "detached"
+)
+
+// RegisteredDevice — устройство в реестре peer. Одно устройство может быть подключено
+// одновременно по USB и по сети; ConnectionType — подключение, которое используется для запросов.
+type RegisteredDevice struct {
+	Udid            string      `json:"udid"`
+	State           DeviceState `json:"state"`
+	ConnectionType  string      `json:"connectionType,omitempty"`
+	ConnectionTypes []string    `json:"connectionTypes"`
+	FirstSeen       time.Time   `json:"firstSeen"`
+	// LastSeen — время последнего подключения, а для отключённого устройства — время отключения.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// deviceRecord хранит подключения устройства к usbmuxd по DeviceID.
+type deviceRecord struct {
+	info        RegisteredDevice
+	connections map[int]ios.DeviceEntry
+}
+
+// preferred возвращает подключение для запросов: USB, если оно есть, иначе с наименьшим DeviceID.
+func (r *deviceRecord) preferred() (ios.DeviceEntry, bool) {
+	var found ios.DeviceEntry
+	ok := false
+	for _, entry := range r.connections {
+		usb, foundUSB := entry.Properties.ConnectionType == "USB", found.Properties.ConnectionType == "USB"
+		if !ok || (usb && !foundUSB) || (usb == foundUSB && entry.DeviceID < found.DeviceID) {
+			found, ok = entry, true
+		}
+	}
+	return found, ok
+}
+
+func (r *deviceRecord) refresh() {
+	r.info.ConnectionTypes = []string{}
+	for _, entry := range r.connections {
+		r.info.ConnectionTypes = append(r.info.ConnectionTypes, entry.Properties.ConnectionType)
+	}
+	sort.Strings(r.info.ConnectionTypes)
+	r.info.ConnectionType = ""
+	if entry, ok := r.preferred(); ok {
+		r.info.ConnectionType = entry.Properties.ConnectionType
+	}
+}
+
+// Реестр устройств заполняется одной подпиской ios.Listen. Пока подписка работает (synced),
+// /list и DeviceMiddleware отвечают из памяти, не обращаясь к usbmuxd. Сообщение Detached
+// от usbmuxd содержит только DeviceID, поэтому реестр хранит UDID каждого подключения.
+var (
+	registryMu     sync.Mutex
+	registry       = make(map[string]*deviceRecord)
+	deviceIDs      = make(map[int]string)
+	registrySynced bool
+
+	// listenMu объединяет изменение реестра с публикацией в поток "listen", чтобы новый клиент
+	// /listen получил снимок реестра и затем только более поздние события.
+	listenMu sync.Mutex
+
+	attachHandlersMu sync.Mutex
+	attachHandlers   []func(udid string)
+
+	detachHandlersMu sync.Mutex
+	detachHandlers   []func(udid string)
+)
+
+// onDeviceAttached регистрирует обработчик, который вызывается с UDID подключившегося устройства,
+// в том числе для устройств, подключённых до запуска наблюдателя. Второе подключение того же
+// устройства (USB и сеть) обработчик не вызывает.
+func onDeviceAttached(handler func(udid string)) {
+	attachHandlersMu.Lock()
+	defer attachHandlersMu.Unlock()
+	attachHandlers = append(attachHandlers, handler)
+}
+
+func notifyDeviceAttached(udid string) {
+	attachHandlersMu.Lock()
+	handlers := append([]func(string){}, attachHandlers...)
+	attachHandlersMu.Unlock()
+	for _, handler := range handlers {
+		handler(udid)
+	}
+}
+
+// onDeviceDetached регистрирует обработчик, который вызывается с UDID устройства,
+// когда пропало его последнее подключение.
+func onDeviceDetached(handler func(udid string)) {
+	detachHandlersMu.Lock()
+	defer detachHandlersMu.Unlock()
+	detachHandlers = append(detachHandlers, handler)
+}
+
+func notifyDeviceDetached(udid string) {
+	detachHandlersMu.Lock()
+	handlers := append([]func(string){}, detachHandlers...)
+	detachHandlersMu.Unlock()
+	for _, handler := range handlers {
+		handler(udid)
+	}
+}
+
+// registerAttached добавляет подключение и сообщает, было ли оно первым у устройства
+// и было ли оно новым: при сверке после переподключения к usbmuxd известные подключения
+// приходят повторно.
+func registerAttached(entry ios.DeviceEntry) (string, bool, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	udid := entry.Properties.SerialNumber
+	now := time.Now().UTC()
+	record, ok := registry[udid]
+	if !ok {
+		record = &deviceRecord{info: RegisteredDevice{Udid: udid, FirstSeen: now}, connections: make(map[int]ios.DeviceEntry)}
+		registry[udid] = record
+	}
+	_, known := record.connections[entry.DeviceID]
+	first := len(record.connections) == 0
+	record.connections[entry.DeviceID] = entry
+	deviceIDs[entry.DeviceID] = udid
+	record.refresh()
+	if known {
+		return udid, false, false
+	}
+	record.info.State = DeviceStateAttached
+	record.info.LastSeen = now
+	return udid, first, true
+}
+
+// registerDetached убирает подключение и сообщает, было ли оно последним у устройства.
+func registerDetached(deviceID int) (string, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	udid, ok := deviceIDs[deviceID]
+	if !ok {
+		return "", false
+	}
+	delete(deviceIDs, deviceID)
+	record := registry[udid]
+	delete(record.connections, deviceID)
+	record.refresh()
+	if len(record.connections) > 0 {
+		return udid, false
+	}
+	record.info.State = DeviceStateDetached
+	record.info.LastSeen = time.Now().UTC()
+	return udid, true
+}
+
+// setRegistrySynced отмечает, соответствует ли реестр usbmuxd.
+func setRegistrySynced(synced bool) {
+	registryMu.Lock()
+	registrySynced = synced
+	registryMu.Unlock()
+}
+
+// lookupDevice возвращает подключённое устройство из реестра. Пока реестр не синхронизирован
+// с usbmuxd, устройство ищется через usbmuxd.
+func lookupDevice(udid string) (ios.DeviceEntry, error) {
+	registryMu.Lock()
+	synced := registrySynced
+	var entry ios.DeviceEntry
+	found := false
+	if record, ok := registry[udid]; ok {
+		entry, found = record.preferred()
+	}
+	registryMu.Unlock()
+	if !synced {
+		return ios.GetDevice(udid)
+	}
+	if !found {
+		return entry, fmt.Errorf("device '%s' not found", udid)
+	}
+	return entry, nil
+}
+
+// listAttachedDevices возвращает подключения в формате usbmuxd ListDevices.
+func listAttachedDevices() (ios.DeviceList, error) {
+	registryMu.Lock()
+	synced := registrySynced
+	list := ios.DeviceList{DeviceList: []ios.DeviceEntry{}}
+	for _, record := range registry {
+		for _, entry := range record.connections {
+			list.DeviceList = append(list.DeviceList, entry)
+		}
+	}
+	registryMu.Unlock()
+	if !synced {
+		return ios.ListDevices()
+	}
+	sort.Slice(list.DeviceList, func(i, j int) bool { return list.DeviceList[i].DeviceID < list.DeviceList[j].DeviceID })
+	return list, nil
+}
+
+// registeredDevice возвращает запись реестра об устройстве.
+func registeredDevice(udid string) (RegisteredDevice, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	record, ok := registry[udid]
+	if !ok {
+		return RegisteredDevice{}, false
+	}
+	info := record.info
+	info.ConnectionTypes = append([]string{}, info.ConnectionTypes...)
+	return info, true
+}
+
+// attachedDevices возвращает UDID подключённых устройств.
+func attachedDevices() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	udids := make([]string, 0, len(registry))
+	for udid, record := range registry {
+		if len(record.connections) > 0 {
+			udids = append(udids, udid)
+		}
+	}
+	return udids
+}
+
+// StartDeviceWatcher держит одну подписку ios.Listen и переподключается при её обрыве.
+func StartDeviceWatcher() {
+	go func() {
+		for {
+			err := watchDevices()
+			setRegistrySynced(false)
+			log.WithError(err).Warn("device watcher stopped, reconnecting")
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+// watchDevices подписывается на usbmuxd и сверяет реестр со списком устройств: подключения,
+// пропавшие, пока подписки не было, считаются отключёнными. Listen открывается до запроса
+// списка, чтобы не пропустить события между ними.
+func watchDevices() error {
+	receive, closeFunc, err := ios.Listen()
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+	list, err := ios.ListDevices()
+	if err != nil {
+		return err
+	}
+	current := make(map[int]bool, len(list.DeviceList))
+	for _, entry := range list.DeviceList {
+		current[entry.DeviceID] = true
+	}
+	registryMu.Lock()
+	var gone []int
+	for deviceID := range deviceIDs {
+		if !current[deviceID] {
+			gone = append(gone, deviceID)
+		}
+	}
+	registryMu.Unlock()
+	for _, deviceID := range gone {
+		handleDeviceMessage(ios.AttachedMessage{MessageType: "Detached", DeviceID: deviceID})
+	}
+	for _, entry := range list.DeviceList {
+		handleDeviceMessage(ios.AttachedMessage{MessageType: "Attached", DeviceID: entry.DeviceID, Properties: entry.Properties})
+	}
+	setRegistrySynced(true)
+
+	for {
+		msg, err := receive()
+		if err != nil {
+			return err
+		}
+		handleDeviceMessage(msg)
+	}
+}
+
+// handleDeviceMessage обновляет реестр, передаёт клиентам /listen сообщения, которые его
+// изменили, и вызывает обработчики подключения и отключения.
+func handleDeviceMessage(msg ios.AttachedMessage) {
+	udid, changed := applyDeviceMessage(msg)
+	if !changed {
+		return
+	}
+	switch {
+	case msg.DeviceAttached():
+		log.WithField("udid", udid).Infof("device attached via %s", msg.Properties.ConnectionType)
+		notifyDeviceAttached(udid)
+	case msg.DeviceDetached():
+		log.WithField("udid", udid).Info("device detached")
+		notifyDeviceDetached(udid)
+	}
+}
+
+// applyDeviceMessage обновляет реестр и публикует сообщение в поток "listen", если оно
+// добавило или убрало подключение. Возвращает UDID и true, если устройство подключилось
+// первым подключением или потеряло последнее.
+func applyDeviceMessage(msg ios.AttachedMessage) (string, bool) {
+	listenMu.Lock()
+	defer listenMu.Unlock()
+	feed := getEventFeed("listen", "", defaultFeedHistory, defaultFeedClientBuffer)
+	switch {
+	case msg.DeviceAttached():
+		udid, first, added := registerAttached(msg.DeviceEntry())
+		if !added {
+			return udid, false
+		}
+		feed.publish("device", MustMarshal(msg))
+		return udid, first
+	case msg.DeviceDetached():
+		udid, last := registerDetached(msg.DeviceID)
+		if udid == "" {
+			return "", false
+		}
+		feed.publish("device", MustMarshal(msg))
+		return udid, last
+	}
+	return "", false
+}
+
+// subscribeListen подписывает клиента /listen. Клиент без Last-Event-ID, как и у usbmuxd,
+// сначала получает сообщения Attached обо всех подключениях из реестра; у них номер последнего
+// события потока, чтобы после переподключения клиент продолжил с него.
+func subscribeListen(feed *eventFeed, lastID uint64, resume bool) ([]feedEvent, *feedSubscription) {
+	listenMu.Lock()
+	defer listenMu.Unlock()
+	replay, sub := feed.subscribe(listenSource, lastID, resume)
+	if resume {
+		return replay, sub
+	}
+	id, now := feed.lastEventID(), time.Now()
+	list, _ := listAttachedDevices()
+	for _, entry := range list.DeviceList {
+		msg := ios.AttachedMessage{MessageType: "Attached", DeviceID: entry.DeviceID, Properties: entry.Properties}
+		replay = append(replay, feedEvent{ID: id, At: now, Event: "device", Data: MustMarshal(msg)})
+	}
+	return replay, sub
+}
+
+// ListRegisteredDevices godoc
+// @Summary      Реестр устройств
+// @Description  Возвращает устройства, которые peer видел с момента запуска: состояние, типы подключения, время первого и последнего появления. Отвечает из памяти, без запроса к usbmuxd.
+// @Tags         general
+// @Produce      json
+// @Param        state  query  string  false  "attached или detached"
+// @Success      200  {array}  RegisteredDevice
+// @Failure      422  {object}  GenericResponse
+// @Router       /devices [get]
+func ListRegisteredDevices(c *gin.Context) {
+	state := DeviceState(c.Query("state"))
+	if state != "" && state != DeviceStateAttached && state != DeviceStateDetached {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "state must be attached or detached"})
+		return
+	}
+	registryMu.Lock()
+	devices := []RegisteredDevice{}
+	for _, record := range registry {
+		if state == "" || record.info.State == state {
+			info := record.info
+			info.ConnectionTypes = append([]string{}, info.ConnectionTypes...)
+			devices = append(devices, info)
+		}
+	}
+	registryMu.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].FirstSeen.Before(devices[j].FirstSeen) })
+	c.JSON(http.StatusOK, devices)
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Типы событий шины. Они же используются в вебхуках.
+const (
+	EventDeviceAttached = "device.attached"
+	EventDeviceDetached = "device.detached"
+	EventAppState       = "app.state"
+	EventWdaSession     = "wda.session"
+	EventImageMount     = "ddi.mount"
+	EventSyslog         = "syslog"
+	EventCrash          = "crash"
+)
+
+// AllDevices в подписке означает события всех устройств.
+const AllDevices = "*"
+
+// busClientBuffer — сколько событий может ждать отправки одному подписчику шины.
+const busClientBuffer = 1024
+
+var errBusSlowClient = errors.New("client is too slow, events were dropped")
+
+// BusEvent — событие шины.
+type BusEvent struct {
+	Udid      string          `json:"udid,omitempty"`
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// busFeed описывает событие, которое приходит из потока устройства (event_feed.go). Такой поток
+// работает, только пока у него есть читатель, поэтому подписка на событие удерживает поток.
+type busFeed struct {
+	kind         string
+	event        string
+	history      int
+	clientBuffer int
+	source       func(ios.DeviceEntry) feedSource
+}
+
+var busFeeds = map[string]busFeed{
+	EventAppState: {kind: "notifications", event: "notification", history: defaultFeedHistory, clientBuffer: defaultFeedClientBuffer, source: notificationsSource},
+	EventSyslog:   {kind: "syslog", event: "log", history: syslogFeedHistory, clientBuffer: syslogClientBuffer, source: syslogSource},
+	EventCrash:    {kind: "crashes", event: "crash", history: crashFeedHistory, clientBuffer: defaultFeedClientBuffer, source: crashSource},
+}
+
+var busEventTypes = []string{EventDeviceAttached, EventDeviceDetached, EventAppState, EventWdaSession, EventImageMount, EventSyslog, EventCrash}
+
+// feedBusType возвращает тип события шины для события event потока kind или пустую строку.
+func feedBusType(kind string, event string) string {
+	for eventType, feed := range busFeeds {
+		if feed.kind == kind && feed.event == event {
+			return eventType
+		}
+	}
+	return ""
+}
+
+// busTopic — тип события и устройство, udid может быть AllDevices.
+type busTopic struct {
+	eventType string
+	udid      string
+}
+
+// busSubscription — подписчик шины. Когда он не успевает, канал закрывается, а в err
+// записывается причина.
+type busSubscription struct {
+	topics map[busTopic]bool
+	events chan BusEvent
+	err    error
+}
+
+var (
+	busMu          sync.Mutex
+	busHandlers    []func(BusEvent)
+	busSubscribers = make(map[*busSubscription]struct{})
+)
+
+func init() {
+	onDeviceAttached(func(udid string) {
+		publishEvent(EventDeviceAttached, udid, devicePayload(udid))
+	})
+	onDeviceDetached(func(udid string) {
+		publishEvent(EventDeviceDetached, udid, devicePayload(udid))
+	})
+}
+
+// devicePayload возвращает запись реестра об устройстве для событий подключения и отключения.
+func devicePayload(udid string) interface{} {
+	if device, ok := registeredDevice(udid); ok {
+		return device
+	}
+	return gin.H{"udid": udid}
+}
+
+// onBusEvent регистрирует обработчик всех событий шины. Обработчик вызывается синхронно
+// при публикации и не должен блокироваться.
+func onBusEvent(handler func(BusEvent)) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	busHandlers = append(busHandlers, handler)
+}
+
+// publishEvent публикует событие eventType устройства udid с payload в формате JSON.
+func publishEvent(eventType string, udid string, payload interface{}) {
+	publishBusEvent(BusEvent{Udid: udid, Type: eventType, Timestamp: time.Now().UTC(), Payload: json.RawMessage(MustMarshal(payload))})
+}
+
+func publishBusEvent(e BusEvent) {
+	busMu.Lock()
+	handlers := busHandlers
+	for sub := range busSubscribers {
+		if !sub.topics[busTopic{e.Type, e.Udid}] && !sub.topics[busTopic{e.Type, AllDevices}] {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			delete(busSubscribers, sub)
+			sub.err = errBusSlowClient
+			close(sub.events)
+		}
+	}
+	busMu.Unlock()
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+func newBusSubscription() *busSubscription {
+	sub := &busSubscription{topics: make(map[busTopic]bool), events: make(chan BusEvent, busClientBuffer)}
+	busMu.Lock()
+	busSubscribers[sub] = struct{}{}
+	busMu.Unlock()
+	return sub
+}
+
+// subscribe добавляет темы и возвращает те из них, которых ещё не было. После close или
+// отключения медленного подписчика ничего не делает: темы уже никто не отпустит.
+func (s *busSubscription) subscribe(topics []busTopic) []busTopic {
+	busMu.Lock()
+	defer busMu.Unlock()
+	if _, ok := busSubscribers[s]; !ok {
+		return nil
+	}
+	var added []busTopic
+	for _, topic := range topics {
+		if !s.topics[topic] {
+			s.topics[topic] = true
+			added = append(added, topic)
+		}
+	}
+	return added
+}
+
+// unsubscribe убирает темы и возвращает те из них, которые были.
+func (s *busSubscription) unsubscribe(topics []busTopic) []busTopic {
+	busMu.Lock()
+	defer busMu.Unlock()
+	var removed []busTopic
+	for _, topic := range topics {
+		if s.topics[topic] {
+			delete(s.topics, topic)
+			removed = append(removed, topic)
+		}
+	}
+	return removed
+}
+
+// close отписывает подписчика и возвращает темы, на которые он был подписан.
+func (s *busSubscription) close() []busTopic {
+	busMu.Lock()
+	defer busMu.Unlock()
+	if _, ok := busSubscribers[s]; ok {
+		delete(busSubscribers, s)
+		close(s.events)
+	}
+	topics := make([]busTopic, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// feedKeeper удерживает поток устройства, пока на его события подписан хоть кто-то.
+type feedKeeper struct {
+	refs int
+	stop chan struct{}
+}
+
+var (
+	feedKeepersMu sync.Mutex
+	feedKeepers   = make(map[busTopic]*feedKeeper)
+)
+
+// retainBusFeed запускает поток устройства для события eventType, если он ещё не удерживается.
+// Для событий не из потоков ничего не делает.
+func retainBusFeed(eventType string, udid string) {
+	feed, ok := busFeeds[eventType]
+	if !ok || udid == AllDevices {
+		return
+	}
+	feedKeepersMu.Lock()
+	defer feedKeepersMu.Unlock()
+	topic := busTopic{eventType, udid}
+	keeper, ok := feedKeepers[topic]
+	if !ok {
+		keeper = &feedKeeper{stop: make(chan struct{})}
+		feedKeepers[topic] = keeper
+		// События попадают в шину из самого потока, читателю остаётся только удерживать его.
+		go followDeviceFeed(udid, feed.kind, feed.history, feed.clientBuffer, feed.source, keeper.stop, func(feedEvent) {})
+	}
+	keeper.refs++
+}
+
+// releaseBusFeed отпускает поток, удержанный retainBusFeed.
+func releaseBusFeed(eventType string, udid string) {
+	if _, ok := busFeeds[eventType]; !ok || udid == AllDevices {
+		return
+	}
+	feedKeepersMu.Lock()
+	defer feedKeepersMu.Unlock()
+	topic := busTopic{eventType, udid}
+	keeper, ok := feedKeepers[topic]
+	if !ok {
+		return
+	}
+	keeper.refs--
+	if keeper.refs == 0 {
+		close(keeper.stop)
+		delete(feedKeepers, topic)
+	}
+}
+
+// BusRequest — команда клиента /events/ws.
+type BusRequest struct {
+	// Action — subscribe или unsubscribe.
+	Action string `json:"action"`
+	// Udid — устройство или "*" для всех устройств. Для app.state, syslog и crash нужно конкретное устройство.
+	Udid  string   `json:"udid"`
+	Types []string `json:"types"`
+}
+
+// BusMessage — сообщение сервера /events/ws: event с событием, subscribed и unsubscribed
+// в ответ на команды или error.
+type BusMessage struct {
+	Type    string    `json:"type"`
+	Event   *BusEvent `json:"event,omitempty"`
+	Udid    string    `json:"udid,omitempty"`
+	Types   []string  `json:"types,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// busTopics проверяет команду и возвращает её темы.
+func (r BusRequest) busTopics() ([]busTopic, error) {
+	if r.Action != "subscribe" && r.Action != "unsubscribe" {
+		return nil, fmt.Errorf("action must be subscribe or unsubscribe")
+	}
+	if r.Udid == "" {
+		return nil, fmt.Errorf("udid is required, use %q for all devices", AllDevices)
+	}
+	if len(r.Types) == 0 {
+		return nil, fmt.Errorf("types must not be empty, supported: %v", busEventTypes)
+	}
+	topics := make([]busTopic, 0, len(r.Types))
+	for _, eventType := range r.Types {
+		if !slices.Contains(busEventTypes, eventType) {
+			return nil, fmt.Errorf("unknown type %q, supported: %v", eventType, busEventTypes)
+		}
+		if _, ok := busFeeds[eventType]; ok && r.Udid == AllDevices {
+			return nil, fmt.Errorf("%s requires a device udid", eventType)
+		}
+		topics = append(topics, busTopic{eventType, r.Udid})
+	}
+	return topics, nil
+}
+
+// EventsWebSocket godoc
+// @Summary      События всех устройств через одно WebSocket-подключение
+// @Description  Клиент отправляет BusRequest {"action":"subscribe","udid":"<udid>|*","types":["syslog","app.state"]} и получает BusMessage с type: event и событием в event. unsubscribe отписывает от тем. Типы: device.attached, device.detached, app.state, wda.session, ddi.mount, syslog, crash. Для app.state, syslog и crash нужен UDID: подписка удерживает соответствующий поток устройства. Если клиент не успевает получать события, подключение закрывается с сообщением error.
+// @Tags         general
+// @Success      101
+// @Router       /events/ws [get]
+func EventsWebSocket(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	sub := newBusSubscription()
+
+	var writeMu sync.Mutex
+	write := func(msg BusMessage) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, []byte(MustMarshal(msg)))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var req BusRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			topics, err := req.busTopics()
+			if err != nil {
+				write(BusMessage{Type: "error", Message: err.Error()})
+				continue
+			}
+			if req.Action == "subscribe" {
+				for _, topic := range sub.subscribe(topics) {
+					retainBusFeed(topic.eventType, topic.udid)
+				}
+				write(BusMessage{Type: "subscribed", Udid: req.Udid, Types: req.Types})
+			} else {
+				for _, topic := range sub.unsubscribe(topics) {
+					releaseBusFeed(topic.eventType, topic.udid)
+				}
+				write(BusMessage{Type: "unsubscribed", Udid: req.Udid, Types: req.Types})
+			}
+		}
+	}()
+	// Темы отпускаются только после выхода читателя, иначе он может удержать поток
+	// уже после того, как подписка закрыта.
+	defer func() {
+		conn.Close()
+		<-closed
+		for _, topic := range sub.close() {
+			releaseBusFeed(topic.eventType, topic.udid)
+		}
+	}()
+
+	log.Info("events websocket client connected")
+	for {
+		select {
+		case <-closed:
+			log.Info("events websocket client disconnected")
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				write(BusMessage{Type: "error", Message: sub.err.Error()})
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, sub.err.Error()), time.Now().Add(time.Second))
+				return
+			}
+			if err := write(BusMessage{Type: "event", Event: &e}); err != nil {
+				return
+			}
+		}
+	}
+}
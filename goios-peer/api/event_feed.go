@@ -0,0 +1,337 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFeedHistory = 1000
+	// feedLinger — сколько источник продолжает работать после ухода последнего клиента, чтобы
+	// переподключившийся клиент продолжил с Last-Event-ID без пропусков.
+	feedLinger = 30 * time.Second
+	// defaultFeedClientBuffer — сколько событий может ждать отправки одному клиенту.
+	defaultFeedClientBuffer = 256
+	// feedRetryInterval — пауза перед повторной подпиской внутреннего читателя после ошибки источника.
+	feedRetryInterval = 5 * time.Second
+	// feedStartTimeout — сколько клиент ждёт подключения источника, прежде чем поток начнётся без него.
+	feedStartTimeout = 15 * time.Second
+)
+
+var (
+	// errSlowClient — клиент не успевал получать события и был отключён. Он может продолжить
+	// с Last-Event-ID, пока пропущенные события есть в истории.
+	errSlowClient = errors.New("client is too slow, reconnect with Last-Event-ID to resume")
+	// errFeedDeviceDetached завершает потоки устройства, которое отключилось.
+	errFeedDeviceDetached = errors.New("device disconnected")
+)
+
+// feedEvent — событие потока с порядковым номером, который клиент возвращает в Last-Event-ID,
+// и временем получения от устройства.
+type feedEvent struct {
+	ID    uint64
+	At    time.Time
+	Event string
+	Data  string
+}
+
+// feedSource читает события устройства и передаёт их в publish, пока не закроется stop
+// или чтение не завершится ошибкой. После подключения к устройству источник вызывает ready,
+// чтобы клиенты, которые ждут запуска, получили ответ 200.
+type feedSource func(stop <-chan struct{}, ready func(), publish func(event string, data string)) error
+
+// feedSubscription — подписка одного клиента. Канал events ограничен; когда поток завершается
+// или клиент отстаёт, в err записывается причина и закрываются events и done.
+// ready закрывается, когда источник подключился к устройству.
+type feedSubscription struct {
+	events chan feedEvent
+	done   chan struct{}
+	ready  <-chan struct{}
+	err    error
+}
+
+// eventFeed держит одно подключение к источнику событий, раздаёт события всем клиентам
+// и хранит последние события в кольцевом буфере для продолжения потока.
+type eventFeed struct {
+	kind         string
+	udid         string
+	clientBuffer int
+
+	mu          sync.Mutex
+	history     []feedEvent
+	next        int
+	count       int
+	lastID      uint64
+	subscribers map[*feedSubscription]struct{}
+	stop        chan struct{}
+	ready       chan struct{}
+	linger      *time.Timer
+}
+
+var (
+	eventFeedsMu sync.Mutex
+	eventFeeds   = make(map[string]map[string]*eventFeed)
+)
+
+// getEventFeed возвращает поток kind устройства udid и создаёт его при первом обращении.
+// Для потоков, не привязанных к устройству, udid пустой.
+func getEventFeed(kind string, udid string, history int, clientBuffer int) *eventFeed {
+	eventFeedsMu.Lock()
+	defer eventFeedsMu.Unlock()
+	feeds, ok := eventFeeds[udid]
+	if !ok {
+		feeds = make(map[string]*eventFeed)
+		eventFeeds[udid] = feeds
+	}
+	feed, ok := feeds[kind]
+	if !ok {
+		feed = &eventFeed{
+			kind:         kind,
+			udid:         udid,
+			clientBuffer: clientBuffer,
+			history:      make([]feedEvent, history),
+			subscribers:  make(map[*feedSubscription]struct{}),
+		}
+		feeds[kind] = feed
+	}
+	return feed
+}
+
+// closeDeviceFeeds останавливает источники устройства и завершает потоки клиентов с ошибкой.
+// История сохраняется, чтобы клиент после переподключения устройства мог продолжить поток.
+func closeDeviceFeeds(udid string) {
+	eventFeedsMu.Lock()
+	feeds := make([]*eventFeed, 0, len(eventFeeds[udid]))
+	for _, feed := range eventFeeds[udid] {
+		feeds = append(feeds, feed)
+	}
+	eventFeedsMu.Unlock()
+	for _, feed := range feeds {
+		feed.closeWithError(errFeedDeviceDetached)
+	}
+}
+
+func init() {
+	onDeviceDetached(closeDeviceFeeds)
+}
+
+// subscribe подписывает клиента и запускает source, если источник ещё не работает.
+// Если resume, возвращает события из истории с номером больше lastID.
+func (f *eventFeed) subscribe(source feedSource, lastID uint64, resume bool) ([]feedEvent, *feedSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var replay []feedEvent
+	if resume {
+		replay = f.afterLocked(lastID)
+	}
+	sub := &feedSubscription{events: make(chan feedEvent, f.clientBuffer), done: make(chan struct{})}
+	f.subscribers[sub] = struct{}{}
+	if f.linger != nil {
+		f.linger.Stop()
+		f.linger = nil
+	}
+	if f.stop == nil {
+		f.stop = make(chan struct{})
+		f.ready = make(chan struct{})
+		go f.run(source, f.stop, f.ready)
+	}
+	sub.ready = f.ready
+	return replay, sub
+}
+
+// unsubscribe отписывает клиента. После ухода последнего клиента источник останавливается через feedLinger.
+func (f *eventFeed) unsubscribe(sub *feedSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[sub]; !ok {
+		return
+	}
+	f.dropLocked(sub, nil)
+	if len(f.subscribers) > 0 || f.stop == nil || f.linger != nil {
+		return
+	}
+	f.linger = time.AfterFunc(feedLinger, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.linger = nil
+		if len(f.subscribers) == 0 && f.stop != nil {
+			close(f.stop)
+			f.stop = nil
+		}
+	})
+}
+
+// dropLocked отключает подписку с причиной err.
+func (f *eventFeed) dropLocked(sub *feedSubscription, err error) {
+	delete(f.subscribers, sub)
+	sub.err = err
+	close(sub.events)
+	close(sub.done)
+}
+
+// closeWithError останавливает источник и отключает всех клиентов с ошибкой err.
+func (f *eventFeed) closeWithError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.linger != nil {
+		f.linger.Stop()
+		f.linger = nil
+	}
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	for sub := range f.subscribers {
+		f.dropLocked(sub, err)
+	}
+}
+
+// run выполняет источник. Если он завершился сам, клиенты отключаются с его ошибкой.
+func (f *eventFeed) run(source feedSource, stop chan struct{}, ready chan struct{}) {
+	var readyOnce sync.Once
+	err := source(stop, func() { readyOnce.Do(func() { close(ready) }) }, f.publish)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	f.stop = nil
+	if err == nil {
+		err = io.EOF
+	}
+	for sub := range f.subscribers {
+		f.dropLocked(sub, err)
+	}
+}
+
+// publish записывает событие в историю, передаёт его клиентам и, если у события есть тип шины,
+// публикует его в шину. Шина вызывается после f.mu: её обработчики не должны ждать поток.
+func (f *eventFeed) publish(event string, data string) {
+	f.mu.Lock()
+	e := f.publishLocked(event, data)
+	f.mu.Unlock()
+	if eventType := feedBusType(f.kind, event); eventType != "" {
+		publishBusEvent(BusEvent{Udid: f.udid, Type: eventType, Timestamp: e.At.UTC(), Payload: json.RawMessage(data)})
+	}
+}
+
+func (f *eventFeed) publishLocked(event string, data string) feedEvent {
+	f.lastID++
+	e := feedEvent{ID: f.lastID, At: time.Now(), Event: event, Data: data}
+	f.history[f.next] = e
+	f.next = (f.next + 1) % len(f.history)
+	f.count = min(f.count+1, len(f.history))
+	for sub := range f.subscribers {
+		select {
+		case sub.events <- e:
+		default:
+			f.dropLocked(sub, errSlowClient)
+		}
+	}
+	return e
+}
+
+// lastEventID возвращает номер последнего опубликованного события.
+func (f *eventFeed) lastEventID() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastID
+}
+
+// snapshot возвращает все события истории от старых к новым.
+func (f *eventFeed) snapshot() []feedEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.afterLocked(0)
+}
+
+// afterLocked возвращает события истории с номером больше id, от старых к новым.
+func (f *eventFeed) afterLocked(id uint64) []feedEvent {
+	var events []feedEvent
+	for i := 0; i < f.count; i++ {
+		e := f.history[(f.next-f.count+i+len(f.history))%len(f.history)]
+		if e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// followDeviceFeed читает поток kind устройства udid внутри peer, пока не закроется stop,
+// и передаёт события в handle. После ошибок источника подписка повторяется; если читатель
+// отстал или источник перезапускался, пропущенные события берутся из истории потока.
+func followDeviceFeed(udid string, kind string, history int, clientBuffer int, source func(ios.DeviceEntry) feedSource, stop <-chan struct{}, handle func(feedEvent)) {
+	var lastID uint64
+	wait := func() bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(feedRetryInterval):
+			return true
+		}
+	}
+	for {
+		device, err := resolveDevice(udid)
+		if err != nil {
+			log.WithField("udid", udid).WithError(err).Warnf("failed to get device for %s feed", kind)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		feed := getEventFeed(kind, udid, history, clientBuffer)
+		replay, sub := feed.subscribe(source(device), lastID, lastID > 0)
+		for _, e := range replay {
+			lastID = e.ID
+			handle(e)
+		}
+		err = consumeFeed(sub, stop, func(e feedEvent) {
+			lastID = e.ID
+			handle(e)
+		})
+		feed.unsubscribe(sub)
+		if err == nil {
+			return
+		}
+		log.WithField("udid", udid).WithError(err).Warnf("%s feed ended", kind)
+		if !errors.Is(err, errSlowClient) && !wait() {
+			return
+		}
+	}
+}
+
+// consumeFeed передаёт события подписки в handle, пока она не завершится.
+// Возвращает nil, если закрыт stop.
+func consumeFeed(sub *feedSubscription, stop <-chan struct{}, handle func(feedEvent)) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e, ok := <-sub.events:
+			if !ok {
+				if sub.err == nil {
+					return io.EOF
+				}
+				return sub.err
+			}
+			handle(e)
+		}
+	}
+}
+
+// resolveDevice находит подключённое устройство вместе с данными туннеля.
+func resolveDevice(udid string) (ios.DeviceEntry, error) {
+	device, err := lookupDevice(udid)
+	if err != nil {
+		return device, err
+	}
+	return deviceWithTunnelInfo(device)
+}
@@ -0,0 +1,533 @@
+package api
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FrameStorageMemory = "memory"
+	FrameStorageDisk   = "disk"
+
+	defaultHistoryRetention = 30 * time.Second
+	maxHistoryRetention     = 10 * time.Minute
+	defaultHistoryFPS       = 2
+	defaultHistoryQuality   = 70
+	// maxHistoryExport ограничивает число кадров в одном архиве.
+	maxHistoryExport = 2000
+	// defaultHistoryMaxMemoryMB ограничивает объём кадров в памяти на одно устройство, если
+	// FRAME_HISTORY_MAX_MEMORY_MB не задан. Значение небольшое: история часто включена сразу
+	// на десятках устройств.
+	defaultHistoryMaxMemoryMB = 32
+)
+
+// FrameHistoryConfig — параметры истории кадров устройства.
+type FrameHistoryConfig struct {
+	Retention string `json:"retention"`
+	FPS       int    `json:"fps"`
+	Quality   int    `json:"quality"`
+	MaxWidth  int    `json:"maxWidth,omitempty"`
+	MaxHeight int    `json:"maxHeight,omitempty"`
+	Grayscale bool   `json:"grayscale,omitempty"`
+	Storage   string `json:"storage"`
+	// MaxBytes — предел объёма кадров в памяти. При его превышении самые старые кадры
+	// удаляются раньше, чем истечёт retention. Для хранения на диске не задаётся.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+// FrameHistoryStatus — состояние истории кадров устройства.
+type FrameHistoryStatus struct {
+	Udid     string             `json:"udid"`
+	Running  bool               `json:"running"`
+	Config   FrameHistoryConfig `json:"config"`
+	Frames   int                `json:"frames"`
+	Bytes    int64              `json:"bytes"`
+	OldestAt *time.Time         `json:"oldestAt,omitempty"`
+	NewestAt *time.Time         `json:"newestAt,omitempty"`
+}
+
+// historyFrame — кадр истории. В режиме disk JPEG хранится в файле path, а jpeg пуст.
+type historyFrame struct {
+	seq        uint64
+	capturedAt time.Time
+	width      int
+	height     int
+	size       int64
+	jpeg       []byte
+	path       string
+}
+
+// frameHistory подписывается на поток экрана устройства и хранит кадры за последние retention.
+// Неизменившиеся кадры не сохраняются, поэтому экран на момент t — последний кадр не позже t.
+type frameHistory struct {
+	udid      string
+	retention time.Duration
+	maxBytes  int64
+	config    FrameHistoryConfig
+	folder    string
+
+	mu      sync.Mutex
+	frames  []historyFrame
+	bytes   int64
+	running bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var (
+	frameHistoriesMu sync.Mutex
+	frameHistories   = make(map[string]*frameHistory)
+	// frameHistoryLifecycleMu упорядочивает запуск и остановку историй: иначе два одновременных
+	// запуска оставляют работать историю, которой уже нет в frameHistories, а остановка старой
+	// истории может удалить каталог новой.
+	frameHistoryLifecycleMu sync.Mutex
+)
+
+// frameHistoryFolder возвращает каталог для кадров из FRAME_HISTORY_FOLDER.
+func frameHistoryFolder(udid string) string {
+	folder := os.Getenv("FRAME_HISTORY_FOLDER")
+	if folder == "" {
+		folder = path.Join(os.TempDir(), "goios-frames")
+	}
+	return path.Join(folder, udid)
+}
+
+// frameHistoryMaxMemory возвращает предел объёма кадров в памяти на одно устройство
+// из FRAME_HISTORY_MAX_MEMORY_MB.
+func frameHistoryMaxMemory() int64 {
+	if n, err := strconv.Atoi(os.Getenv("FRAME_HISTORY_MAX_MEMORY_MB")); err == nil && n > 0 {
+		return int64(n) * 1024 * 1024
+	}
+	return defaultHistoryMaxMemoryMB * 1024 * 1024
+}
+
+func findFrameHistory(udid string) (*frameHistory, bool) {
+	frameHistoriesMu.Lock()
+	defer frameHistoriesMu.Unlock()
+	h, ok := frameHistories[udid]
+	return h, ok
+}
+
+// parseFrameHistoryConfig читает retention и storage, а параметры потока — через parseStreamOptionsWith.
+// Хранилище по умолчанию задаётся FRAME_HISTORY_STORAGE. Неизменившиеся кадры не сохраняются,
+// а keepalive потока равен retention, чтобы в истории всегда был кадр, показывающий экран на её начало.
+func parseFrameHistoryConfig(c *gin.Context) (FrameHistoryConfig, StreamOptions, error) {
+	config := FrameHistoryConfig{Storage: os.Getenv("FRAME_HISTORY_STORAGE")}
+	if config.Storage == "" {
+		config.Storage = FrameStorageMemory
+	}
+	if storage := c.Query("storage"); storage != "" {
+		config.Storage = storage
+	}
+	if config.Storage != FrameStorageMemory && config.Storage != FrameStorageDisk {
+		return config, StreamOptions{}, fmt.Errorf("storage must be memory or disk")
+	}
+	if config.Storage == FrameStorageMemory {
+		config.MaxBytes = frameHistoryMaxMemory()
+	}
+	retention, err := durationQuery(c, "retention", defaultHistoryRetention)
+	if err != nil || retention <= 0 || retention > maxHistoryRetention {
+		return config, StreamOptions{}, fmt.Errorf("retention must be a positive duration up to %s", maxHistoryRetention)
+	}
+	config.Retention = retention.String()
+	opts, err := parseStreamOptionsWith(c, StreamOptions{FPS: defaultHistoryFPS, Quality: defaultHistoryQuality})
+	if err != nil {
+		return config, opts, err
+	}
+	opts.SkipUnchanged, opts.Keepalive = true, retention
+	config.FPS, config.Quality, config.MaxWidth, config.MaxHeight, config.Grayscale = opts.FPS, opts.Quality, opts.MaxWidth, opts.MaxHeight, opts.Grayscale
+	return config, opts, nil
+}
+
+// startFrameHistory запускает историю кадров устройства, заменяя уже работающую.
+func startFrameHistory(device ios.DeviceEntry, config FrameHistoryConfig, opts StreamOptions) (*frameHistory, error) {
+	udid := device.Properties.SerialNumber
+	frameHistoryLifecycleMu.Lock()
+	defer frameHistoryLifecycleMu.Unlock()
+	stopFrameHistoryLocked(udid)
+
+	h := &frameHistory{
+		udid:      udid,
+		retention: opts.Keepalive,
+		maxBytes:  config.MaxBytes,
+		config:    config,
+		running:   true,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if config.Storage == FrameStorageDisk {
+		h.folder = frameHistoryFolder(udid)
+		if err := os.MkdirAll(h.folder, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create frame history folder: %w", err)
+		}
+	}
+	frameHistoriesMu.Lock()
+	frameHistories[udid] = h
+	frameHistoriesMu.Unlock()
+
+	sm := getStreamManager(device)
+	ch := sm.AddClient(opts)
+	go h.run(sm, ch)
+	return h, nil
+}
+
+// stopFrameHistory останавливает историю устройства и удаляет её кадры.
+func stopFrameHistory(udid string) (FrameHistoryStatus, bool) {
+	frameHistoryLifecycleMu.Lock()
+	defer frameHistoryLifecycleMu.Unlock()
+	return stopFrameHistoryLocked(udid)
+}
+
+// stopFrameHistoryLocked вызывается под frameHistoryLifecycleMu.
+func stopFrameHistoryLocked(udid string) (FrameHistoryStatus, bool) {
+	frameHistoriesMu.Lock()
+	h, ok := frameHistories[udid]
+	delete(frameHistories, udid)
+	frameHistoriesMu.Unlock()
+	if !ok {
+		return FrameHistoryStatus{}, false
+	}
+	h.mu.Lock()
+	if h.running {
+		close(h.stop)
+	}
+	h.mu.Unlock()
+	<-h.done
+	status := h.status()
+	h.mu.Lock()
+	h.removeLocked(len(h.frames))
+	h.mu.Unlock()
+	if h.folder != "" {
+		os.RemoveAll(h.folder)
+	}
+	return status, true
+}
+
+// run сохраняет кадры, пока историю не остановят. Если устройство отключено, кадры остаются
+// доступными до явной остановки.
+func (h *frameHistory) run(sm *StreamManager, ch chan StreamFrame) {
+	defer close(h.done)
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				log.WithField("udid", h.udid).Info("frame history stopped, device detached")
+				h.mu.Lock()
+				h.running = false
+				h.mu.Unlock()
+				return
+			}
+			if err := h.add(frame); err != nil {
+				log.WithField("udid", h.udid).WithError(err).Warn("failed to store history frame")
+			}
+		case <-h.stop:
+			sm.RemoveClient(ch)
+			h.mu.Lock()
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (h *frameHistory) add(frame StreamFrame) error {
+	entry := historyFrame{
+		seq:        frame.Seq,
+		capturedAt: frame.CapturedAt,
+		width:      frame.Width,
+		height:     frame.Height,
+		size:       int64(len(frame.JPEG)),
+	}
+	if h.folder != "" {
+		entry.path = path.Join(h.folder, fmt.Sprintf("%d.jpg", frame.Seq))
+		if err := os.WriteFile(entry.path, frame.JPEG, 0o644); err != nil {
+			return err
+		}
+	} else {
+		entry.jpeg = frame.JPEG
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.frames = append(h.frames, entry)
+	h.bytes += entry.size
+	h.trimLocked(frame.CapturedAt.Add(-h.retention))
+	h.capLocked()
+	return nil
+}
+
+// capLocked удаляет самые старые кадры, пока их объём превышает maxBytes. Последний кадр
+// остаётся всегда. Вызывается под h.mu.
+func (h *frameHistory) capLocked() {
+	if h.maxBytes <= 0 {
+		return
+	}
+	n, bytes := 0, h.bytes
+	for n+1 < len(h.frames) && bytes > h.maxBytes {
+		bytes -= h.frames[n].size
+		n++
+	}
+	h.removeLocked(n)
+}
+
+// trimLocked удаляет кадры старше before, но оставляет последний из них: он показывает экран
+// на момент before. Вызывается под h.mu.
+func (h *frameHistory) trimLocked(before time.Time) {
+	n := 0
+	for n+1 < len(h.frames) && !h.frames[n+1].capturedAt.After(before) {
+		n++
+	}
+	h.removeLocked(n)
+}
+
+// removeLocked удаляет n самых старых кадров вместе с их файлами. Вызывается под h.mu.
+func (h *frameHistory) removeLocked(n int) {
+	for _, f := range h.frames[:n] {
+		h.bytes -= f.size
+		if f.path != "" {
+			os.Remove(f.path)
+		}
+	}
+	h.frames = append(h.frames[:0:0], h.frames[n:]...)
+}
+
+func (h *frameHistory) status() FrameHistoryStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := FrameHistoryStatus{Udid: h.udid, Running: h.running, Config: h.config, Frames: len(h.frames), Bytes: h.bytes}
+	if len(h.frames) > 0 {
+		oldest, newest := h.frames[0].capturedAt, h.frames[len(h.frames)-1].capturedAt
+		status.OldestAt, status.NewestAt = &oldest, &newest
+	}
+	return status
+}
+
+// frameAt возвращает кадр, который был на экране в момент at: последний кадр не позже at.
+func (h *frameHistory) frameAt(at time.Time) (historyFrame, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.Search(len(h.frames), func(i int) bool { return h.frames[i].capturedAt.After(at) })
+	if i == 0 {
+		return historyFrame{}, false
+	}
+	return h.frames[i-1], true
+}
+
+// framesBetween возвращает кадры, показывавшиеся на экране в интервале [from, to].
+func (h *frameHistory) framesBetween(from time.Time, to time.Time) []historyFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	start := sort.Search(len(h.frames), func(i int) bool { return h.frames[i].capturedAt.After(from) })
+	if start > 0 {
+		start--
+	}
+	end := sort.Search(len(h.frames), func(i int) bool { return h.frames[i].capturedAt.After(to) })
+	if start >= end {
+		return nil
+	}
+	return append([]historyFrame(nil), h.frames[start:end]...)
+}
+
+func (f historyFrame) data() ([]byte, error) {
+	if f.path == "" {
+		return f.jpeg, nil
+	}
+	return os.ReadFile(f.path)
+}
+
+// parseTimeQuery читает момент времени: RFC3339, unix-время в миллисекундах или
+// отрицательную длительность относительно текущего момента, например -5s.
+func parseTimeQuery(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d <= 0 {
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC3339 time, unix milliseconds or a negative duration", value)
+}
+
+// StartFrameHistory godoc
+// @Summary      Включить историю кадров
+// @Description  Начинает хранить кадры экрана за последние retention в памяти или на диске. Повторный вызов перезапускает историю с новыми параметрами. В памяти каждое устройство хранит не больше FRAME_HISTORY_MAX_MEMORY_MB мегабайт кадров (по умолчанию 32): при превышении самые старые кадры удаляются раньше, чем истечёт retention.
+// @Tags         stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        retention  query  string  false  "Сколько хранить кадры, по умолчанию 30s, не более 10m"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 2"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 70"
+// @Param        maxWidth  query  int  false  "Максимальная ширина кадра"
+// @Param        maxHeight  query  int  false  "Максимальная высота кадра"
+// @Param        grayscale  query  bool  false  "Хранить кадры в оттенках серого"
+// @Param        storage  query  string  false  "memory или disk, по умолчанию FRAME_HISTORY_STORAGE или memory. В памяти хранится не более FRAME_HISTORY_MAX_MEMORY_MB на устройство, по умолчанию 32 МБ"
+// @Success      200  {object}  FrameHistoryStatus
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/frames/history [post]
+func StartFrameHistory(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	config, opts, err := parseFrameHistoryConfig(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	h, err := startFrameHistory(device, config, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, h.status())
+}
+
+// GetFrameHistory godoc
+// @Summary      Состояние истории кадров
+// @Tags         stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Success      200  {object}  FrameHistoryStatus
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/frames/history [get]
+func GetFrameHistory(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	h, ok := findFrameHistory(device.Properties.SerialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "frame history is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, h.status())
+}
+
+// StopFrameHistory godoc
+// @Summary      Выключить историю кадров
+// @Description  Останавливает историю и удаляет сохранённые кадры
+// @Tags         stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Success      200  {object}  FrameHistoryStatus
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/frames/history [delete]
+func StopFrameHistory(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	status, ok := stopFrameHistory(device.Properties.SerialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "frame history is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// GetFrames godoc
+// @Summary      Кадры из истории
+// @Description  С параметром at возвращает JPEG-кадр, который был на экране в этот момент. С параметрами from и to возвращает zip-архив кадров за интервал; имена файлов содержат unix-время захвата в миллисекундах. В архив попадают не более 2000 последних кадров интервала; если кадров больше, X-Frames-Truncated равен true, а X-Frames-Total содержит их число.
+// @Tags         stream
+// @Produce      jpeg
+// @Produce      application/zip
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        at  query  string  false  "Момент времени: RFC3339, unix-время в мс или длительность назад, например -5s"
+// @Param        from  query  string  false  "Начало интервала"
+// @Param        to  query  string  false  "Конец интервала, по умолчанию сейчас"
+// @Success      200  {file}  file
+// @Failure      404  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Header       200  {string}  X-Capture-Timestamp  "Время захвата кадра, RFC3339"
+// @Header       200  {int}  X-Frames-Total  "Число кадров в интервале"
+// @Header       200  {bool}  X-Frames-Truncated  "В архив попали не все кадры интервала"
+// @Router       /device/{udid}/frames [get]
+func GetFrames(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	h, ok := findFrameHistory(device.Properties.SerialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "frame history is not enabled"})
+		return
+	}
+
+	if at := c.Query("at"); at != "" {
+		t, err := parseTimeQuery(at)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "at: " + err.Error()})
+			return
+		}
+		frame, ok := h.frameAt(t)
+		if !ok {
+			c.JSON(http.StatusNotFound, GenericResponse{Error: "no frame at this time in the history"})
+			return
+		}
+		data, err := frame.data()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		c.Header("X-Capture-Timestamp", frame.capturedAt.UTC().Format(time.RFC3339Nano))
+		c.Header("X-Frame-Seq", strconv.FormatUint(frame.seq, 10))
+		c.Header("Content-Length", strconv.Itoa(len(data)))
+		c.Data(http.StatusOK, "image/jpeg", data)
+		return
+	}
+
+	from := c.Query("from")
+	if from == "" {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "at or from query param is missing"})
+		return
+	}
+	start, err := parseTimeQuery(from)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "from: " + err.Error()})
+		return
+	}
+	end := time.Now()
+	if to := c.Query("to"); to != "" {
+		if end, err = parseTimeQuery(to); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "to: " + err.Error()})
+			return
+		}
+	}
+	frames := h.framesBetween(start, end)
+	if len(frames) == 0 {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "no frames in this interval"})
+		return
+	}
+	total := len(frames)
+	if total > maxHistoryExport {
+		frames = frames[total-maxHistoryExport:]
+	}
+
+	c.Header("X-Frames-Total", strconv.Itoa(total))
+	c.Header("X-Frames-Truncated", strconv.FormatBool(total > len(frames)))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-frames.zip"`, device.Properties.SerialNumber))
+	zw := zip.NewWriter(c.Writer)
+	for _, frame := range frames {
+		data, err := frame.data()
+		if err != nil {
+			// Кадр мог быть удалён ротацией, пока архив пишется.
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("%d-%d.jpg", frame.capturedAt.UnixMilli(), frame.seq),
+			Method:   zip.Store,
+			Modified: frame.capturedAt,
+		})
+		if err != nil {
+			break
+		}
+		if _, err := w.Write(data); err != nil {
+			break
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.WithField("udid", device.Properties.SerialNumber).WithError(err).Warn("failed to write frames archive")
+	}
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+)
+
+// Координаты во всех запросах ввода задаются в пикселях скриншота,
+// то есть совпадают с изображениями из /screenshot и /screenstream.
+
+type TapRequest struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type LongPressRequest struct {
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	DurationMs int     `json:"durationMs"`
+}
+
+type SwipeRequest struct {
+	FromX      float64 `json:"fromX"`
+	FromY      float64 `json:"fromY"`
+	ToX        float64 `json:"toX"`
+	ToY        float64 `json:"toY"`
+	DurationMs int     `json:"durationMs"`
+}
+
+type TypeTextRequest struct {
+	Text string `json:"text" binding:"required"`
+}
+
+const (
+	defaultLongPressMs = 1000
+	defaultSwipeMs     = 300
+)
+
+// inputClient возвращает клиент WDA для устройства или отвечает ошибкой и возвращает nil.
+func inputClient(c *gin.Context) *wdaClient {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	client, err := wdaClientForDevice(device)
+	if errors.Is(err, errNoWdaSession) {
+		c.JSON(http.StatusConflict, GenericResponse{Error: err.Error()})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return nil
+	}
+	return client
+}
+
+func respondInput(c *gin.Context, err error, message string) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: message})
+}
+
+// @Summary      Тап по экрану
+// @Description  Выполняет тап через WDA. Координаты в пикселях скриншота.
+// @Tags         input
+// @Accept       json
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        request body TapRequest true "Координаты"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/tap [post]
+func InputTap(c *gin.Context) {
+	var request TapRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.Tap(request.X, request.Y), "tap performed")
+}
+
+// @Summary      Долгое нажатие
+// @Description  Выполняет долгое нажатие через WDA. Координаты в пикселях скриншота, длительность по умолчанию 1000мс.
+// @Tags         input
+// @Accept       json
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        request body LongPressRequest true "Координаты и длительность"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/long-press [post]
+func InputLongPress(c *gin.Context) {
+	var request LongPressRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if request.DurationMs <= 0 {
+		request.DurationMs = defaultLongPressMs
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.LongPress(request.X, request.Y, request.DurationMs), "long press performed")
+}
+
+// @Summary      Свайп
+// @Description  Выполняет свайп через WDA. Координаты в пикселях скриншота, длительность по умолчанию 300мс.
+// @Tags         input
+// @Accept       json
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        request body SwipeRequest true "Начальная и конечная точки"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/swipe [post]
+func InputSwipe(c *gin.Context) {
+	var request SwipeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if request.DurationMs <= 0 {
+		request.DurationMs = defaultSwipeMs
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.Swipe(request.FromX, request.FromY, request.ToX, request.ToY, request.DurationMs), "swipe performed")
+}
+
+// @Summary      Ввод текста
+// @Description  Вводит текст в элемент, находящийся в фокусе
+// @Tags         input
+// @Accept       json
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        request body TypeTextRequest true "Текст"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/type [post]
+func InputTypeText(c *gin.Context) {
+	var request TypeTextRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.TypeText(request.Text), "text typed")
+}
+
+// @Summary      Кнопка Home
+// @Description  Возвращает устройство на домашний экран
+// @Tags         input
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/home [post]
+func InputHome(c *gin.Context) {
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.Home(), "home pressed")
+}
+
+// @Summary      Кнопки громкости
+// @Description  Нажимает кнопку громкости
+// @Tags         input
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        direction query string true "up или down"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/volume [post]
+func InputVolume(c *gin.Context) {
+	var button string
+	switch c.Query("direction") {
+	case "up":
+		button = "volumeUp"
+	case "down":
+		button = "volumeDown"
+	default:
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "direction query param must be up or down"})
+		return
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.PressButton(button), button+" pressed")
+}
+
+// @Summary      Заблокировать экран
+// @Tags         input
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/lock [post]
+func InputLock(c *gin.Context) {
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.Lock(), "device locked")
+}
+
+// @Summary      Разблокировать экран
+// @Tags         input
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Success      200  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/input/unlock [post]
+func InputUnlock(c *gin.Context) {
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	respondInput(c, client.Unlock(), "device unlocked")
+}
@@ -58,7 +58,7 @@ func DeviceMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": "udid is missing"})
 			return
 		}
-		device, err := ios.GetDevice(udid)
+		device, err := lookupDevice(udid)
 		if err != nil {
 			if strings.Contains(err.Error(), "not found") {
 				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "device not found on the host"})
@@ -68,22 +68,11 @@ func DeviceMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		info, err := tunnel.TunnelInfoForDevice(device.Properties.SerialNumber, ios.HttpApiHost(), ios.HttpApiPort())
-		if err == nil {
-			log.WithField("udid", device.Properties.SerialNumber).Printf("Received tunnel info %v", info)
-
-			device.UserspaceTUNPort = info.UserspaceTUNPort
-			device.UserspaceTUN = info.UserspaceTUN
-
-			device, err = deviceWithRsdProvider(device, udid, info.Address, info.RsdPort)
-			if err != nil {
-				c.Error(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}) // Return an error response
-				c.Next()
-			}
-		} else {
-			log.Error(err)
-			log.WithField("udid", device.Properties.SerialNumber).Warn("failed to get tunnel info")
+		device, err = deviceWithTunnelInfo(device)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.Set(IOS_KEY, device)
@@ -91,27 +80,40 @@ func DeviceMiddleware() gin.HandlerFunc {
 	}
 }
 
-func deviceWithRsdProvider(device ios.DeviceEntry, udid string, address string, rsdPort int) (ios.DeviceEntry, error) {
-	rsdService, err := ios.NewWithAddrPortDevice(address, rsdPort, device)
+// deviceWithTunnelInfo дополняет устройство данными туннеля, если он есть (iOS 17+).
+// Без туннеля устройство возвращается как есть.
+func deviceWithTunnelInfo(device ios.DeviceEntry) (ios.DeviceEntry, error) {
+	info, err := tunnel.TunnelInfoForDevice(device.Properties.SerialNumber, ios.HttpApiHost(), ios.HttpApiPort())
 	if err != nil {
-		return device, err
+		log.Error(err)
+		log.WithField("udid", device.Properties.SerialNumber).Warn("failed to get tunnel info")
+		return device, nil
 	}
+	log.WithField("udid", device.Properties.SerialNumber).Printf("Received tunnel info %v", info)
 
-	defer rsdService.Close()
-	rsdProvider, err := rsdService.Handshake()
+	device.UserspaceTUNPort = info.UserspaceTUNPort
+	device.UserspaceTUN = info.UserspaceTUN
+
+	return deviceWithRsdProvider(device, info.Address, info.RsdPort)
+}
+
+func deviceWithRsdProvider(device ios.DeviceEntry, address string, rsdPort int) (ios.DeviceEntry, error) {
+	rsdService, err := ios.NewWithAddrPortDevice(address, rsdPort, device)
 	if err != nil {
 		return device, err
 	}
 
-	device1, err := ios.GetDeviceWithAddress(udid, address, rsdProvider)
+	defer rsdService.Close()
+	rsdProvider, err := rsdService.Handshake()
 	if err != nil {
 		return device, err
 	}
 
-	device1.UserspaceTUN = device.UserspaceTUN
-	device1.UserspaceTUNPort = device.UserspaceTUNPort
+	// Устройство уже найдено в реестре, повторно запрашивать список у usbmuxd не нужно.
+	device.Address = address
+	device.Rsd = rsdProvider
 
-	return device1, nil
+	return device, nil
 }
 
 const IOS_KEY = "go_ios_device"
@@ -134,7 +136,6 @@ func LimitNumClientsUDID() gin.HandlerFunc {
 		sema <- struct{}{}
 		defer func() { <-sema }()
 		c.Next()
-		print("mid done")
 	}
 }
 
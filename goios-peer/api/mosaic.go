@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	defaultMosaicWidth  = 1920
+	defaultMosaicHeight = 1080
+	defaultMosaicFPS    = 5
+	maxMosaicTiles      = 64
+	// mosaicLabelHeight — высота полосы с подписью под плиткой.
+	mosaicLabelHeight = 18
+	// mosaicReconnectInterval — как часто плитка пытается снова подключиться к отключённому устройству.
+	mosaicReconnectInterval = 5 * time.Second
+)
+
+var (
+	mosaicBackground  = color.RGBA{R: 16, G: 16, B: 16, A: 255}
+	mosaicPlaceholder = color.RGBA{R: 48, G: 48, B: 48, A: 255}
+	mosaicLabelColor  = color.RGBA{R: 230, G: 230, B: 230, A: 255}
+	mosaicOfflineText = color.RGBA{R: 220, G: 80, B: 80, A: 255}
+)
+
+// MosaicOptions — параметры мозаики из query.
+type MosaicOptions struct {
+	Udids   []string
+	Cols    int
+	Width   int
+	Height  int
+	FPS     int
+	Quality int
+}
+
+// parseMosaicOptions читает udids, cols, width, height, fps и quality. По умолчанию cols подбирается
+// так, чтобы сетка была близка к квадратной.
+func parseMosaicOptions(c *gin.Context) (MosaicOptions, error) {
+	opts := MosaicOptions{Width: defaultMosaicWidth, Height: defaultMosaicHeight, FPS: defaultMosaicFPS, Quality: 80}
+	for _, udid := range strings.Split(c.Query("udids"), ",") {
+		if udid = strings.TrimSpace(udid); udid != "" {
+			opts.Udids = append(opts.Udids, udid)
+		}
+	}
+	if len(opts.Udids) == 0 {
+		return opts, fmt.Errorf("udids query param is missing")
+	}
+	if len(opts.Udids) > maxMosaicTiles {
+		return opts, fmt.Errorf("at most %d devices can be shown in a mosaic", maxMosaicTiles)
+	}
+	for opts.Cols*opts.Cols < len(opts.Udids) {
+		opts.Cols++
+	}
+	ints := []struct {
+		name     string
+		target   *int
+		min, max int
+	}{
+		{"cols", &opts.Cols, 1, maxMosaicTiles},
+		{"width", &opts.Width, 160, 7680},
+		{"height", &opts.Height, 120, 4320},
+		{"fps", &opts.FPS, 1, maxStreamFPS},
+		{"quality", &opts.Quality, 1, 100},
+	}
+	for _, p := range ints {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < p.min || n > p.max {
+			return opts, fmt.Errorf("%s must be an integer between %d and %d", p.name, p.min, p.max)
+		}
+		*p.target = n
+	}
+	return opts, nil
+}
+
+// mosaicTile держит подписку на поток одного устройства и его последний кадр.
+type mosaicTile struct {
+	udid   string
+	bounds image.Rectangle
+
+	mu     sync.Mutex
+	latest image.Image
+	online bool
+}
+
+func (t *mosaicTile) setFrame(img image.Image) {
+	t.mu.Lock()
+	t.latest = img
+	t.online = true
+	t.mu.Unlock()
+}
+
+func (t *mosaicTile) setOffline() {
+	t.mu.Lock()
+	t.latest = nil
+	t.online = false
+	t.mu.Unlock()
+}
+
+// run подписывается на StreamManager устройства и переподключается, пока не закроется done.
+// Кадры запрашиваются сразу в размере плитки, поэтому масштабирование идёт в общем конвейере.
+func (t *mosaicTile) run(done <-chan struct{}, opts StreamOptions) {
+	for {
+		t.follow(done, opts)
+		t.setOffline()
+		select {
+		case <-done:
+			return
+		case <-time.After(mosaicReconnectInterval):
+		}
+	}
+}
+
+// follow получает кадры устройства, пока оно подключено и клиент не ушёл.
+func (t *mosaicTile) follow(done <-chan struct{}, opts StreamOptions) {
+	device, err := lookupDevice(t.udid)
+	if err != nil {
+		return
+	}
+	device, err = deviceWithTunnelInfo(device)
+	if err != nil {
+		log.WithField("udid", t.udid).WithError(err).Warn("mosaic tile failed to connect")
+		return
+	}
+	sm := getStreamManager(device)
+	ch := sm.AddClient(opts)
+	defer sm.RemoveClient(ch)
+	t.mu.Lock()
+	t.online = true
+	t.mu.Unlock()
+	for {
+		select {
+		case <-done:
+			return
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+			img, err := jpeg.Decode(bytes.NewReader(frame.JPEG))
+			if err != nil {
+				continue
+			}
+			t.setFrame(img)
+		}
+	}
+}
+
+// draw рисует плитку: кадр по центру с сохранением пропорций и подпись снизу,
+// либо заглушку, если устройство отключено.
+func (t *mosaicTile) draw(dst *image.RGBA) {
+	t.mu.Lock()
+	img, online := t.latest, t.online
+	t.mu.Unlock()
+
+	screen := image.Rect(t.bounds.Min.X, t.bounds.Min.Y, t.bounds.Max.X, t.bounds.Max.Y-mosaicLabelHeight)
+	label := t.udid
+	if img == nil {
+		draw.Draw(dst, screen.Inset(2), image.NewUniform(mosaicPlaceholder), image.Point{}, draw.Src)
+		status := "connecting"
+		if !online {
+			status = "disconnected"
+		}
+		drawText(dst, status, image.Pt((screen.Min.X+screen.Max.X)/2, (screen.Min.Y+screen.Max.Y)/2), mosaicOfflineText)
+	} else {
+		b := img.Bounds()
+		// Кадр меньше плитки не увеличивается, а только центрируется.
+		w, h := scaledSize(b.Dx(), b.Dy(), screen.Dx(), screen.Dy())
+		x := screen.Min.X + (screen.Dx()-w)/2
+		y := screen.Min.Y + (screen.Dy()-h)/2
+		draw.ApproxBiLinear.Scale(dst, image.Rect(x, y, x+w, y+h), img, b, draw.Src, nil)
+	}
+	drawText(dst, label, image.Pt((t.bounds.Min.X+t.bounds.Max.X)/2, t.bounds.Max.Y-5), mosaicLabelColor)
+}
+
+// drawText пишет текст моноширинным шрифтом, центрируя его по x; y — базовая линия.
+func drawText(dst *image.RGBA, text string, at image.Point, c color.Color) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(at.X-width/2, at.Y),
+	}
+	d.DrawString(text)
+}
+
+// MosaicHandler godoc
+// @Summary      Мозаика экранов нескольких устройств
+// @Description  Собирает последние кадры потоков указанных устройств в одну сетку и отдаёт её MJPEG-потоком. Под каждой плиткой подпись с UDID; отключённое устройство показывается заглушкой и подключается снова, когда появится.
+// @Tags         stream
+// @Produce      multipart/x-mixed-replace
+// @Param        udids  query  string  true  "UDID устройств через запятую"
+// @Param        cols  query  int  false  "Число столбцов, по умолчанию сетка близкая к квадратной"
+// @Param        width  query  int  false  "Ширина выходного кадра, по умолчанию 1920"
+// @Param        height  query  int  false  "Высота выходного кадра, по умолчанию 1080"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 5"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 80"
+// @Success      200  {string}  string  "stream"
+// @Failure      422  {object}  GenericResponse
+// @Router       /mosaic [get]
+func MosaicHandler(c *gin.Context) {
+	opts, err := parseMosaicOptions(c)
+	if err != nil {
+		c.Header("Content-Type", "application/json")
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	rows := (len(opts.Udids) + opts.Cols - 1) / opts.Cols
+	tileWidth, tileHeight := opts.Width/opts.Cols, opts.Height/rows
+	if tileHeight <= mosaicLabelHeight+8 || tileWidth < 32 {
+		c.Header("Content-Type", "application/json")
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "output size is too small for this number of tiles"})
+		return
+	}
+	tileOpts := StreamOptions{
+		FPS:           opts.FPS,
+		Quality:       90,
+		MaxWidth:      tileWidth,
+		MaxHeight:     tileHeight - mosaicLabelHeight,
+		SkipUnchanged: true,
+		Keepalive:     time.Minute,
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	tiles := make([]*mosaicTile, len(opts.Udids))
+	for i, udid := range opts.Udids {
+		x, y := (i%opts.Cols)*tileWidth, (i/opts.Cols)*tileHeight
+		tiles[i] = &mosaicTile{udid: udid, bounds: image.Rect(x, y, x+tileWidth, y+tileHeight), online: true}
+		go tiles[i].run(done, tileOpts)
+	}
+	log.Infof("starting mosaic stream for %d devices", len(tiles))
+
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	ticker := time.NewTicker(time.Second / time.Duration(opts.FPS))
+	defer ticker.Stop()
+	writer := c.Writer
+	var b bytes.Buffer
+	for {
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(mosaicBackground), image.Point{}, draw.Src)
+		for _, tile := range tiles {
+			tile.draw(canvas)
+		}
+		b.Reset()
+		if err := jpeg.Encode(&b, canvas, &jpeg.Options{Quality: opts.Quality}); err != nil {
+			log.Warnf("failed encoding mosaic %v", err)
+			return
+		}
+		if _, err := writer.Write([]byte(fmt.Sprintf(mjpegFrameHeader, b.Len()))); err != nil {
+			break
+		}
+		if _, err := writer.Write(b.Bytes()); err != nil {
+			break
+		}
+		if _, err := writer.Write([]byte(mjpegFrameFooter)); err != nil {
+			break
+		}
+		writer.Flush()
+
+		select {
+		case <-c.Request.Context().Done():
+			log.Info("mosaic client disconnected")
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Info("mosaic client disconnected")
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"goios-peer/avi"
+)
+
+type RecordingState string
+
+const (
+	RecordingActive   RecordingState = "recording"
+	RecordingFinished RecordingState = "finished"
+	RecordingFailed   RecordingState = "failed"
+)
+
+const (
+	// defaultRecordingMaxDuration ограничивает запись, которую забыли остановить.
+	defaultRecordingMaxDuration = 30 * time.Minute
+	// recordingMaxDurationLimit — наибольший допустимый maxDuration. Размер файла отдельно
+	// ограничен avi.MaxFileSize: при его достижении запись завершается раньше.
+	recordingMaxDurationLimit = 2 * time.Hour
+)
+
+// Recording — запись экрана устройства в файл MJPEG AVI.
+type Recording struct {
+	ID        string         `json:"id"`
+	Udid      string         `json:"udid"`
+	State     RecordingState `json:"state"`
+	StartedAt time.Time      `json:"startedAt"`
+	StoppedAt *time.Time     `json:"stoppedAt,omitempty"`
+	Duration  string         `json:"duration"`
+	Frames    int            `json:"frames"`
+	FPS       int            `json:"fps"`
+	Size      int64          `json:"size"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// recordingJob хранит состояние записи и управляет её горутиной.
+type recordingJob struct {
+	mu        sync.Mutex
+	recording Recording
+	file      string
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+func (j *recordingJob) snapshot() Recording {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.recording
+}
+
+// finish останавливает запись и ждёт, пока файл будет дописан.
+func (j *recordingJob) finish() Recording {
+	j.stopOnce.Do(func() { close(j.stop) })
+	<-j.done
+	return j.snapshot()
+}
+
+var (
+	recordingsMu sync.Mutex
+	recordings   = make(map[string]*recordingJob)
+)
+
+// recordingsFolder возвращает каталог для файлов записей из RECORDINGS_FOLDER.
+func recordingsFolder() (string, error) {
+	folder := os.Getenv("RECORDINGS_FOLDER")
+	if folder == "" {
+		folder = path.Join(os.TempDir(), "goios-recordings")
+	}
+	return folder, os.MkdirAll(folder, 0o755)
+}
+
+// findRecording возвращает запись устройства по ID.
+func findRecording(udid string, id string) (*recordingJob, bool) {
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	job, ok := recordings[id]
+	if !ok || job.recording.Udid != udid {
+		return nil, false
+	}
+	return job, true
+}
+
+// startRecording подписывается на общий поток экрана устройства и пишет кадры в файл.
+func startRecording(device ios.DeviceEntry, opts StreamOptions, maxDuration time.Duration) (*recordingJob, error) {
+	folder, err := recordingsFolder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recordings folder: %w", err)
+	}
+	id := uuid.New().String()
+	file := path.Join(folder, id+".avi")
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+
+	job := &recordingJob{
+		recording: Recording{
+			ID:        id,
+			Udid:      device.Properties.SerialNumber,
+			State:     RecordingActive,
+			StartedAt: time.Now(),
+			FPS:       opts.FPS,
+		},
+		file: file,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	recordingsMu.Lock()
+	recordings[id] = job
+	recordingsMu.Unlock()
+
+	sm := getStreamManager(device)
+	ch := sm.AddClient(opts)
+	go job.run(f, sm, ch, maxDuration)
+	return job, nil
+}
+
+// run пишет кадры до остановки, истечения maxDuration, достижения avi.MaxFileSize
+// или отключения устройства.
+// Время кадра отсчитывается от момента захвата первого кадра, поэтому паузы на экране
+// сохраняются в видео с реальной длительностью.
+func (j *recordingJob) run(f *os.File, sm *StreamManager, ch chan StreamFrame, maxDuration time.Duration) {
+	defer close(j.done)
+	logger := log.WithField("udid", j.recording.Udid).WithField("recording", j.recording.ID)
+	writer := avi.NewMJPEGWriter(f, j.recording.FPS)
+	timeout := time.NewTimer(maxDuration)
+	defer timeout.Stop()
+
+	var first time.Time
+	var recordErr error
+	limitReached := false
+loop:
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				logger.Info("recording stopped, device detached")
+				break loop
+			}
+			if first.IsZero() {
+				first = frame.CapturedAt
+			}
+			err := writer.WriteFrame(frame.JPEG, frame.Width, frame.Height, frame.CapturedAt.Sub(first))
+			if errors.Is(err, avi.ErrFileTooLarge) {
+				logger.Info("recording reached max file size")
+				limitReached = true
+				break loop
+			}
+			if err != nil {
+				recordErr = err
+				break loop
+			}
+			j.mu.Lock()
+			j.recording.Frames = writer.Frames()
+			j.mu.Unlock()
+		case <-j.stop:
+			break loop
+		case <-timeout.C:
+			logger.Info("recording reached max duration")
+			break loop
+		}
+	}
+	sm.RemoveClient(ch)
+
+	if recordErr == nil && !limitReached && !first.IsZero() {
+		if err := writer.Extend(time.Since(first)); !errors.Is(err, avi.ErrFileTooLarge) {
+			recordErr = err
+		}
+	}
+	if err := writer.Close(); err != nil && recordErr == nil {
+		recordErr = err
+	}
+	if err := f.Close(); err != nil && recordErr == nil {
+		recordErr = err
+	}
+
+	stoppedAt := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.recording.StoppedAt = &stoppedAt
+	j.recording.Frames = writer.Frames()
+	j.recording.Duration = writer.Duration().String()
+	if info, err := os.Stat(j.file); err == nil {
+		j.recording.Size = info.Size()
+	}
+	switch {
+	case recordErr != nil:
+		logger.WithError(recordErr).Error("recording failed")
+		j.recording.State = RecordingFailed
+		j.recording.Error = recordErr.Error()
+	case writer.Frames() == 0:
+		j.recording.State = RecordingFailed
+		j.recording.Error = "no frames were captured"
+	default:
+		j.recording.State = RecordingFinished
+	}
+	logger.WithField("frames", j.recording.Frames).Info("recording finished")
+}
+
+// StartRecording godoc
+// @Summary      Начать запись экрана
+// @Description  Начинает запись экрана устройства из общего потока скриншотов в файл MJPEG AVI с реальными временными метками кадров
+// @Tags         recordings
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 10"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 80"
+// @Param        maxWidth  query  int  false  "Максимальная ширина кадра"
+// @Param        maxHeight  query  int  false  "Максимальная высота кадра"
+// @Param        maxDuration  query  string  false  "Максимальная длительность записи, по умолчанию 30m, не больше 2h. Запись также завершается, когда файл доходит до 1 ГБ"
+// @Success      201  {object}  Recording
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/recordings [post]
+func StartRecording(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	opts, err := parseStreamOptions(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	maxDuration, err := durationQuery(c, "maxDuration", defaultRecordingMaxDuration)
+	if err != nil || maxDuration <= 0 || maxDuration > recordingMaxDurationLimit {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "maxDuration must be a positive duration up to " + recordingMaxDurationLimit.String()})
+		return
+	}
+	job, err := startRecording(device, opts, maxDuration)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, job.snapshot())
+}
+
+// ListRecordings godoc
+// @Summary      Список записей экрана
+// @Description  Возвращает активные и завершённые записи экрана устройства
+// @Tags         recordings
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Success      200  {object}  []Recording
+// @Router       /device/{udid}/recordings [get]
+func ListRecordings(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	recordingsMu.Lock()
+	result := make([]Recording, 0)
+	for _, job := range recordings {
+		if job.recording.Udid == device.Properties.SerialNumber {
+			result = append(result, job.snapshot())
+		}
+	}
+	recordingsMu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+	c.JSON(http.StatusOK, result)
+}
+
+// recordingFromPath находит запись по :id или отвечает 404.
+func recordingFromPath(c *gin.Context) (*recordingJob, bool) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	job, ok := findRecording(device.Properties.SerialNumber, c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "recording not found"})
+	}
+	return job, ok
+}
+
+// GetRecording godoc
+// @Summary      Получить запись экрана
+// @Tags         recordings
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        id  path      string  true  "ID записи"
+// @Success      200  {object}  Recording
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/recordings/{id} [get]
+func GetRecording(c *gin.Context) {
+	job, ok := recordingFromPath(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job.snapshot())
+}
+
+// StopRecording godoc
+// @Summary      Остановить запись экрана
+// @Description  Останавливает запись и дописывает файл. Повторный вызов возвращает уже завершённую запись.
+// @Tags         recordings
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        id  path      string  true  "ID записи"
+// @Success      200  {object}  Recording
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/recordings/{id}/stop [post]
+func StopRecording(c *gin.Context) {
+	job, ok := recordingFromPath(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job.finish())
+}
+
+// DownloadRecording godoc
+// @Summary      Скачать запись экрана
+// @Tags         recordings
+// @Produce      video/x-msvideo
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        id  path      string  true  "ID записи"
+// @Success      200  {file}  file
+// @Failure      404  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Router       /device/{udid}/recordings/{id}/download [get]
+func DownloadRecording(c *gin.Context) {
+	job, ok := recordingFromPath(c)
+	if !ok {
+		return
+	}
+	recording := job.snapshot()
+	if recording.State != RecordingFinished {
+		c.JSON(http.StatusConflict, GenericResponse{Error: fmt.Sprintf("recording is %s", recording.State)})
+		return
+	}
+	c.Header("Content-Type", "video/x-msvideo")
+	c.FileAttachment(job.file, recording.ID+".avi")
+}
+
+// DeleteRecording godoc
+// @Summary      Удалить запись экрана
+// @Description  Останавливает запись, если она идёт, и удаляет файл
+// @Tags         recordings
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        id  path      string  true  "ID записи"
+// @Success      200  {object}  Recording
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/recordings/{id} [delete]
+func DeleteRecording(c *gin.Context) {
+	job, ok := recordingFromPath(c)
+	if !ok {
+		return
+	}
+	recording := job.finish()
+	recordingsMu.Lock()
+	delete(recordings, recording.ID)
+	recordingsMu.Unlock()
+	if err := os.Remove(job.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: "failed to delete recording file"})
+		return
+	}
+	c.JSON(http.StatusOK, recording)
+}
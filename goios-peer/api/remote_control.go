@@ -0,0 +1,218 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Типы событий, которые браузер отправляет в /control.
+const (
+	ControlEventResolution = "resolution"
+	ControlEventDown       = "down"
+	ControlEventMove       = "move"
+	ControlEventUp         = "up"
+	ControlEventText       = "text"
+	ControlEventHome       = "home"
+)
+
+// ControlEvent — событие ввода от браузера. Координаты X/Y задаются в разрешении,
+// в котором клиент показывает поток; его размер передаётся событием resolution.
+type ControlEvent struct {
+	Type   string  `json:"type"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Text   string  `json:"text"`
+}
+
+// ControlMessage — текстовое сообщение сервера клиенту, например об ошибке ввода.
+type ControlMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 64 * 1024,
+	CheckOrigin:     checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin не даёт произвольной странице в браузере оператора подключиться
+// к управлению устройством. Клиенты без заголовка Origin (не браузеры) и страницы с того же
+// хоста допускаются всегда; панели с других хостов перечисляются в WS_ALLOWED_ORIGINS через
+// запятую, например https://dashboard.example.com, "*" разрешает любой Origin.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// controlSession хранит состояние одного подключения удалённого управления.
+type controlSession struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	displayWidth  float64
+	displayHeight float64
+	frameWidth    float64
+	frameHeight   float64
+	gesture       []GesturePoint
+	lastEvent     time.Time
+}
+
+func (s *controlSession) writeMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+func (s *controlSession) sendError(err error) {
+	s.writeMessage(websocket.TextMessage, []byte(MustMarshal(ControlMessage{Type: "error", Message: err.Error()})))
+}
+
+// rememberFrameSize запоминает размер кадра в пикселях устройства для пересчёта координат.
+func (s *controlSession) rememberFrameSize(frame StreamFrame) {
+	s.mu.Lock()
+	s.frameWidth = float64(frame.SourceWidth)
+	s.frameHeight = float64(frame.SourceHeight)
+	s.mu.Unlock()
+}
+
+// toDevicePixels переводит координаты из разрешения клиента в пиксели скриншота.
+func (s *controlSession) toDevicePixels(x float64, y float64) (float64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.displayWidth <= 0 || s.displayHeight <= 0 || s.frameWidth <= 0 || s.frameHeight <= 0 {
+		return x, y
+	}
+	return x * s.frameWidth / s.displayWidth, y * s.frameHeight / s.displayHeight
+}
+
+// addGesturePoint добавляет точку к текущему жесту и возвращает накопленный жест.
+func (s *controlSession) addGesturePoint(x float64, y float64, reset bool) []GesturePoint {
+	px, py := s.toDevicePixels(x, y)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if reset || len(s.gesture) == 0 {
+		s.gesture = []GesturePoint{{X: px, Y: py}}
+	} else {
+		s.gesture = append(s.gesture, GesturePoint{X: px, Y: py, DelayMs: int(now.Sub(s.lastEvent).Milliseconds())})
+	}
+	s.lastEvent = now
+	return s.gesture
+}
+
+func (s *controlSession) takeGesture() []GesturePoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gesture := s.gesture
+	s.gesture = nil
+	return gesture
+}
+
+// handleEvent выполняет событие ввода. Жест отправляется в WDA целиком при отпускании пальца,
+// потому что W3C actions не поддерживают потоковый ввод.
+func (s *controlSession) handleEvent(client *wdaClient, event ControlEvent) error {
+	switch event.Type {
+	case ControlEventResolution:
+		s.mu.Lock()
+		s.displayWidth = event.Width
+		s.displayHeight = event.Height
+		s.mu.Unlock()
+	case ControlEventDown:
+		s.addGesturePoint(event.X, event.Y, true)
+	case ControlEventMove:
+		s.mu.Lock()
+		active := len(s.gesture) > 0
+		s.mu.Unlock()
+		if active {
+			s.addGesturePoint(event.X, event.Y, false)
+		}
+	case ControlEventUp:
+		s.addGesturePoint(event.X, event.Y, false)
+		return client.Gesture(s.takeGesture())
+	case ControlEventText:
+		return client.TypeText(event.Text)
+	case ControlEventHome:
+		return client.Home()
+	default:
+		log.Debugf("unknown control event type %q", event.Type)
+	}
+	return nil
+}
+
+// RemoteControlHandler godoc
+// @Summary      Удалённое управление через WebSocket
+// @Description  Принимает от браузера JSON-события ввода (resolution, down, move, up, text, home) и выполняет их через WDA. В то же соединение бинарными сообщениями отправляются JPEG-кадры экрана.
+// @Tags         stream
+// @Param        udid  path      string  true  "UDID устройства"
+// @Success      101  {string}  string  "Switching Protocols"
+// @Failure      409  {object}  GenericResponse
+// @Router       /device/{udid}/control [get]
+func RemoteControlHandler(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.WithField("udid", device.Properties.SerialNumber).WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+	session := &controlSession{conn: conn}
+
+	sm := getStreamManager(device)
+	ch := sm.AddClient(DefaultStreamOptions())
+	defer sm.RemoveClient(ch)
+
+	go func() {
+		for frame := range ch {
+			session.rememberFrameSize(frame)
+			if err := session.writeMessage(websocket.BinaryMessage, frame.JPEG); err != nil {
+				return
+			}
+		}
+	}()
+
+	log.WithField("udid", device.Properties.SerialNumber).Info("remote control client connected")
+	for {
+		var event ControlEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			break
+		}
+		if err := session.handleEvent(client, event); err != nil {
+			session.sendError(err)
+		}
+	}
+	log.WithField("udid", device.Properties.SerialNumber).Info("remote control client disconnected")
+}
@@ -9,11 +9,25 @@ var mjpegMiddleWare = MJPEGHeadersMiddleware()
 
 func registerRoutes(router *gin.RouterGroup) {
 	router.GET("/list", List)
+	router.GET("/devices", ListRegisteredDevices)
+	router.GET("/wda/sessions", ListWdaSessions)
+	router.DELETE("/wda/sessions", DeleteWdaSessions)
+	router.GET("/mosaic", mjpegMiddleWare, MosaicHandler)
+	webhookRoutes(router)
+	router.GET("/events/ws", EventsWebSocket)
+	// Архив syslog читается с диска, поэтому доступен без DeviceMiddleware и для отключённых устройств.
+	router.GET("/device/:udid/syslog/archive", SyslogArchive)
 
 	device := router.Group("/device/:udid")
 	device.Use(DeviceMiddleware())
 	simpleDeviceRoutes(device)
 	appRoutes(device)
+	inputRoutes(device)
+	uiRoutes(device)
+	recordingRoutes(device)
+	frameRoutes(device)
+	crashRoutes(device)
+	webrtcRoutes(device)
 }
 
 func simpleDeviceRoutes(device *gin.RouterGroup) {
@@ -27,6 +41,7 @@ func simpleDeviceRoutes(device *gin.RouterGroup) {
 	device.PUT("/image", InstallImage)
 
 	device.GET("/notifications", streamingMiddleWare, Notifications)
+	device.GET("/notifications/history", NotificationHistory)
 
 	device.GET("/info", Info)
 	device.GET("/listen", streamingMiddleWare, Listen)
@@ -36,11 +51,17 @@ func simpleDeviceRoutes(device *gin.RouterGroup) {
 
 	device.POST("/resetlocation", ResetLocation)
 	device.GET("/screenshot", Screenshot)
+	device.POST("/screenshot/compare", CompareScreen)
+	device.POST("/screenshot/wait-match", WaitScreenMatches)
 	device.GET("/screenstream", mjpegMiddleWare, MJPEGStreamHandler)
+	device.GET("/screenstream/ws", StreamWebSocketHandler)
+	device.GET("/control", RemoteControlHandler)
+	device.GET("/screen/stats", StreamStatsHandler)
 	device.PUT("/setlocation", SetLocation)
 	device.GET("/syslog", streamingMiddleWare, Syslog)
 
 	device.POST("/wda/session", CreateWdaSession)
+	device.POST("/wda/provision", ProvisionWda)
 	device.GET("/wda/screenstream/", mjpegMiddleWare, MJPEGProxyHandler)
 	device.GET("/wda/session/:sessionId", ReadWdaSession)
 	device.DELETE("/wda/session/:sessionId", DeleteWdaSession)
@@ -55,3 +76,65 @@ func appRoutes(group *gin.RouterGroup) {
 	router.POST("/install", InstallApp)
 	router.POST("/uninstall", UninstallApp)
 }
+
+func webhookRoutes(group *gin.RouterGroup) {
+	router := group.Group("/webhooks")
+	router.POST("", CreateWebhook)
+	router.GET("", ListWebhooks)
+	router.DELETE("/:id", DeleteWebhook)
+	router.GET("/:id/deliveries", ListWebhookDeliveries)
+}
+
+func crashRoutes(group *gin.RouterGroup) {
+	router := group.Group("/crashes")
+	router.GET("", ListCrashReports)
+	router.DELETE("", DeleteCrashReports)
+	router.GET("/watch", streamingMiddleWare, WatchCrashReports)
+	router.GET("/:name", GetCrashReport)
+	router.DELETE("/:name", DeleteCrashReport)
+}
+
+func inputRoutes(group *gin.RouterGroup) {
+	router := group.Group("/input")
+	router.POST("/tap", InputTap)
+	router.POST("/long-press", InputLongPress)
+	router.POST("/swipe", InputSwipe)
+	router.POST("/type", InputTypeText)
+	router.POST("/home", InputHome)
+	router.POST("/volume", InputVolume)
+	router.POST("/lock", InputLock)
+	router.POST("/unlock", InputUnlock)
+}
+
+func uiRoutes(group *gin.RouterGroup) {
+	router := group.Group("/ui")
+	router.GET("/tree", UITree)
+	router.GET("/wait-for", UIWaitFor)
+}
+
+func recordingRoutes(group *gin.RouterGroup) {
+	router := group.Group("/recordings")
+	router.POST("", StartRecording)
+	router.GET("", ListRecordings)
+	router.GET("/:id", GetRecording)
+	router.POST("/:id/stop", StopRecording)
+	router.GET("/:id/download", DownloadRecording)
+	router.DELETE("/:id", DeleteRecording)
+}
+
+func frameRoutes(group *gin.RouterGroup) {
+	router := group.Group("/frames")
+	router.GET("", GetFrames)
+	router.GET("/history", GetFrameHistory)
+	router.POST("/history", StartFrameHistory)
+	router.DELETE("/history", StopFrameHistory)
+}
+
+func webrtcRoutes(group *gin.RouterGroup) {
+	if !webrtcEnabled() {
+		return
+	}
+	router := group.Group("/webrtc")
+	router.POST("/offer", WebRTCOfferHandler)
+	router.DELETE("/:sessionId", DeleteWebRTCSession)
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultCompareTolerance = 0.1
+	defaultMatchTimeout     = 10 * time.Second
+	defaultMatchInterval    = 500 * time.Millisecond
+	// maxReferenceSize ограничивает размер загружаемого эталона.
+	maxReferenceSize = 20 * 1024 * 1024
+)
+
+// CompareOptions задаёт параметры сравнения скриншота с эталоном.
+// Tolerance — допустимое отличие канала пикселя в долях от 0 до 1, MaxDiffPercent — допустимая
+// доля отличающихся пикселей в процентах. Области Ignore задаются в пикселях эталона.
+type CompareOptions struct {
+	Tolerance      float64
+	MaxDiffPercent float64
+	Ignore         []image.Rectangle
+}
+
+// CompareResult — результат сравнения. DiffImage — PNG, на котором отличающиеся пиксели
+// выделены красным, а игнорируемые области — синим; в JSON передаётся в base64.
+type CompareResult struct {
+	Passed       bool      `json:"passed"`
+	DiffPercent  float64   `json:"diffPercent"`
+	DiffPixels   int       `json:"diffPixels"`
+	TotalPixels  int       `json:"totalPixels"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	CapturedAt   time.Time `json:"capturedAt"`
+	DiffImage    []byte    `json:"diffImage,omitempty"`
+	Attempts     int       `json:"attempts,omitempty"`
+	DeviceWidth  int       `json:"deviceWidth"`
+	DeviceHeight int       `json:"deviceHeight"`
+}
+
+var (
+	// errReferenceTooLarge — эталон больше экрана устройства.
+	errReferenceTooLarge = errors.New("reference image is larger than the device screen")
+	// errReferenceAspectRatio — пропорции эталона и экрана различаются, и экран нельзя привести к размеру эталона.
+	errReferenceAspectRatio = errors.New("reference image aspect ratio does not match the device screen")
+)
+
+// compareRequest — эталон и параметры, разобранные из multipart-запроса. Эталон декодируется
+// только после проверки его размера по заголовку, когда известен размер экрана.
+type compareRequest struct {
+	file      *multipart.FileHeader
+	size      image.Point
+	reference *image.RGBA
+	opts      CompareOptions
+}
+
+// parseCompareRequest читает из multipart-формы файл reference и поля tolerance, maxDiffPercent и ignore.
+// Поле ignore можно передать несколько раз, каждое в формате x,y,w,h. У эталона читается только заголовок.
+func parseCompareRequest(c *gin.Context) (*compareRequest, error) {
+	req := &compareRequest{opts: CompareOptions{Tolerance: defaultCompareTolerance}}
+	file, err := c.FormFile("reference")
+	if err != nil {
+		return req, fmt.Errorf("reference image is missing")
+	}
+	if file.Size > maxReferenceSize {
+		return req, fmt.Errorf("reference image exceeds the 20MB limit")
+	}
+	f, err := file.Open()
+	if err != nil {
+		return req, fmt.Errorf("failed to read reference image: %w", err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return req, fmt.Errorf("reference must be a PNG or JPEG image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return req, fmt.Errorf("reference image is empty")
+	}
+	req.file, req.size = file, image.Pt(config.Width, config.Height)
+
+	if tolerance := c.PostForm("tolerance"); tolerance != "" {
+		t, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || t < 0 || t > 1 {
+			return req, fmt.Errorf("tolerance must be a number between 0 and 1")
+		}
+		req.opts.Tolerance = t
+	}
+	if maxDiff := c.PostForm("maxDiffPercent"); maxDiff != "" {
+		m, err := strconv.ParseFloat(maxDiff, 64)
+		if err != nil || m < 0 || m > 100 {
+			return req, fmt.Errorf("maxDiffPercent must be a number between 0 and 100")
+		}
+		req.opts.MaxDiffPercent = m
+	}
+	for _, value := range c.PostFormArray("ignore") {
+		rect, err := parseRect(value)
+		if err != nil {
+			return req, fmt.Errorf("ignore: %w", err)
+		}
+		req.opts.Ignore = append(req.opts.Ignore, rect)
+	}
+	return req, nil
+}
+
+// loadReference проверяет, что эталон не больше экрана, и декодирует его. Повторные вызовы
+// возвращают уже декодированный эталон.
+func (r *compareRequest) loadReference(screen image.Point) error {
+	if r.reference != nil {
+		return nil
+	}
+	if r.size.X > screen.X || r.size.Y > screen.Y {
+		return fmt.Errorf("%w: reference is %dx%d, screen is %dx%d", errReferenceTooLarge, r.size.X, r.size.Y, screen.X, screen.Y)
+	}
+	f, err := r.file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read reference image: %w", err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed decoding reference image: %w", err)
+	}
+	r.reference = toRGBA(img)
+	return nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+// compareScreenshot сравнивает PNG с устройства с эталоном. Если размеры различаются, скриншот
+// приводится к размеру эталона — так можно сравнивать с уменьшенными эталонами, но пропорции должны совпадать.
+func compareScreenshot(pngBytes []byte, reference *image.RGBA, opts CompareOptions) (CompareResult, error) {
+	img, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return CompareResult{}, fmt.Errorf("failed decoding png: %w", err)
+	}
+	bounds := img.Bounds()
+	refBounds := reference.Bounds()
+	result := CompareResult{
+		Width:        refBounds.Dx(),
+		Height:       refBounds.Dy(),
+		DeviceWidth:  bounds.Dx(),
+		DeviceHeight: bounds.Dy(),
+	}
+
+	var actual *image.RGBA
+	if bounds.Dx() == refBounds.Dx() && bounds.Dy() == refBounds.Dy() {
+		actual = toRGBA(img)
+	} else {
+		deviceRatio := float64(bounds.Dx()) / float64(bounds.Dy())
+		refRatio := float64(refBounds.Dx()) / float64(refBounds.Dy())
+		if math.Abs(deviceRatio-refRatio) > 0.01*refRatio {
+			return result, fmt.Errorf("%w: reference is %dx%d, screen is %dx%d", errReferenceAspectRatio,
+				refBounds.Dx(), refBounds.Dy(), bounds.Dx(), bounds.Dy())
+		}
+		actual = image.NewRGBA(refBounds)
+		draw.ApproxBiLinear.Scale(actual, refBounds, img, bounds, draw.Src, nil)
+	}
+
+	diff := image.NewRGBA(refBounds)
+	threshold := int(opts.Tolerance * 255)
+	for y := 0; y < refBounds.Dy(); y++ {
+		for x := 0; x < refBounds.Dx(); x++ {
+			i := reference.PixOffset(x, y)
+			a, r := actual.Pix[i:i+4:i+4], reference.Pix[i:i+4:i+4]
+			if ignored(opts.Ignore, x, y) {
+				diff.SetRGBA(x, y, color.RGBA{R: a[0] / 4, G: a[1] / 4, B: 128 + a[2]/2, A: 255})
+				continue
+			}
+			result.TotalPixels++
+			if channelDiff(a[0], r[0]) > threshold || channelDiff(a[1], r[1]) > threshold || channelDiff(a[2], r[2]) > threshold {
+				result.DiffPixels++
+				diff.SetRGBA(x, y, color.RGBA{R: 255, A: 255})
+				continue
+			}
+			// Совпадающие пиксели приглушаются, чтобы отличия были заметны.
+			gray := uint8((int(a[0]) + int(a[1]) + int(a[2])) / 3 / 3)
+			diff.SetRGBA(x, y, color.RGBA{R: 128 + gray, G: 128 + gray, B: 128 + gray, A: 255})
+		}
+	}
+	if result.TotalPixels > 0 {
+		result.DiffPercent = float64(result.DiffPixels) * 100 / float64(result.TotalPixels)
+	}
+	result.Passed = result.DiffPercent <= opts.MaxDiffPercent
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, diff); err != nil {
+		return result, fmt.Errorf("failed encoding diff image: %w", err)
+	}
+	result.DiffImage = b.Bytes()
+	return result, nil
+}
+
+func channelDiff(a uint8, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func ignored(regions []image.Rectangle, x int, y int) bool {
+	p := image.Pt(x, y)
+	for _, r := range regions {
+		if p.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureAndCompare делает свежий скриншот и сравнивает его с эталоном.
+func captureAndCompare(device ios.DeviceEntry, req *compareRequest) (CompareResult, error) {
+	pngBytes, capturedAt, err := getStreamManager(device).Screenshot()
+	if err != nil {
+		return CompareResult{}, err
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(pngBytes))
+	if err != nil {
+		return CompareResult{}, fmt.Errorf("failed decoding png: %w", err)
+	}
+	if err := req.loadReference(image.Pt(config.Width, config.Height)); err != nil {
+		return CompareResult{}, err
+	}
+	result, err := compareScreenshot(pngBytes, req.reference, req.opts)
+	result.CapturedAt = capturedAt
+	return result, err
+}
+
+// respondCompareError отвечает 422 на несовместимый эталон и 500 на остальные ошибки.
+func respondCompareError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, errReferenceTooLarge) || errors.Is(err, errReferenceAspectRatio) {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, GenericResponse{Error: err.Error()})
+}
+
+// CompareScreen godoc
+// @Summary      Сравнить экран с эталоном
+// @Description  Делает свежий скриншот и сравнивает его с эталоном попиксельно. Возвращает процент отличий, результат и PNG с подсвеченными отличиями.
+// @Tags         general_device_specific
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        reference  formData  file  true  "Эталон, PNG или JPEG, не больше экрана и с теми же пропорциями"
+// @Param        tolerance  formData  number  false  "Допустимое отличие канала пикселя, 0-1, по умолчанию 0.1"
+// @Param        maxDiffPercent  formData  number  false  "Допустимый процент отличающихся пикселей, по умолчанию 0"
+// @Param        ignore  formData  []string  false  "Игнорируемые области x,y,w,h в пикселях эталона"
+// @Success      200  {object}  CompareResult
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/screenshot/compare [post]
+func CompareScreen(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	req, err := parseCompareRequest(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	result, err := captureAndCompare(device, req)
+	if err != nil {
+		respondCompareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// WaitScreenMatches godoc
+// @Summary      Ожидание совпадения экрана с эталоном
+// @Description  Сравнивает экран с эталоном, пока он не совпадёт или не истечёт timeout. При таймауте возвращает 504 с результатом последнего сравнения.
+// @Tags         general_device_specific
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        reference  formData  file  true  "Эталон, PNG или JPEG, не больше экрана и с теми же пропорциями"
+// @Param        tolerance  formData  number  false  "Допустимое отличие канала пикселя, 0-1, по умолчанию 0.1"
+// @Param        maxDiffPercent  formData  number  false  "Допустимый процент отличающихся пикселей, по умолчанию 0"
+// @Param        ignore  formData  []string  false  "Игнорируемые области x,y,w,h в пикселях эталона"
+// @Param        timeout  query  string  false  "Время ожидания, по умолчанию 10s, не больше 5m"
+// @Param        interval  query  string  false  "Интервал между сравнениями, по умолчанию 500ms, от 100ms до timeout"
+// @Success      200  {object}  CompareResult
+// @Failure      504  {object}  CompareResult
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/screenshot/wait-match [post]
+func WaitScreenMatches(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	timeout, interval, err := waitDurations(c, defaultMatchTimeout, defaultMatchInterval)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	req, err := parseCompareRequest(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		result, err := captureAndCompare(device, req)
+		if err != nil {
+			respondCompareError(c, err)
+			return
+		}
+		result.Attempts = attempt
+		if result.Passed {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+		if time.Now().Add(interval).After(deadline) {
+			c.JSON(http.StatusGatewayTimeout, result)
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
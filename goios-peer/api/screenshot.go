@@ -1,11 +1,12 @@
 package api
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
+	"image"
 	"image/jpeg"
-	"image/png"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,173 +14,459 @@ import (
 	"github.com/danielpaulus/go-ios/ios/instruments"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
 )
 
 const (
 	mjpegFrameFooter = "\r\n\r\n"
 	mjpegFrameHeader = "--BoundaryString\r\nContent-type: image/jpg\r\nContent-Length: %d\r\n\r\n"
+
+	maxStreamFPS = 30
 )
 
-// StreamManager управляет трансляцией кадров и клиентами для одного устройства/пути.
+// StreamOptions задаёт параметры кодирования потока для клиента.
+// Клиенты с одинаковыми параметрами получают результат одного и того же кодирования.
+type StreamOptions struct {
+	FPS       int
+	Quality   int
+	MaxWidth  int
+	MaxHeight int
+	Grayscale bool
+	// SkipUnchanged не отправляет кадры, совпадающие с предыдущим, но не реже одного раза за Keepalive,
+	// чтобы MJPEG-клиенты не отваливались по таймауту.
+	SkipUnchanged bool
+	Keepalive     time.Duration
+}
+
+// DefaultStreamOptions: ~10fps, качество 80, полное разрешение, без повторной отправки неизменившихся кадров.
+func DefaultStreamOptions() StreamOptions {
+	return StreamOptions{FPS: 10, Quality: 80, SkipUnchanged: true, Keepalive: 2 * time.Second}
+}
+
+// period возвращает интервал между кадрами для клиента.
+func (o StreamOptions) period() time.Duration {
+	return time.Second / time.Duration(o.FPS)
+}
+
+// parseStreamOptions читает параметры потока из query: fps, quality, maxWidth, maxHeight, grayscale,
+// skipUnchanged и keepalive.
+func parseStreamOptions(c *gin.Context) (StreamOptions, error) {
+	return parseStreamOptionsWith(c, DefaultStreamOptions())
+}
+
+// parseStreamOptionsWith читает параметры потока из query, используя opts как значения по умолчанию.
+func parseStreamOptionsWith(c *gin.Context, opts StreamOptions) (StreamOptions, error) {
+	ints := []struct {
+		name     string
+		target   *int
+		min, max int
+	}{
+		{"fps", &opts.FPS, 1, maxStreamFPS},
+		{"quality", &opts.Quality, 1, 100},
+		{"maxWidth", &opts.MaxWidth, 1, 10000},
+		{"maxHeight", &opts.MaxHeight, 1, 10000},
+	}
+	for _, p := range ints {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < p.min || n > p.max {
+			return opts, fmt.Errorf("%s must be an integer between %d and %d", p.name, p.min, p.max)
+		}
+		*p.target = n
+	}
+	if grayscale := c.Query("grayscale"); grayscale != "" {
+		g, err := strconv.ParseBool(grayscale)
+		if err != nil {
+			return opts, fmt.Errorf("grayscale must be true or false")
+		}
+		opts.Grayscale = g
+	}
+	if skip := c.Query("skipUnchanged"); skip != "" {
+		b, err := strconv.ParseBool(skip)
+		if err != nil {
+			return opts, fmt.Errorf("skipUnchanged must be true or false")
+		}
+		opts.SkipUnchanged = b
+	}
+	if keepalive := c.Query("keepalive"); keepalive != "" {
+		d, err := time.ParseDuration(keepalive)
+		if err != nil || d < opts.period() {
+			return opts, fmt.Errorf("keepalive must be a duration not shorter than the frame interval")
+		}
+		opts.Keepalive = d
+	}
+	return opts, nil
+}
+
+// StreamFrame — закодированный кадр, который получают клиенты StreamManager.
+type StreamFrame struct {
+	Seq        uint64
+	CapturedAt time.Time
+	Width      int
+	Height     int
+	// SourceWidth и SourceHeight — размер экрана устройства до масштабирования.
+	SourceWidth  int
+	SourceHeight int
+	JPEG         []byte
+}
+
+// encodeFrame масштабирует кадр под ограничения opts, при необходимости переводит в оттенки серого
+// и кодирует в JPEG.
+func encodeFrame(img image.Image, opts StreamOptions) ([]byte, error) {
+	img = scaleImage(img, opts.MaxWidth, opts.MaxHeight)
+	if opts.Grayscale {
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// scaledSize возвращает размер изображения, уменьшенного с сохранением пропорций до maxWidth x maxHeight.
+// Нулевое ограничение означает отсутствие ограничения по этой стороне.
+func scaledSize(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	ratio := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		ratio = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if r := float64(maxHeight) / float64(height); r < ratio {
+			ratio = r
+		}
+	}
+	if ratio >= 1 {
+		return width, height
+	}
+	return max(1, int(float64(width)*ratio)), max(1, int(float64(height)*ratio))
+}
+
+// scaleImage уменьшает изображение, чтобы оно вписалось в maxWidth x maxHeight.
+func scaleImage(img image.Image, maxWidth int, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := scaledSize(bounds.Dx(), bounds.Dy(), maxWidth, maxHeight)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// encodeGroup объединяет клиентов с одинаковыми StreamOptions. lastEmit — время захвата последнего
+// кадра, назначенного группе; lastSeq и lastHash — номер и хэш последнего кадра, который группа получила.
+// Кадры упорядочиваются внутри группы: кадр, который обогнал кадр другой группы, не выбрасывается.
+type encodeGroup struct {
+	clients  map[chan StreamFrame]struct{}
+	lastEmit time.Time
+	lastSeq  uint64
+	lastHash uint64
+}
+
+// StreamManager владеет единственным сервисом скриншотов устройства и раздаёт кадры всем потребителям:
+// MJPEG-клиентам, одиночным скриншотам и другим подписчикам.
+// Захват идёт с частотой самого требовательного клиента, остальные группы прореживаются.
 type StreamManager struct {
 	mu        sync.Mutex
-	consumers map[chan []byte]struct{}
+	consumers map[chan StreamFrame]StreamOptions
+	groups    map[StreamOptions]*encodeGroup
 	running   bool
 	stop      chan struct{}
 	device    ios.DeviceEntry
-	conn      *instruments.ScreenshotService
+
+	// conn разделяется циклом захвата и одиночными скриншотами; connRefs считает его пользователей,
+	// captureMu не даёт им вызывать TakeScreenshot одновременно.
+	conn               *instruments.ScreenshotService
+	connRefs           int
+	captureMu          sync.Mutex
+	screenshotRequests int
+
+	latestPNG []byte
+	latestAt  time.Time
+
+	stats streamStats
 }
 
 // Создаёт новый StreamManager для конкретного устройства.
 func NewStreamManager(device ios.DeviceEntry) *StreamManager {
 	return &StreamManager{
-		consumers: make(map[chan []byte]struct{}),
+		consumers: make(map[chan StreamFrame]StreamOptions),
+		groups:    make(map[StreamOptions]*encodeGroup),
 		device:    device,
 	}
 }
 
-// Добавляет клиента и запускает поток при первом клиенте.
-func (s *StreamManager) AddClient() chan []byte {
+// ConsumerCount возвращает число MJPEG-клиентов и выполняющихся запросов скриншота.
+func (s *StreamManager) ConsumerCount() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	ch := make(chan []byte, 10)
-	s.consumers[ch] = struct{}{}
+	return len(s.consumers) + s.screenshotRequests
+}
+
+// Добавляет клиента с указанными параметрами и запускает поток при первом клиенте.
+func (s *StreamManager) AddClient(opts StreamOptions) chan StreamFrame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan StreamFrame, 10)
+	s.consumers[ch] = opts
+	group, ok := s.groups[opts]
+	if !ok {
+		group = &encodeGroup{clients: make(map[chan StreamFrame]struct{})}
+		s.groups[opts] = group
+	}
+	group.clients[ch] = struct{}{}
 	if !s.running {
 		s.startStreaming()
 	}
+	s.logConsumers("stream client added")
 	return ch
 }
 
 // Удаляет клиента и останавливает поток, если клиентов не осталось.
-func (s *StreamManager) RemoveClient(ch chan []byte) {
+func (s *StreamManager) RemoveClient(ch chan StreamFrame) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	opts, ok := s.consumers[ch]
+	if !ok {
+		return
+	}
 	delete(s.consumers, ch)
+	if group, ok := s.groups[opts]; ok {
+		delete(group.clients, ch)
+		if len(group.clients) == 0 {
+			delete(s.groups, opts)
+		}
+	}
 	close(ch)
 	if len(s.consumers) == 0 && s.running {
 		s.stopStreaming()
 	}
+	s.logConsumers("stream client removed")
 }
 
-// Запускает поток скриншотов для всех клиентов этого StreamManager.
-func (s *StreamManager) startStreaming() {
-	s.stop = make(chan struct{})
-	s.running = true
+// Close отключает всех клиентов и освобождает сервис скриншотов, например когда устройство отключено.
+func (s *StreamManager) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.consumers {
+		close(ch)
+	}
+	s.consumers = make(map[chan StreamFrame]StreamOptions)
+	s.groups = make(map[StreamOptions]*encodeGroup)
+	if s.running {
+		s.stopStreaming()
+	}
+}
+
+// logConsumers пишет текущее число потребителей. Вызывается под s.mu.
+func (s *StreamManager) logConsumers(event string) {
+	log.
+		WithField("udid", s.device.Properties.SerialNumber).
+		WithField("streamClients", len(s.consumers)).
+		WithField("screenshotRequests", s.screenshotRequests).
+		Debug(event)
+}
 
-	conn, err := instruments.NewScreenshotService(s.device)
+// acquireConnLocked открывает сервис скриншотов при первом пользователе. Вызывается под s.mu.
+func (s *StreamManager) acquireConnLocked() (*instruments.ScreenshotService, error) {
+	if s.conn == nil {
+		conn, err := instruments.NewScreenshotService(s.device)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	s.connRefs++
+	return s.conn, nil
+}
+
+// releaseConnLocked закрывает сервис скриншотов, когда им больше никто не пользуется. Вызывается под s.mu.
+func (s *StreamManager) releaseConnLocked() {
+	s.connRefs--
+	if s.connRefs <= 0 && s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.connRefs = 0
+	}
+}
+
+// takeScreenshot делает снимок через общий сервис, не пересекаясь с другими вызовами.
+func (s *StreamManager) takeScreenshot(conn *instruments.ScreenshotService) ([]byte, error) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	return conn.TakeScreenshot()
+}
+
+// Screenshot возвращает PNG текущего экрана и время его захвата. Если поток уже идёт, отдаёт
+// свежий кадр из него, иначе делает снимок через тот же сервис скриншотов. Кадр медленного потока
+// считается свежим не дольше двух интервалов частоты по умолчанию.
+func (s *StreamManager) Screenshot() ([]byte, time.Time, error) {
+	s.mu.Lock()
+	fresh := 2 * min(s.capturePeriod(), DefaultStreamOptions().period())
+	if s.running && s.latestPNG != nil && time.Since(s.latestAt) < fresh {
+		png, at := s.latestPNG, s.latestAt
+		s.mu.Unlock()
+		return png, at, nil
+	}
+	conn, err := s.acquireConnLocked()
 	if err != nil {
-		log.Errorf("failed to start screenshot service: %v", err)
-		s.running = false
-		return
+		s.mu.Unlock()
+		return nil, time.Time{}, err
 	}
-	s.conn = conn
-
-	go func() {
-		var opt jpeg.Options
-		opt.Quality = 80
-		for {
-			select {
-			case <-s.stop:
-				return
-			default:
-				start := time.Now()
-				pngBytes, err := s.conn.TakeScreenshot()
-				if err != nil {
-					log.Warnf("Screenshot failed: %v", err)
-					time.Sleep(1 * time.Second)
-					continue
-				}
-				img, err := png.Decode(bytes.NewReader(pngBytes))
-				if err != nil {
-					log.Warnf("failed decoding png %v", err)
-					continue
-				}
-				var b bytes.Buffer
-				foo := bufio.NewWriter(&b)
-				err = jpeg.Encode(foo, img, &opt)
-				if err != nil {
-					log.Warnf("failed encoding jpg %v", err)
-					continue
-				}
-				foo.Flush()
-				jpg := b.Bytes()
-
-				elapsed := time.Since(start)
-				log.Debugf("frame prepared in %fs", elapsed.Seconds())
-
-				s.mu.Lock()
-				for ch := range s.consumers {
-					// Не блокируем, если клиент не успевает получать кадры
-					select {
-					case ch <- jpg:
-					default:
-					}
-				}
-				s.mu.Unlock()
-
-				time.Sleep(100 * time.Millisecond) // ~10fps
-			}
-		}
+	s.screenshotRequests++
+	s.logConsumers("screenshot requested")
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.screenshotRequests--
+		s.releaseConnLocked()
+		s.mu.Unlock()
 	}()
+	capturedAt := time.Now()
+	png, err := s.takeScreenshot(conn)
+	return png, capturedAt, err
+}
+
+// capturePeriod возвращает интервал захвата для самого требовательного клиента: если все клиенты
+// просят 1-2 fps, захват идёт с той же частотой. Без клиентов — интервал по умолчанию. Вызывается под s.mu.
+func (s *StreamManager) capturePeriod() time.Duration {
+	var period time.Duration
+	for opts := range s.groups {
+		if p := opts.period(); period == 0 || p < period {
+			period = p
+		}
+	}
+	if period == 0 {
+		return DefaultStreamOptions().period()
+	}
+	return period
+}
+
+// dueGroups возвращает параметры групп, которым пора отправить кадр, и отмечает время отправки.
+// Допуск в 10% периода сглаживает неровный темп захвата. Кадр с тем же хэшем, что и последний
+// полученный группой, получают только группы без SkipUnchanged и группы, у которых истёк Keepalive.
+// Сравнение идёт с кадром группы, а не с предыдущим захватом: изменение, которое группа пропустила
+// из-за прореживания или выброса кадра, она получит со следующим кадром.
+func (s *StreamManager) dueGroups(now time.Time, hash uint64) []StreamOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := make([]StreamOptions, 0, len(s.groups))
+	for opts, group := range s.groups {
+		changed := hash != group.lastHash
+		if !changed && opts.SkipUnchanged && now.Sub(group.lastEmit) < opts.Keepalive {
+			continue
+		}
+		period := opts.period()
+		if now.Sub(group.lastEmit) >= period-period/10 {
+			group.lastEmit = now
+			due = append(due, opts)
+		}
+	}
+	return due
 }
 
-// Останавливает поток скриншотов.
+// Останавливает поток скриншотов. Вызывается под s.mu.
 func (s *StreamManager) stopStreaming() {
 	close(s.stop)
 	s.running = false
-	if s.conn != nil {
-		s.conn.Close()
-		s.conn = nil
-	}
+	s.latestPNG = nil
+	s.releaseConnLocked()
 }
 
-// Глобальная map для StreamManager'ов по уникальному пути.
+// Глобальная map для StreamManager'ов по UDID устройства.
 var (
 	streamManagersMu sync.Mutex
 	streamManagers   = make(map[string]*StreamManager)
 )
 
-// Возвращает StreamManager для пути (создаёт, если не существует).
-func getStreamManager(path string, device ios.DeviceEntry) *StreamManager {
+// Возвращает StreamManager для устройства (создаёт, если не существует).
+func getStreamManager(device ios.DeviceEntry) *StreamManager {
 	streamManagersMu.Lock()
 	defer streamManagersMu.Unlock()
-	sm, ok := streamManagers[path]
+	udid := device.Properties.SerialNumber
+	sm, ok := streamManagers[udid]
 	if !ok {
 		sm = NewStreamManager(device)
-		streamManagers[path] = sm
+		streamManagers[udid] = sm
 	}
 	return sm
 }
 
+// findStreamManager возвращает StreamManager устройства, не создавая его.
+func findStreamManager(udid string) (*StreamManager, bool) {
+	streamManagersMu.Lock()
+	defer streamManagersMu.Unlock()
+	sm, ok := streamManagers[udid]
+	return sm, ok
+}
+
+// closeStreamManager останавливает и удаляет StreamManager отключённого устройства.
+func closeStreamManager(udid string) {
+	streamManagersMu.Lock()
+	sm, ok := streamManagers[udid]
+	delete(streamManagers, udid)
+	streamManagersMu.Unlock()
+	if ok {
+		sm.Close()
+		log.WithField("udid", udid).Info("screen stream closed, device detached")
+	}
+}
+
+func init() {
+	onDeviceDetached(closeStreamManager)
+}
+
 // MJPEGStreamHandler godoc
 // @Summary      MJPEG Stream
-// @Description  Возвращает MJPEG-поток скриншотов с iOS-устройства.
+// @Description  Возвращает MJPEG-поток скриншотов с iOS-устройства. Клиенты с одинаковыми параметрами используют общее кодирование.
 // @Tags         stream
 // @Produce      multipart/x-mixed-replace
 // @Param        device_id  path      string  true  "ID устройства"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 10"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 80"
+// @Param        maxWidth  query  int  false  "Максимальная ширина кадра"
+// @Param        maxHeight  query  int  false  "Максимальная высота кадра"
+// @Param        grayscale  query  bool  false  "Кадры в оттенках серого"
+// @Param        skipUnchanged  query  bool  false  "Не отправлять неизменившиеся кадры, по умолчанию true"
+// @Param        keepalive  query  string  false  "Максимальный интервал между кадрами при неизменном экране, по умолчанию 2s"
 // @Success      200  {string}  string  "stream"
+// @Failure      422  {object}  GenericResponse
 // @Header       200  {string}  Content-Type "multipart/x-mixed-replace; boundary=--BoundaryString"
 // @Header       200  {string}  Cache-Control "no-cache, private"
 // @Header       200  {string}  Pragma "no-cache"
 // @Header       200  {string}  Access-Control-Allow-Origin "*"
 // @Router       /screenstream [get]
 func MJPEGStreamHandler(c *gin.Context) {
-	path := c.Request.URL.Path
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+
+	opts, err := parseStreamOptions(c)
+	if err != nil {
+		c.Header("Content-Type", "application/json")
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
 
-	sm := getStreamManager(path, device)
-	log.Infof("starting mjpeg stream for client on path %s", path)
-	ch := sm.AddClient()
+	sm := getStreamManager(device)
+	log.Infof("starting mjpeg stream for client of %s with %+v", udid, opts)
+	ch := sm.AddClient(opts)
 	defer sm.RemoveClient(ch)
 
 	writer := c.Writer
 
-	for jpg := range ch {
-		_, err := writer.Write([]byte(fmt.Sprintf(mjpegFrameHeader, len(jpg))))
+	for frame := range ch {
+		_, err := writer.Write([]byte(fmt.Sprintf(mjpegFrameHeader, len(frame.JPEG))))
 		if err != nil {
 			break
 		}
-		_, err = writer.Write(jpg)
+		_, err = writer.Write(frame.JPEG)
 		if err != nil {
 			break
 		}
@@ -189,5 +476,5 @@ func MJPEGStreamHandler(c *gin.Context) {
 		}
 		writer.Flush()
 	}
-	log.Infof("client disconnected from %s", path)
+	log.Infof("client disconnected from %s", udid)
 }
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+const (
+	ScreenshotFormatPNG  = "png"
+	ScreenshotFormatJPEG = "jpeg"
+	// ScreenshotFormatWebP запрашивает WebP, если он доступен. Кодировщика WebP на чистом Go нет,
+	// поэтому такой запрос отдаётся в JPEG — реальный формат виден по Content-Type.
+	ScreenshotFormatWebP = "webp"
+)
+
+// errInvalidScreenshotOptions — ошибка в параметрах запроса, которую нельзя было проверить до захвата,
+// например область обрезки за пределами экрана.
+var errInvalidScreenshotOptions = errors.New("invalid screenshot options")
+
+// ScreenshotOptions задаёт формат, масштаб и обрезку скриншота.
+// Обрезка задаётся в пикселях устройства и применяется до масштабирования.
+type ScreenshotOptions struct {
+	Format  string
+	Quality int
+	Scale   float64
+	Width   int
+	Crop    image.Rectangle
+}
+
+// RenderedScreenshot — скриншот после преобразования вместе с исходным размером экрана.
+type RenderedScreenshot struct {
+	Data         []byte
+	ContentType  string
+	Width        int
+	Height       int
+	DeviceWidth  int
+	DeviceHeight int
+}
+
+// parseScreenshotOptions читает параметры скриншота из query: format, quality, scale, width и crop=x,y,w,h.
+func parseScreenshotOptions(c *gin.Context) (ScreenshotOptions, error) {
+	opts := ScreenshotOptions{Format: ScreenshotFormatPNG, Quality: 80, Scale: 1}
+	switch format := strings.ToLower(c.DefaultQuery("format", ScreenshotFormatPNG)); format {
+	case ScreenshotFormatPNG, ScreenshotFormatJPEG, ScreenshotFormatWebP:
+		opts.Format = format
+	case "jpg":
+		opts.Format = ScreenshotFormatJPEG
+	default:
+		return opts, fmt.Errorf("format must be png, jpeg or webp")
+	}
+	if quality := c.Query("quality"); quality != "" {
+		q, err := strconv.Atoi(quality)
+		if err != nil || q < 1 || q > 100 {
+			return opts, fmt.Errorf("quality must be an integer between 1 and 100")
+		}
+		opts.Quality = q
+	}
+	if scale := c.Query("scale"); scale != "" {
+		f, err := strconv.ParseFloat(scale, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return opts, fmt.Errorf("scale must be a number in (0, 1]")
+		}
+		opts.Scale = f
+	}
+	if width := c.Query("width"); width != "" {
+		w, err := strconv.Atoi(width)
+		if err != nil || w < 1 || w > 10000 {
+			return opts, fmt.Errorf("width must be an integer between 1 and 10000")
+		}
+		opts.Width = w
+	}
+	if opts.Width > 0 && opts.Scale != 1 {
+		return opts, fmt.Errorf("scale and width can not be used together")
+	}
+	if crop := c.Query("crop"); crop != "" {
+		rect, err := parseRect(crop)
+		if err != nil {
+			return opts, fmt.Errorf("crop: %w", err)
+		}
+		opts.Crop = rect
+	}
+	return opts, nil
+}
+
+// parseRect разбирает прямоугольник в формате x,y,w,h.
+func parseRect(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("rectangle must be x,y,w,h")
+	}
+	var values [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("rectangle must be x,y,w,h with non-negative integers")
+		}
+		values[i] = n
+	}
+	if values[2] == 0 || values[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("rectangle width and height must be positive")
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// needsDecode сообщает, нужно ли декодировать PNG. Без преобразований отдаются исходные байты.
+func (o ScreenshotOptions) needsDecode() bool {
+	return o.Format != ScreenshotFormatPNG || o.Scale != 1 || o.Width > 0 || !o.Crop.Empty()
+}
+
+// renderScreenshot применяет к PNG с устройства обрезку, масштаб и формат из opts.
+func renderScreenshot(pngBytes []byte, opts ScreenshotOptions) (RenderedScreenshot, error) {
+	if !opts.needsDecode() {
+		config, err := png.DecodeConfig(bytes.NewReader(pngBytes))
+		if err != nil {
+			return RenderedScreenshot{}, fmt.Errorf("failed decoding png: %w", err)
+		}
+		return RenderedScreenshot{
+			Data:         pngBytes,
+			ContentType:  "image/png",
+			Width:        config.Width,
+			Height:       config.Height,
+			DeviceWidth:  config.Width,
+			DeviceHeight: config.Height,
+		}, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return RenderedScreenshot{}, fmt.Errorf("failed decoding png: %w", err)
+	}
+	bounds := img.Bounds()
+	result := RenderedScreenshot{DeviceWidth: bounds.Dx(), DeviceHeight: bounds.Dy()}
+
+	if !opts.Crop.Empty() {
+		crop := opts.Crop.Add(bounds.Min)
+		if !crop.In(bounds) {
+			return result, fmt.Errorf("%w: crop %d,%d,%d,%d is outside of the %dx%d screen", errInvalidScreenshotOptions,
+				opts.Crop.Min.X, opts.Crop.Min.Y, opts.Crop.Dx(), opts.Crop.Dy(), bounds.Dx(), bounds.Dy())
+		}
+		img = cropImage(img, crop)
+		bounds = img.Bounds()
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	switch {
+	case opts.Width > 0 && opts.Width < width:
+		height = max(1, height*opts.Width/width)
+		width = opts.Width
+	case opts.Scale < 1:
+		width = max(1, int(float64(width)*opts.Scale))
+		height = max(1, int(float64(height)*opts.Scale))
+	}
+	img = scaleImage(img, width, height)
+	result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	var b bytes.Buffer
+	switch opts.Format {
+	case ScreenshotFormatPNG:
+		err = png.Encode(&b, img)
+		result.ContentType = "image/png"
+	default:
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: opts.Quality})
+		result.ContentType = "image/jpeg"
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed encoding screenshot: %w", err)
+	}
+	result.Data = b.Bytes()
+	return result, nil
+}
+
+// cropImage вырезает область rect. Для типов с SubImage копирования не происходит.
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
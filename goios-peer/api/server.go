@@ -19,6 +19,7 @@ func StartRestAPI() {
 	myfile, _ := os.Create("go-ios.log")
 	gin.DefaultWriter = io.MultiWriter(myfile, os.Stdout)
 	TunnelStart()
+	StartDeviceWatcher()
 	router.Use(MyLogger(log), gin.Recovery())
 
 	v1 := router.Group("/api/v1")
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	StreamFormatSSE    = "sse"
+	StreamFormatNDJSON = "ndjson"
+)
+
+const (
+	// sseHeartbeatInterval — как часто в пустой поток отправляется комментарий, чтобы прокси не закрыли соединение.
+	sseHeartbeatInterval = 15 * time.Second
+	// sseRetry — через сколько миллисекунд EventSource переподключается после обрыва.
+	sseRetry = 3000
+)
+
+// lastEventID читает номер последнего полученного события из заголовка Last-Event-ID
+// или из query lastEventId, если клиент не может задать заголовок.
+func lastEventID(c *gin.Context) (uint64, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("lastEventId")
+	}
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// feedErrorResponse отвечает ошибкой JSON до начала потока. Заголовки потока, выставленные
+// StreamingHeaderMiddleware, убираются, чтобы клиент разобрал ответ как JSON.
+func feedErrorResponse(c *gin.Context, status int, err error) {
+	c.Writer.Header().Del("Content-Type")
+	c.Writer.Header().Del("Transfer-Encoding")
+	c.JSON(status, GenericResponse{Error: err.Error()})
+}
+
+// writeFeedEvent пишет событие в формате SSE или строкой NDJSON.
+func writeFeedEvent(w gin.ResponseWriter, format string, e feedEvent) error {
+	var b strings.Builder
+	if format == StreamFormatNDJSON {
+		b.WriteString(e.Data)
+		b.WriteByte('\n')
+	} else {
+		fmt.Fprintf(&b, "id: %d\nevent: %s\n", e.ID, e.Event)
+		for _, line := range strings.Split(e.Data, "\n") {
+			fmt.Fprintf(&b, "data: %s\n", line)
+		}
+		b.WriteByte('\n')
+	}
+	_, err := w.WriteString(b.String())
+	return err
+}
+
+// writeFeedError пишет завершающее событие error. У него нет id, поэтому после переподключения
+// Last-Event-ID указывает на последнее настоящее событие.
+func writeFeedError(w gin.ResponseWriter, format string, err error) {
+	data := MustMarshal(GenericResponse{Error: err.Error()})
+	if format == StreamFormatNDJSON {
+		w.WriteString(data + "\n")
+	} else {
+		w.WriteString("event: error\ndata: " + data + "\n\n")
+	}
+	w.Flush()
+}
+
+// serveFeed отдаёт события feed клиенту, пока он не отключится или источник не завершится.
+// Если поток завершил сервер, последним приходит событие error с причиной.
+// По умолчанию используется SSE с id и event, ?format=ndjson отдаёт только JSON построчно.
+// Клиент с Last-Event-ID сначала получает пропущенные события из истории.
+// Если accept не nil, клиенту отправляются только события, для которых он вернул true.
+// Если источник не смог подключиться к устройству, клиент получает ответ 500 с ошибкой.
+func serveFeed(c *gin.Context, feed *eventFeed, source feedSource, accept func(feedEvent) bool) {
+	serveFeedWith(c, feed, accept, func(lastID uint64, resume bool) ([]feedEvent, *feedSubscription) {
+		return feed.subscribe(source, lastID, resume)
+	})
+}
+
+// serveFeedWith работает как serveFeed, но подписывает клиента через subscribe: так обработчик
+// может заменить события, которые клиент получает до потока.
+func serveFeedWith(c *gin.Context, feed *eventFeed, accept func(feedEvent) bool, subscribe func(lastID uint64, resume bool) ([]feedEvent, *feedSubscription)) {
+	format := c.DefaultQuery("format", StreamFormatSSE)
+	if format != StreamFormatSSE && format != StreamFormatNDJSON {
+		feedErrorResponse(c, http.StatusUnprocessableEntity, errors.New("format must be sse or ndjson"))
+		return
+	}
+	lastID, resume := lastEventID(c)
+	replay, sub := subscribe(lastID, resume)
+	defer feed.unsubscribe(sub)
+
+	// Пока ответ не начат, ошибку подключения к устройству можно вернуть обычным ответом.
+	select {
+	case <-sub.ready:
+	case <-sub.done:
+		if sub.err != nil {
+			feedErrorResponse(c, http.StatusInternalServerError, sub.err)
+			return
+		}
+	case <-time.After(feedStartTimeout):
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	if format == StreamFormatNDJSON {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+	w := c.Writer
+	if format == StreamFormatSSE {
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	}
+	for _, e := range replay {
+		if accept != nil && !accept(e) {
+			continue
+		}
+		if err := writeFeedEvent(w, format, e); err != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				if sub.err != nil {
+					writeFeedError(w, format, sub.err)
+				}
+				return
+			}
+			if accept != nil && !accept(e) {
+				continue
+			}
+			if err := writeFeedEvent(w, format, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if format != StreamFormatSSE {
+				continue
+			}
+			if _, err := w.WriteString(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		w.Flush()
+	}
+}
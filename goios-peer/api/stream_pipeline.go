@@ -0,0 +1,401 @@
+package api
+
+import (
+	"bytes"
+	"hash/fnv"
+	"image/png"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/instruments"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Поток экрана работает как конвейер: захват -> очередь -> пул воркеров (PNG decode + JPEG encode) -> выдача.
+// Захват не ждёт кодирования, поэтому fps ограничен самой медленной стадией, а не их суммой.
+
+// streamQueueSize — ёмкость очередей между стадиями. При переполнении старые кадры выбрасываются.
+const streamQueueSize = 4
+
+// streamWorkers — число воркеров декодирования и кодирования.
+var streamWorkers = min(runtime.NumCPU(), 4)
+
+// capturedFrame — сырой кадр после захвата вместе с группами, которым он нужен.
+type capturedFrame struct {
+	seq        uint64
+	capturedAt time.Time
+	hash       uint64
+	png        []byte
+	groups     []StreamOptions
+}
+
+// encodedFrame — кадр, закодированный для каждой из групп.
+type encodedFrame struct {
+	seq        uint64
+	capturedAt time.Time
+	hash       uint64
+	frames     map[StreamOptions]StreamFrame
+}
+
+// Запускает конвейер скриншотов для всех клиентов этого StreamManager. Вызывается под s.mu.
+func (s *StreamManager) startStreaming() {
+	conn, err := s.acquireConnLocked()
+	if err != nil {
+		log.Errorf("failed to start screenshot service: %v", err)
+		return
+	}
+	s.stop = make(chan struct{})
+	s.running = true
+	stop := s.stop
+	s.stats.reset(streamWorkers)
+
+	captured := make(chan capturedFrame, streamQueueSize)
+	encoded := make(chan encodedFrame, streamQueueSize)
+
+	go s.captureLoop(conn, stop, captured)
+
+	var workers sync.WaitGroup
+	for i := 0; i < streamWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.encodeLoop(captured, encoded)
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(encoded)
+	}()
+
+	go s.emitLoop(encoded)
+}
+
+// captureLoop непрерывно делает скриншоты с частотой самого требовательного клиента.
+func (s *StreamManager) captureLoop(conn *instruments.ScreenshotService, stop chan struct{}, captured chan capturedFrame) {
+	defer close(captured)
+	var lastHash uint64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		start := time.Now()
+		pngBytes, err := s.takeScreenshot(conn)
+		if err != nil {
+			log.Warnf("Screenshot failed: %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		s.stats.observeCapture(time.Since(start))
+
+		s.mu.Lock()
+		s.latestPNG = pngBytes
+		s.latestAt = start
+		s.mu.Unlock()
+
+		// Устройство кодирует одинаковый экран в одинаковый PNG, поэтому для обнаружения
+		// изменений достаточно хэша сырых байтов, без декодирования.
+		hash := fnv.New64a()
+		hash.Write(pngBytes)
+		sum := hash.Sum64()
+		if sum == lastHash {
+			s.stats.observeUnchanged()
+		}
+		lastHash = sum
+
+		if groups := s.dueGroups(start, sum); len(groups) > 0 {
+			frame := capturedFrame{seq: s.stats.nextSeq(), capturedAt: start, hash: sum, png: pngBytes, groups: groups}
+			select {
+			case captured <- frame:
+			default:
+				// Очередь полна: выбрасываем самый старый кадр, чтобы не копить задержку.
+				select {
+				case <-captured:
+					s.stats.observeDrop()
+				default:
+				}
+				captured <- frame
+			}
+		}
+
+		s.mu.Lock()
+		wait := s.capturePeriod() - time.Since(start)
+		s.mu.Unlock()
+		if wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// encodeLoop декодирует PNG и кодирует JPEG для каждой группы. Группы, которые уже получили
+// более новый кадр, пропускаются; кадр, устаревший для всех групп, не декодируется.
+func (s *StreamManager) encodeLoop(captured chan capturedFrame, encoded chan encodedFrame) {
+	for frame := range captured {
+		groups := s.pendingGroups(frame.seq, frame.groups)
+		if len(groups) == 0 {
+			s.stats.observeDrop()
+			continue
+		}
+		start := time.Now()
+		img, err := png.Decode(bytes.NewReader(frame.png))
+		if err != nil {
+			log.Warnf("failed decoding png %v", err)
+			s.stats.observeDrop()
+			continue
+		}
+		s.stats.observeDecode(time.Since(start))
+
+		result := encodedFrame{seq: frame.seq, capturedAt: frame.capturedAt, hash: frame.hash, frames: make(map[StreamOptions]StreamFrame, len(groups))}
+		for _, opts := range groups {
+			start = time.Now()
+			jpg, err := encodeFrame(img, opts)
+			if err != nil {
+				log.Warnf("failed encoding jpg %v", err)
+				continue
+			}
+			s.stats.observeEncode(time.Since(start))
+			width, height := scaledSize(img.Bounds().Dx(), img.Bounds().Dy(), opts.MaxWidth, opts.MaxHeight)
+			result.frames[opts] = StreamFrame{
+				Seq:          frame.seq,
+				CapturedAt:   frame.capturedAt,
+				Width:        width,
+				Height:       height,
+				SourceWidth:  img.Bounds().Dx(),
+				SourceHeight: img.Bounds().Dy(),
+				JPEG:         jpg,
+			}
+		}
+		encoded <- result
+	}
+}
+
+// pendingGroups возвращает группы, которые ещё не получили кадр новее seq.
+func (s *StreamManager) pendingGroups(seq uint64, groups []StreamOptions) []StreamOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make([]StreamOptions, 0, len(groups))
+	for _, opts := range groups {
+		if group, ok := s.groups[opts]; ok && group.lastSeq < seq {
+			pending = append(pending, opts)
+		}
+	}
+	return pending
+}
+
+// emitLoop раздаёт кадры клиентам по возрастанию номера внутри каждой группы: группа не получает
+// кадр, если уже получила более новый, но другие группы того же кадра это не затрагивает.
+func (s *StreamManager) emitLoop(encoded chan encodedFrame) {
+	for frame := range encoded {
+		emitted := false
+		s.mu.Lock()
+		for opts, out := range frame.frames {
+			group, ok := s.groups[opts]
+			if !ok || group.lastSeq >= frame.seq {
+				continue
+			}
+			group.lastSeq = frame.seq
+			group.lastHash = frame.hash
+			emitted = true
+			for ch := range group.clients {
+				// Не блокируем, если клиент не успевает получать кадры
+				select {
+				case ch <- out:
+				default:
+				}
+			}
+		}
+		s.mu.Unlock()
+		if !emitted {
+			s.stats.observeDrop()
+			continue
+		}
+		s.stats.observeEmit()
+		log.Debugf("frame %d emitted %fs after capture", frame.seq, time.Since(frame.capturedAt).Seconds())
+	}
+}
+
+// StreamStats — статистика конвейера потока экрана. Задержки — скользящие средние в миллисекундах.
+type StreamStats struct {
+	Udid             string  `json:"udid"`
+	Running          bool    `json:"running"`
+	Workers          int     `json:"workers"`
+	Consumers        int     `json:"consumers"`
+	CaptureLatencyMs float64 `json:"captureLatencyMs"`
+	DecodeLatencyMs  float64 `json:"decodeLatencyMs"`
+	EncodeLatencyMs  float64 `json:"encodeLatencyMs"`
+	CaptureFPS       float64 `json:"captureFps"`
+	EmitFPS          float64 `json:"emitFps"`
+	CapturedFrames   uint64  `json:"capturedFrames"`
+	EmittedFrames    uint64  `json:"emittedFrames"`
+	DroppedFrames    uint64  `json:"droppedFrames"`
+	UnchangedFrames  uint64  `json:"unchangedFrames"`
+}
+
+// streamStatsAlpha — вес нового значения в скользящем среднем.
+const streamStatsAlpha = 0.1
+
+// streamStats собирает статистику конвейера; безопасна для использования из всех стадий.
+type streamStats struct {
+	mu        sync.Mutex
+	workers   int
+	capture   float64
+	decode    float64
+	encode    float64
+	captured  rateMeter
+	emitted   rateMeter
+	dropped   uint64
+	unchanged uint64
+	seq       uint64
+}
+
+// reset обнуляет статистику при новом запуске конвейера. Номера кадров не сбрасываются,
+// чтобы кадры предыдущего запуска не обогнали новые.
+func (st *streamStats) reset(workers int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.workers = workers
+	st.capture, st.decode, st.encode = 0, 0, 0
+	st.captured, st.emitted = rateMeter{}, rateMeter{}
+	st.dropped, st.unchanged = 0, 0
+}
+
+func (st *streamStats) nextSeq() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	return st.seq
+}
+
+func ewma(current float64, sample time.Duration) float64 {
+	ms := float64(sample.Microseconds()) / 1000
+	if current == 0 {
+		return ms
+	}
+	return current + streamStatsAlpha*(ms-current)
+}
+
+func (st *streamStats) observeCapture(d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.capture = ewma(st.capture, d)
+	st.captured.tick(time.Now())
+}
+
+func (st *streamStats) observeDecode(d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.decode = ewma(st.decode, d)
+}
+
+func (st *streamStats) observeEncode(d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.encode = ewma(st.encode, d)
+}
+
+func (st *streamStats) observeDrop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.dropped++
+}
+
+func (st *streamStats) observeUnchanged() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.unchanged++
+}
+
+func (st *streamStats) observeEmit() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.emitted.tick(time.Now())
+}
+
+func (st *streamStats) snapshot() StreamStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return StreamStats{
+		Workers:          st.workers,
+		CaptureLatencyMs: st.capture,
+		DecodeLatencyMs:  st.decode,
+		EncodeLatencyMs:  st.encode,
+		CaptureFPS:       st.captured.rate(),
+		EmitFPS:          st.emitted.rate(),
+		CapturedFrames:   st.captured.count,
+		EmittedFrames:    st.emitted.count,
+		DroppedFrames:    st.dropped,
+		UnchangedFrames:  st.unchanged,
+	}
+}
+
+// rateMeter считает частоту событий по последним rateMeterWindow отметкам.
+const rateMeterWindow = 30
+
+type rateMeter struct {
+	count uint64
+	times [rateMeterWindow]time.Time
+}
+
+func (r *rateMeter) tick(now time.Time) {
+	r.times[r.count%rateMeterWindow] = now
+	r.count++
+}
+
+func (r *rateMeter) rate() float64 {
+	n := min(r.count, rateMeterWindow)
+	if n < 2 {
+		return 0
+	}
+	newest := r.times[(r.count-1)%rateMeterWindow]
+	oldest := r.times[(r.count-n)%rateMeterWindow]
+	if time.Since(newest) > 2*time.Second {
+		return 0
+	}
+	elapsed := newest.Sub(oldest).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n-1) / elapsed
+}
+
+// Stats возвращает текущую статистику конвейера.
+func (s *StreamManager) Stats() StreamStats {
+	stats := s.stats.snapshot()
+	s.mu.Lock()
+	stats.Udid = s.device.Properties.SerialNumber
+	stats.Running = s.running
+	stats.Consumers = len(s.consumers) + s.screenshotRequests
+	s.mu.Unlock()
+	return stats
+}
+
+// StreamStatsHandler godoc
+// @Summary      Статистика потока экрана
+// @Description  Возвращает задержки захвата, декодирования и кодирования, фактический fps и число выброшенных кадров
+// @Tags         stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Success      200  {object}  StreamStats
+// @Router       /device/{udid}/screen/stats [get]
+func StreamStatsHandler(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	sm, ok := findStreamManager(device.Properties.SerialNumber)
+	if !ok {
+		c.JSON(http.StatusOK, StreamStats{Udid: device.Properties.SerialNumber})
+		return
+	}
+	c.JSON(http.StatusOK, sm.Stats())
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Типы сообщений клиента в /screenstream/ws.
+const (
+	WSStreamAck    = "ack"
+	WSStreamWindow = "window"
+)
+
+const (
+	maxWSStreamWindow = 30
+	// orientationPollInterval — как часто ориентация перезапрашивается у WDA.
+	orientationPollInterval = 2 * time.Second
+)
+
+// WSFrameHeader — текстовое сообщение, которое предшествует каждому бинарному JPEG-кадру.
+// Skipped — сколько кадров пропущено перед этим, потому что клиент не успевал.
+// Orientation — одно из значений Orientation*. Без сессии WDA она определяется по размерам кадра:
+// portrait или landscapeLeft, так как стороны поворота по кадру не различить.
+type WSFrameHeader struct {
+	Type        string `json:"type"`
+	Seq         uint64 `json:"seq"`
+	CapturedAt  int64  `json:"capturedAt"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Orientation string `json:"orientation"`
+	Size        int    `json:"size"`
+	Skipped     uint64 `json:"skipped"`
+}
+
+// WSStreamCommand — сообщение управления потоком от клиента. ack подтверждает обработку кадра Seq,
+// window задаёт Size — сколько неподтверждённых кадров может быть в пути; 0 отключает подтверждения.
+type WSStreamCommand struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+	Size int    `json:"size"`
+}
+
+// wsStream хранит состояние одного WebSocket-клиента потока. Клиенту всегда отправляется
+// самый свежий кадр: пока предыдущий не отправлен или окно занято, новые кадры заменяют старый.
+type wsStream struct {
+	mu          sync.Mutex
+	pending     *StreamFrame
+	skipped     uint64
+	window      int
+	inFlight    []uint64
+	orientation string
+
+	wake chan struct{}
+}
+
+func (s *wsStream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *wsStream) offer(frame StreamFrame) {
+	s.mu.Lock()
+	if s.pending != nil {
+		s.skipped++
+	}
+	s.pending = &frame
+	s.mu.Unlock()
+	s.signal()
+}
+
+// take возвращает кадр для отправки, если он есть и окно позволяет.
+func (s *wsStream) take() (StreamFrame, WSFrameHeader, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil || (s.window > 0 && len(s.inFlight) >= s.window) {
+		return StreamFrame{}, WSFrameHeader{}, false
+	}
+	frame := *s.pending
+	s.pending = nil
+	orientation := s.orientation
+	if orientation == "" {
+		orientation = OrientationPortrait
+		if frame.Width > frame.Height {
+			orientation = OrientationLandscapeLeft
+		}
+	}
+	header := WSFrameHeader{
+		Type:        "frame",
+		Seq:         frame.Seq,
+		CapturedAt:  frame.CapturedAt.UnixMilli(),
+		Width:       frame.Width,
+		Height:      frame.Height,
+		Orientation: orientation,
+		Size:        len(frame.JPEG),
+		Skipped:     s.skipped,
+	}
+	s.skipped = 0
+	if s.window > 0 {
+		s.inFlight = append(s.inFlight, frame.Seq)
+	}
+	return frame, header, true
+}
+
+// handleCommand применяет сообщение управления потоком.
+func (s *wsStream) handleCommand(cmd WSStreamCommand) {
+	s.mu.Lock()
+	switch cmd.Type {
+	case WSStreamAck:
+		// Подтверждение кадра подтверждает и все отправленные до него.
+		n := 0
+		for n < len(s.inFlight) && s.inFlight[n] <= cmd.Seq {
+			n++
+		}
+		s.inFlight = s.inFlight[n:]
+	case WSStreamWindow:
+		s.window = min(max(cmd.Size, 0), maxWSStreamWindow)
+		if s.window == 0 {
+			s.inFlight = nil
+		}
+	default:
+		log.Debugf("unknown stream command type %q", cmd.Type)
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// pollOrientation обновляет ориентацию из WDA, пока не закроется done.
+func (s *wsStream) pollOrientation(client *wdaClient, done <-chan struct{}) {
+	ticker := time.NewTicker(orientationPollInterval)
+	defer ticker.Stop()
+	for {
+		if orientation, err := client.Orientation(); err == nil {
+			s.mu.Lock()
+			s.orientation = orientation
+			s.mu.Unlock()
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StreamWebSocketHandler godoc
+// @Summary      Поток экрана через WebSocket
+// @Description  Отправляет JPEG-кадры бинарными сообщениями; перед каждым кадром идёт текстовое JSON-сообщение WSFrameHeader с номером, временем захвата, размерами и ориентацией. Медленному клиенту отправляется только самый свежий кадр. Клиент может включить окно подтверждений сообщением {"type":"window","size":N} и подтверждать кадры сообщением {"type":"ack","seq":N}.
+// @Tags         stream
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 10"
+// @Param        quality  query  int  false  "Качество JPEG, 1-100, по умолчанию 80"
+// @Param        maxWidth  query  int  false  "Максимальная ширина кадра"
+// @Param        maxHeight  query  int  false  "Максимальная высота кадра"
+// @Param        grayscale  query  bool  false  "Кадры в оттенках серого"
+// @Param        skipUnchanged  query  bool  false  "Не отправлять неизменившиеся кадры, по умолчанию true"
+// @Param        keepalive  query  string  false  "Максимальный интервал между кадрами при неизменном экране, по умолчанию 2s"
+// @Param        window  query  int  false  "Число неподтверждённых кадров в пути, 0 (по умолчанию) — без подтверждений"
+// @Success      101  {string}  string  "Switching Protocols"
+// @Failure      422  {object}  GenericResponse
+// @Router       /device/{udid}/screenstream/ws [get]
+func StreamWebSocketHandler(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	opts, err := parseStreamOptions(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	stream := &wsStream{wake: make(chan struct{}, 1)}
+	if window := c.Query("window"); window != "" {
+		n, err := strconv.Atoi(window)
+		if err != nil || n < 0 || n > maxWSStreamWindow {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: fmt.Sprintf("window must be an integer between 0 and %d", maxWSStreamWindow)})
+			return
+		}
+		stream.window = n
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.WithField("udid", udid).WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	if client, ok := existingWdaClient(udid); ok {
+		go stream.pollOrientation(client, done)
+	}
+
+	sm := getStreamManager(device)
+	ch := sm.AddClient(opts)
+	defer sm.RemoveClient(ch)
+	frames := make(chan struct{})
+	go func() {
+		defer close(frames)
+		for frame := range ch {
+			stream.offer(frame)
+		}
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var cmd WSStreamCommand
+			if err := conn.ReadJSON(&cmd); err != nil {
+				return
+			}
+			stream.handleCommand(cmd)
+		}
+	}()
+
+	log.WithField("udid", udid).Infof("websocket stream client connected with %+v", opts)
+	for {
+		select {
+		case <-closed:
+			log.WithField("udid", udid).Info("websocket stream client disconnected")
+			return
+		case <-frames:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "device disconnected"), time.Now().Add(time.Second))
+			return
+		case <-stream.wake:
+		}
+		frame, header, ok := stream.take()
+		if !ok {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(MustMarshal(header))); err != nil {
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame.JPEG); err != nil {
+			return
+		}
+	}
+}
@@ -1,94 +1,156 @@
 package api
 
 import (
-	"io"
+	"errors"
 	"net/http"
 
 	"github.com/danielpaulus/go-ios/ios"
 	"github.com/danielpaulus/go-ios/ios/instruments"
 	"github.com/danielpaulus/go-ios/ios/syslog"
 	"github.com/gin-gonic/gin"
-	log "github.com/sirupsen/logrus"
 )
 
+const (
+	syslogFeedHistory = 5000
+	// syslogClientBuffer больше обычного: syslog присылает сообщения пачками.
+	syslogClientBuffer = 2048
+)
+
+// notificationsSource читает уведомления об изменении состояния приложений через instruments.
+func notificationsSource(device ios.DeviceEntry) feedSource {
+	return func(stop <-chan struct{}, ready func(), publish func(event string, data string)) error {
+		receive, closeFunc, err := instruments.ListenAppStateNotifications(device)
+		if err != nil {
+			return err
+		}
+		ready()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stop:
+				closeFunc()
+			case <-done:
+			}
+		}()
+		for {
+			notification, err := receive()
+			if err != nil {
+				return err
+			}
+			publish("notification", MustMarshal(notification))
+		}
+	}
+}
+
+// syslogSource читает сообщения syslog устройства.
+func syslogSource(device ios.DeviceEntry) feedSource {
+	return func(stop <-chan struct{}, ready func(), publish func(event string, data string)) error {
+		syslogConnection, err := syslog.New(device)
+		if err != nil {
+			return err
+		}
+		ready()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stop:
+			case <-done:
+			}
+			syslogConnection.Close()
+		}()
+		for {
+			m, err := syslogConnection.ReadLogMessage()
+			if err != nil {
+				return err
+			}
+			publish("log", MustMarshal(m))
+		}
+	}
+}
+
+// listenSource ждёт закрытия stop: события в поток "listen" публикует наблюдатель устройств
+// (device_watcher.go) из своей подписки usbmuxd, чтобы клиенты не открывали собственные.
+func listenSource(stop <-chan struct{}, ready func(), publish func(event string, data string)) error {
+	ready()
+	<-stop
+	return nil
+}
+
 // Уведомления используют instruments для получения событий изменения состояния приложений.
-// События будут передаваться как JSON-объекты, разделённые переносами строк, до возникновения ошибки.
+// События передаются как SSE с event: notification, а с ?format=ndjson — JSON-объектами построчно.
 // Listen                godoc
 // @Summary      Использует instruments для получения событий изменения состояния приложений
-// @Description Использует instruments для получения событий изменения состояния приложений
+// @Description Использует instruments для получения событий изменения состояния приложений. Поток SSE с id, event и data; с заголовком Last-Event-ID пропущенные события отправляются из истории устройства. Если instruments не удалось запустить, возвращается 500 с ошибкой.
 // @Tags         general
 // @Produce      json
+// @Param        bundleID  query  string  false  "bundleID приложения, несколько через запятую"
+// @Param        state  query  string  false  "Состояние, например foreground, background, suspended, terminated; несколько через запятую"
+// @Param        format  query  string  false  "sse (по умолчанию) или ndjson"
+// @Param        lastEventId  query  int  false  "Номер последнего полученного события, если нельзя передать Last-Event-ID"
 // @Success      200  {object}  map[string]interface{}
+// @Failure      500  {object}  GenericResponse
 // @Router       /notifications [get]
 func Notifications(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	listenerFunc, closeFunc, err := instruments.ListenAppStateNotifications(device)
-	if err != nil {
-		log.Fatal(err)
-	}
-	c.Stream(func(w io.Writer) bool {
-
-		notification, err := listenerFunc()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, err)
-			closeFunc()
-			return false
-		}
-
-		_, err = w.Write([]byte(MustMarshal(notification)))
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, err)
-			closeFunc()
-			return false
-		}
-		w.Write([]byte("\n"))
-		return true
-	})
-
+	filter := parseAppStateFilter(c)
+	feed := getEventFeed("notifications", device.Properties.SerialNumber, defaultFeedHistory, defaultFeedClientBuffer)
+	serveFeed(c, feed, notificationsSource(device), filter.accept)
 }
 
 // Syslog
 // Listen                godoc
-// @Summary      Использует SSE для подключения к команде LISTEN
-// @Description Использует SSE для подключения к команде LISTEN
+// @Summary      Поток syslog устройства
+// @Description Поток SSE с event: log, в data — сообщение syslog строкой JSON. Одно подключение к syslog устройства используется всеми клиентами; когда устройство отключается, поток завершается событием error; с заголовком Last-Event-ID пропущенные сообщения отправляются из истории. Фильтры применяются на peer: несколько значений одного параметра передаются через запятую.
 // @Tags         general
 // @Produce      json
+// @Param        process  query  string  false  "Имя процесса"
+// @Param        pid  query  int  false  "PID процесса"
+// @Param        subsystem  query  string  false  "Подсистема — библиотека в скобках после имени процесса"
+// @Param        level  query  string  false  "Уровень: Debug, Info, Notice, Warning, Error"
+// @Param        message  query  string  false  "Регулярное выражение для текста сообщения"
+// @Param        bundleID  query  string  false  "Показывать только процесс приложения с этим bundleID"
+// @Param        format  query  string  false  "sse (по умолчанию) или ndjson"
+// @Param        lastEventId  query  int  false  "Номер последнего полученного события, если нельзя передать Last-Event-ID"
 // @Success      200  {object}  map[string]interface{}
-// @Router       /listen [get]
+// @Router       /syslog [get]
 func Syslog(c *gin.Context) {
-	// We are streaming current time to clients in the interval 10 seconds
-	log.Info("connect")
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	syslogConnection, err := syslog.New(device)
+	filter, err := parseSyslogFilter(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
+		feedErrorResponse(c, http.StatusUnprocessableEntity, err)
 		return
 	}
-	c.Stream(func(w io.Writer) bool {
-		m, _ := syslogConnection.ReadLogMessage()
-		// Stream message to client from message channel
-		w.Write([]byte(MustMarshal(m)))
-		return true
-	})
+	if bundleID := c.Query("bundleID"); bundleID != "" {
+		app, err := findInstalledApp(device, bundleID)
+		if err != nil {
+			feedErrorResponse(c, http.StatusInternalServerError, err)
+			return
+		}
+		if app == nil || app.CFBundleExecutable() == "" {
+			feedErrorResponse(c, http.StatusNotFound, errors.New(bundleID+" is not installed"))
+			return
+		}
+		filter.Processes = append(filter.Processes, app.CFBundleExecutable())
+	}
+	feed := getEventFeed("syslog", device.Properties.SerialNumber, syslogFeedHistory, syslogClientBuffer)
+	serveFeed(c, feed, syslogSource(device), filter.accept)
 }
 
 // Listen отправляет события с сервера (SSE), когда устройства подключаются или отключаются
 // Listen                godoc
 // @Summary      Использует SSE для подключения к команде LISTEN
-// @Description Использует SSE для подключения к команде LISTEN
+// @Description Использует SSE для подключения к команде LISTEN. События приходят с event: device: сначала Attached для каждого подключённого устройства, затем изменения. С заголовком Last-Event-ID вместо списка устройств отправляются пропущенные события из истории.
 // @Tags         general
 // @Produce      json
+// @Param        format  query  string  false  "sse (по умолчанию) или ndjson"
+// @Param        lastEventId  query  int  false  "Номер последнего полученного события, если нельзя передать Last-Event-ID"
 // @Success      200  {object}  map[string]interface{}
 // @Router       /listen [get]
 func Listen(c *gin.Context) {
-	// We are streaming current time to clients in the interval 10 seconds
-	log.Info("connect")
-	a, _, _ := ios.Listen()
-	c.Stream(func(w io.Writer) bool {
-		l, _ := a()
-		// Stream message to client from message channel
-		w.Write([]byte(MustMarshal(l)))
-		return true
+	feed := getEventFeed("listen", "", defaultFeedHistory, defaultFeedClientBuffer)
+	serveFeedWith(c, feed, nil, func(lastID uint64, resume bool) ([]feedEvent, *feedSubscription) {
+		return subscribeListen(feed, lastID, resume)
 	})
 }
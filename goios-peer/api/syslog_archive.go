@@ -0,0 +1,445 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSyslogArchiveFileSize = 16 << 20
+	defaultSyslogArchiveMaxFiles = 64
+	// syslogArchiveFlushInterval — как часто архив сбрасывает сжатые данные на диск,
+	// чтобы поиск видел свежие сообщения в файле, который ещё пишется.
+	syslogArchiveFlushInterval = time.Second
+	defaultSyslogArchiveWindow = time.Hour
+
+	syslogArchivePrefix = "syslog-"
+	syslogArchiveSuffix = ".ndjson.gz"
+	// syslogArchiveTimeLayout задаёт время начала файла в имени; имена сортируются по времени.
+	syslogArchiveTimeLayout = "20060102T150405.000Z"
+)
+
+// SyslogArchiveLine — сообщение syslog в архиве со временем получения на peer.
+type SyslogArchiveLine struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// syslogArchiveEnabled сообщает, включена ли запись архива переменной SYSLOG_ARCHIVE=true.
+func syslogArchiveEnabled() bool {
+	return os.Getenv("SYSLOG_ARCHIVE") == "true"
+}
+
+// syslogArchiveFolder возвращает каталог архива устройства из SYSLOG_ARCHIVE_FOLDER.
+func syslogArchiveFolder(udid string) string {
+	folder := os.Getenv("SYSLOG_ARCHIVE_FOLDER")
+	if folder == "" {
+		folder = path.Join(os.TempDir(), "goios-syslog")
+	}
+	return path.Join(folder, udid)
+}
+
+// isPathSegment сообщает, можно ли использовать name как один элемент пути: UDID из URL
+// подставляется в путь к каталогу архива.
+func isPathSegment(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// syslogArchiveLimits читает размер файла в МБ до сжатия (SYSLOG_ARCHIVE_FILE_SIZE_MB)
+// и число хранимых файлов устройства (SYSLOG_ARCHIVE_MAX_FILES).
+func syslogArchiveLimits() (int64, int) {
+	fileSize := int64(defaultSyslogArchiveFileSize)
+	if n, err := strconv.Atoi(os.Getenv("SYSLOG_ARCHIVE_FILE_SIZE_MB")); err == nil && n > 0 {
+		fileSize = int64(n) << 20
+	}
+	maxFiles := defaultSyslogArchiveMaxFiles
+	if n, err := strconv.Atoi(os.Getenv("SYSLOG_ARCHIVE_MAX_FILES")); err == nil && n > 0 {
+		maxFiles = n
+	}
+	return fileSize, maxFiles
+}
+
+// syslogArchiver записывает syslog одного устройства в сжатые файлы, пока устройство подключено.
+// Он подписан на общий поток syslog, поэтому не открывает второе подключение к устройству,
+// а поток работает и без клиентов /syslog.
+type syslogArchiver struct {
+	udid     string
+	folder   string
+	fileSize int64
+	maxFiles int
+
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	written int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	syslogArchiversMu sync.Mutex
+	syslogArchivers   = make(map[string]*syslogArchiver)
+)
+
+func init() {
+	onDeviceAttached(startSyslogArchive)
+	onDeviceDetached(stopSyslogArchive)
+}
+
+// startSyslogArchive начинает запись архива устройства, если архив включён и ещё не пишется.
+func startSyslogArchive(udid string) {
+	if !syslogArchiveEnabled() {
+		return
+	}
+	syslogArchiversMu.Lock()
+	defer syslogArchiversMu.Unlock()
+	if _, ok := syslogArchivers[udid]; ok {
+		return
+	}
+	fileSize, maxFiles := syslogArchiveLimits()
+	a := &syslogArchiver{
+		udid:     udid,
+		folder:   syslogArchiveFolder(udid),
+		fileSize: fileSize,
+		maxFiles: maxFiles,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	syslogArchivers[udid] = a
+	go a.run()
+	log.WithField("udid", udid).Infof("syslog archive started in %s", a.folder)
+}
+
+// stopSyslogArchive останавливает запись и закрывает текущий файл. Файлы остаются на диске.
+func stopSyslogArchive(udid string) {
+	syslogArchiversMu.Lock()
+	a, ok := syslogArchivers[udid]
+	delete(syslogArchivers, udid)
+	syslogArchiversMu.Unlock()
+	if !ok {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	log.WithField("udid", udid).Info("syslog archive stopped")
+}
+
+// run записывает общий поток syslog устройства и раз в syslogArchiveFlushInterval
+// сбрасывает сжатые данные на диск.
+func (a *syslogArchiver) run() {
+	defer close(a.done)
+	defer a.closeFile()
+	go func() {
+		flush := time.NewTicker(syslogArchiveFlushInterval)
+		defer flush.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-flush.C:
+				a.flush()
+			}
+		}
+	}()
+	followDeviceFeed(a.udid, "syslog", syslogFeedHistory, syslogClientBuffer, syslogSource, a.stop, a.write)
+}
+
+// write добавляет сообщение в текущий файл и начинает новый, когда файл достиг fileSize.
+func (a *syslogArchiver) write(e feedEvent) {
+	if e.Event != "log" {
+		return
+	}
+	var raw string
+	if err := json.Unmarshal([]byte(e.Data), &raw); err != nil {
+		return
+	}
+	line := MustMarshal(SyslogArchiveLine{Time: e.At.UTC(), Message: strings.TrimRight(raw, "\x00\n")}) + "\n"
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.gz != nil && a.written >= a.fileSize {
+		a.closeFileLocked()
+	}
+	if a.gz == nil {
+		if err := a.openFileLocked(e.At); err != nil {
+			log.WithField("udid", a.udid).WithError(err).Error("failed to open syslog archive file")
+			return
+		}
+	}
+	n, err := a.gz.Write([]byte(line))
+	a.written += int64(n)
+	if err != nil {
+		log.WithField("udid", a.udid).WithError(err).Error("failed to write syslog archive")
+		a.closeFileLocked()
+	}
+}
+
+func (a *syslogArchiver) openFileLocked(start time.Time) error {
+	if err := os.MkdirAll(a.folder, 0o755); err != nil {
+		return err
+	}
+	name := syslogArchivePrefix + start.UTC().Format(syslogArchiveTimeLayout) + syslogArchiveSuffix
+	file, err := os.OpenFile(path.Join(a.folder, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	a.gz = gzip.NewWriter(file)
+	a.written = 0
+	a.pruneLocked()
+	return nil
+}
+
+func (a *syslogArchiver) closeFileLocked() {
+	if a.gz == nil {
+		return
+	}
+	if err := a.gz.Close(); err != nil {
+		log.WithField("udid", a.udid).WithError(err).Warn("failed to close syslog archive")
+	}
+	a.file.Close()
+	a.gz = nil
+	a.file = nil
+}
+
+func (a *syslogArchiver) closeFile() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closeFileLocked()
+}
+
+func (a *syslogArchiver) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.gz != nil {
+		a.gz.Flush()
+	}
+}
+
+// pruneLocked удаляет самые старые файлы, если их больше maxFiles.
+func (a *syslogArchiver) pruneLocked() {
+	files, err := listSyslogArchive(a.folder)
+	if err != nil {
+		return
+	}
+	for len(files) > a.maxFiles {
+		if err := os.Remove(files[0].path); err != nil {
+			log.WithField("udid", a.udid).WithError(err).Warn("failed to remove old syslog archive")
+		}
+		files = files[1:]
+	}
+}
+
+// syslogArchiveFile — файл архива; в нём сообщения с start до начала следующего файла.
+type syslogArchiveFile struct {
+	path  string
+	start time.Time
+}
+
+// listSyslogArchive возвращает файлы архива из folder от старых к новым.
+func listSyslogArchive(folder string) ([]syslogArchiveFile, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []syslogArchiveFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, syslogArchivePrefix) || !strings.HasSuffix(name, syslogArchiveSuffix) {
+			continue
+		}
+		start, err := time.ParseInLocation(syslogArchiveTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, syslogArchivePrefix), syslogArchiveSuffix), time.UTC)
+		if err != nil {
+			continue
+		}
+		files = append(files, syslogArchiveFile{path: path.Join(folder, name), start: start})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start.Before(files[j].start) })
+	return files, nil
+}
+
+// searchSyslogArchive передаёт в emit сообщения архива за [from, to], подходящие под filter и query.
+// Файл, который ещё пишется, читается до последнего сброса на диск.
+func searchSyslogArchive(folder string, from, to time.Time, filter SyslogFilter, query *regexp.Regexp, emit func(SyslogArchiveLine) error) error {
+	files, err := listSyslogArchive(folder)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		if f.start.After(to) {
+			break
+		}
+		if i+1 < len(files) && files[i+1].start.Before(from) {
+			continue
+		}
+		if err := searchSyslogArchiveFile(f.path, from, to, filter, query, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchSyslogArchiveFile(name string, from, to time.Time, filter SyslogFilter, query *regexp.Regexp, emit func(SyslogArchiveLine) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		// Пустой файл: архив ещё не сбросил в него данные.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", path.Base(name), err)
+	}
+	defer gz.Close()
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		var line SyslogArchiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if line.Time.Before(from) {
+			continue
+		}
+		if line.Time.After(to) {
+			return nil
+		}
+		if !filter.match(line.Message) || (query != nil && !query.MatchString(line.Message)) {
+			continue
+		}
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+	// Конец файла, который ещё пишется, обрывается посреди сжатого блока.
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: %w", path.Base(name), err)
+	}
+	return nil
+}
+
+// SyslogArchive godoc
+// @Summary      Поиск в архиве syslog
+// @Description  Возвращает сообщения из архива syslog устройства за период from–to. Архив пишется непрерывно, пока устройство подключено, при SYSLOG_ARCHIVE=true в SYSLOG_ARCHIVE_FOLDER; файлы сжимаются и сменяются по размеру SYSLOG_ARCHIVE_FILE_SIZE_MB, хранятся последние SYSLOG_ARCHIVE_MAX_FILES. Архив доступен и для отключённых устройств. Поддерживаются те же фильтры, что и в /syslog. По умолчанию отдаются строки "время сообщение", с format=ndjson — SyslogArchiveLine построчно.
+// @Tags         general
+// @Produce      plain
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        from  query  string  false  "Начало: RFC3339, unix-миллисекунды или отрицательная длительность, по умолчанию -1h"
+// @Param        to  query  string  false  "Конец в том же формате, по умолчанию сейчас"
+// @Param        q  query  string  false  "Регулярное выражение для всей строки сообщения"
+// @Param        process  query  string  false  "Имя процесса"
+// @Param        pid  query  int  false  "PID процесса"
+// @Param        subsystem  query  string  false  "Подсистема"
+// @Param        level  query  string  false  "Уровень"
+// @Param        message  query  string  false  "Регулярное выражение для текста сообщения"
+// @Param        format  query  string  false  "text (по умолчанию) или ndjson"
+// @Param        download  query  bool  false  "Отдать как файл"
+// @Success      200  {object}  SyslogArchiveLine
+// @Failure      404  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Router       /device/{udid}/syslog/archive [get]
+func SyslogArchive(c *gin.Context) {
+	udid := c.Param("udid")
+	if !isPathSegment(udid) {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "udid is not a valid device identifier"})
+		return
+	}
+	folder := syslogArchiveFolder(udid)
+	if !syslogArchiveEnabled() {
+		if files, _ := listSyslogArchive(folder); len(files) == 0 {
+			c.JSON(http.StatusNotFound, GenericResponse{Error: "syslog archive is disabled, set SYSLOG_ARCHIVE=true"})
+			return
+		}
+	}
+
+	to := time.Now()
+	from := to.Add(-defaultSyslogArchiveWindow)
+	for _, p := range []struct {
+		name   string
+		target *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeQuery(value)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: p.name + ": " + err.Error()})
+			return
+		}
+		*p.target = t
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "to must not be before from"})
+		return
+	}
+	filter, err := parseSyslogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	var query *regexp.Regexp
+	if q := c.Query("q"); q != "" {
+		query, err = regexp.Compile(q)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "q is not a valid regular expression: " + err.Error()})
+			return
+		}
+	}
+	format := c.DefaultQuery("format", "text")
+	if format != "text" && format != StreamFormatNDJSON {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "format must be text or ndjson"})
+		return
+	}
+
+	extension := "log"
+	if format == StreamFormatNDJSON {
+		extension = "ndjson"
+		c.Header("Content-Type", "application/x-ndjson")
+	} else {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+	}
+	if c.Query("download") == "true" {
+		filename := fmt.Sprintf("syslog-%s-%s-%s.%s", udid, from.UTC().Format(syslogArchiveTimeLayout), to.UTC().Format(syslogArchiveTimeLayout), extension)
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(c.Writer)
+	err = searchSyslogArchive(folder, from, to, filter, query, func(line SyslogArchiveLine) error {
+		var err error
+		if format == StreamFormatNDJSON {
+			_, err = w.WriteString(MustMarshal(line) + "\n")
+		} else {
+			_, err = w.WriteString(line.Time.Format(time.RFC3339Nano) + " " + line.Message + "\n")
+		}
+		return err
+	})
+	if err != nil {
+		// Заголовки уже отправлены, поэтому ошибка только записывается в лог.
+		log.WithField("udid", udid).WithError(err).Warn("failed reading syslog archive")
+	}
+	w.Flush()
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// syslogLinePattern разбирает строку syslog iOS вида
+// "Oct 18 15:04:05 iPhone SpringBoard(UIKitCore)[58] <Notice>: message".
+// В скобках после имени процесса — библиотека, из которой пришло сообщение; она считается подсистемой.
+var syslogLinePattern = regexp.MustCompile(`^(?s)[A-Z][a-z]{2}\s+\d{1,2} \d{2}:\d{2}:\d{2} \S+ ([^\[(]+)(?:\(([^)]*)\))?\[(\d+)\] <(\w+)>: (.*)$`)
+
+// syslogLine — разобранное сообщение syslog.
+type syslogLine struct {
+	Process   string
+	Subsystem string
+	PID       int
+	Level     string
+	Message   string
+}
+
+func parseSyslogLine(raw string) (syslogLine, bool) {
+	match := syslogLinePattern.FindStringSubmatch(strings.TrimRight(raw, "\x00\n"))
+	if match == nil {
+		return syslogLine{}, false
+	}
+	pid, _ := strconv.Atoi(match[3])
+	return syslogLine{
+		Process:   strings.TrimSpace(match[1]),
+		Subsystem: match[2],
+		PID:       pid,
+		Level:     match[4],
+		Message:   match[5],
+	}, true
+}
+
+// SyslogFilter отбирает сообщения syslog на стороне peer. Несколько значений одного параметра
+// объединяются через ИЛИ, разные параметры — через И. Пустой фильтр пропускает всё.
+type SyslogFilter struct {
+	Processes  []string
+	PID        int
+	Subsystems []string
+	Levels     []string
+	Message    *regexp.Regexp
+}
+
+// queryList читает значения параметра, переданные несколько раз или через запятую.
+func queryList(c *gin.Context, name string) []string {
+	var values []string
+	for _, value := range c.QueryArray(name) {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// parseSyslogFilter читает фильтр из query: process, pid, subsystem, level и message (регулярное выражение).
+func parseSyslogFilter(c *gin.Context) (SyslogFilter, error) {
+	filter := SyslogFilter{
+		Processes:  queryList(c, "process"),
+		Subsystems: queryList(c, "subsystem"),
+		Levels:     queryList(c, "level"),
+	}
+	if pid := c.Query("pid"); pid != "" {
+		n, err := strconv.Atoi(pid)
+		if err != nil || n <= 0 {
+			return filter, fmt.Errorf("pid must be a positive integer")
+		}
+		filter.PID = n
+	}
+	if message := c.Query("message"); message != "" {
+		pattern, err := regexp.Compile(message)
+		if err != nil {
+			return filter, fmt.Errorf("message is not a valid regular expression: %w", err)
+		}
+		filter.Message = pattern
+	}
+	return filter, nil
+}
+
+func (f SyslogFilter) empty() bool {
+	return len(f.Processes) == 0 && f.PID == 0 && len(f.Subsystems) == 0 && len(f.Levels) == 0 && f.Message == nil
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, value) })
+}
+
+// match сообщает, подходит ли сообщение под фильтр. Сообщения, которые не удалось разобрать,
+// проходят только через пустой фильтр.
+func (f SyslogFilter) match(raw string) bool {
+	if f.empty() {
+		return true
+	}
+	line, ok := parseSyslogLine(raw)
+	if !ok {
+		return false
+	}
+	if len(f.Processes) > 0 && !containsFold(f.Processes, line.Process) {
+		return false
+	}
+	if f.PID != 0 && f.PID != line.PID {
+		return false
+	}
+	if len(f.Subsystems) > 0 && !containsFold(f.Subsystems, line.Subsystem) {
+		return false
+	}
+	if len(f.Levels) > 0 && !containsFold(f.Levels, line.Level) {
+		return false
+	}
+	return f.Message == nil || f.Message.MatchString(line.Message)
+}
+
+// accept применяет фильтр к событию потока syslog. Служебные события, например error, проходят всегда.
+func (f SyslogFilter) accept(e feedEvent) bool {
+	if e.Event != "log" || f.empty() {
+		return true
+	}
+	var raw string
+	if err := json.Unmarshal([]byte(e.Data), &raw); err != nil {
+		return false
+	}
+	return f.match(raw)
+}
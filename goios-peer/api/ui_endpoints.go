@@ -0,0 +1,351 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultUIWaitTimeout  = 10 * time.Second
+	defaultUIWaitInterval = 500 * time.Millisecond
+	// maxWaitTimeout и minWaitInterval ограничивают ожидания wait-for и wait-match:
+	// каждый опрос нагружает WDA или снимает полный скриншот.
+	maxWaitTimeout  = 5 * time.Minute
+	minWaitInterval = 100 * time.Millisecond
+)
+
+// UIFrame — рамка элемента. В ответах API задаётся в пикселях скриншота.
+type UIFrame struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// UIElement — элемент дерева доступности, полученного из WDA /source.
+type UIElement struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name,omitempty"`
+	Label      string            `json:"label,omitempty"`
+	Value      string            `json:"value,omitempty"`
+	Enabled    bool              `json:"enabled"`
+	Visible    bool              `json:"visible"`
+	Frame      UIFrame           `json:"frame"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Children   []*UIElement      `json:"children,omitempty"`
+}
+
+// UITreeResponse содержит либо всё дерево (Root), либо найденные по запросу элементы (Matches).
+// Scale — число пикселей скриншота в одной точке экрана.
+type UITreeResponse struct {
+	Scale   float64      `json:"scale"`
+	Root    *UIElement   `json:"root,omitempty"`
+	Matches []*UIElement `json:"matches,omitempty"`
+}
+
+// uiQuery описывает запрос элементов: XPath выполняется локально по дереву, predicate — средствами WDA.
+type uiQuery struct {
+	xpath     string
+	predicate string
+	expr      *xpath.Expr
+}
+
+// parseUIQuery читает xpath и predicate и заранее компилирует XPath, чтобы ошибка
+// в запросе возвращалась как 422, а не как ошибка устройства.
+func parseUIQuery(c *gin.Context) (uiQuery, error) {
+	query := uiQuery{xpath: c.Query("xpath"), predicate: c.Query("predicate")}
+	if query.xpath == "" {
+		return query, nil
+	}
+	expr, err := xpath.Compile(query.xpath)
+	if err != nil {
+		return query, fmt.Errorf("invalid xpath: %w", err)
+	}
+	query.expr = expr
+	return query, nil
+}
+
+func (q uiQuery) empty() bool {
+	return q.xpath == "" && q.predicate == ""
+}
+
+// uiQueryErrorStatus возвращает 422 для predicate, который WDA не смог разобрать, и 500 для остальных ошибок.
+func uiQueryErrorStatus(err error) int {
+	if isWdaInvalidSelector(err) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// uiElementFromNode переводит XML-узел WDA в UIElement, пересчитывая рамку в пиксели.
+func uiElementFromNode(node *xmlquery.Node, scale float64, withChildren bool) *UIElement {
+	element := &UIElement{
+		Type:       node.Data,
+		Attributes: make(map[string]string),
+	}
+	for _, attr := range node.Attr {
+		value := attr.Value
+		switch attr.Name.Local {
+		case "type":
+			element.Type = value
+		case "name":
+			element.Name = value
+		case "label":
+			element.Label = value
+		case "value":
+			element.Value = value
+		case "enabled":
+			element.Enabled = value == "true"
+		case "visible":
+			element.Visible = value == "true"
+		case "x":
+			element.Frame.X = parseUIFloat(value) * scale
+		case "y":
+			element.Frame.Y = parseUIFloat(value) * scale
+		case "width":
+			element.Frame.Width = parseUIFloat(value) * scale
+		case "height":
+			element.Frame.Height = parseUIFloat(value) * scale
+		default:
+			element.Attributes[attr.Name.Local] = value
+		}
+	}
+	if len(element.Attributes) == 0 {
+		element.Attributes = nil
+	}
+	if withChildren {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == xmlquery.ElementNode {
+				element.Children = append(element.Children, uiElementFromNode(child, scale, true))
+			}
+		}
+	}
+	return element
+}
+
+func parseUIFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
+
+// fetchUITree забирает /source у WDA и разбирает его; возвращает корневой элемент XML.
+func fetchUITree(client *wdaClient) (*xmlquery.Node, error) {
+	source, err := client.Source()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := xmlquery.Parse(strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	for node := doc.FirstChild; node != nil; node = node.NextSibling {
+		if node.Type == xmlquery.ElementNode {
+			return node, nil
+		}
+	}
+	return doc, nil
+}
+
+// queryUI выполняет запрос и возвращает найденные элементы без дочерних.
+func queryUI(client *wdaClient, query uiQuery, scale float64) ([]*UIElement, error) {
+	if query.xpath != "" {
+		root, err := fetchUITree(client)
+		if err != nil {
+			return nil, err
+		}
+		nodes := xmlquery.QuerySelectorAll(root, query.expr)
+		matches := make([]*UIElement, 0, len(nodes))
+		for _, node := range nodes {
+			if node.Type == xmlquery.ElementNode {
+				matches = append(matches, uiElementFromNode(node, scale, false))
+			}
+		}
+		return matches, nil
+	}
+
+	found, err := client.FindElementsWithAttributes("predicate string", query.predicate)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*UIElement, 0, len(found))
+	for _, info := range found {
+		matches = append(matches, wdaElement(info, scale))
+	}
+	return matches, nil
+}
+
+// wdaElement переводит элемент из ответа WDA в UIElement, пересчитывая рамку в пиксели.
+func wdaElement(info wdaElementInfo, scale float64) *UIElement {
+	return &UIElement{
+		Type:    info.Type,
+		Name:    wdaAttributeString(info.Name),
+		Label:   wdaAttributeString(info.Label),
+		Value:   wdaAttributeString(info.Value),
+		Enabled: info.Enabled,
+		Visible: info.Displayed,
+		Frame: UIFrame{
+			X:      info.Rect.X * scale,
+			Y:      info.Rect.Y * scale,
+			Width:  info.Rect.Width * scale,
+			Height: info.Rect.Height * scale,
+		},
+	}
+}
+
+// wdaAttributeString возвращает атрибут строкой; null становится пустой строкой.
+func wdaAttributeString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// @Summary      Дерево элементов экрана
+// @Description  Получает /source из WDA и возвращает дерево элементов с рамками в пикселях скриншота. С параметром xpath или predicate возвращает только найденные элементы.
+// @Tags         ui
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        xpath query string false "XPath-запрос по дереву, например //XCUIElementTypeButton[@name='OK']"
+// @Param        predicate query string false "NSPredicate-запрос, выполняется в WDA, например label == 'OK'"
+// @Success      200  {object}  UITreeResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/ui/tree [get]
+func UITree(c *gin.Context) {
+	query, err := parseUIQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	scale, err := client.screenScale()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	if query.empty() {
+		root, err := fetchUITree(client)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, UITreeResponse{Scale: scale, Root: uiElementFromNode(root, scale, true)})
+		return
+	}
+
+	matches, err := queryUI(client, query, scale)
+	if err != nil {
+		c.JSON(uiQueryErrorStatus(err), GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, UITreeResponse{Scale: scale, Matches: matches})
+}
+
+// @Summary      Ожидание элемента
+// @Description  Опрашивает экран, пока по запросу xpath или predicate не найдётся хотя бы один элемент, или пока не истечёт timeout. Если элемент не появился, возвращает 504.
+// @Tags         ui
+// @Produce      json
+// @Param        udid path string true "UDID устройства"
+// @Param        xpath query string false "XPath-запрос по дереву"
+// @Param        predicate query string false "NSPredicate-запрос"
+// @Param        timeout query string false "Время ожидания, по умолчанию 10s, не больше 5m"
+// @Param        interval query string false "Интервал опроса, по умолчанию 500ms, от 100ms до timeout"
+// @Success      200  {object}  UITreeResponse
+// @Failure      504  {object}  GenericResponse
+// @Failure      409  {object}  GenericResponse
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/ui/wait-for [get]
+func UIWaitFor(c *gin.Context) {
+	query, err := parseUIQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if query.empty() {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "xpath or predicate query param is missing"})
+		return
+	}
+	timeout, interval, err := waitDurations(c, defaultUIWaitTimeout, defaultUIWaitInterval)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	client := inputClient(c)
+	if client == nil {
+		return
+	}
+	scale, err := client.screenScale()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		matches, err := queryUI(client, query, scale)
+		if err != nil {
+			c.JSON(uiQueryErrorStatus(err), GenericResponse{Error: err.Error()})
+			return
+		}
+		if len(matches) > 0 {
+			c.JSON(http.StatusOK, UITreeResponse{Scale: scale, Matches: matches})
+			return
+		}
+		if time.Now().Add(interval).After(deadline) {
+			c.JSON(http.StatusGatewayTimeout, GenericResponse{Error: "element did not appear within " + timeout.String()})
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// durationQuery читает query-параметр в формате time.ParseDuration.
+func durationQuery(c *gin.Context, name string, fallback time.Duration) (time.Duration, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return d, nil
+}
+
+// waitDurations читает timeout и interval ожидания: timeout от 0 до maxWaitTimeout,
+// interval от minWaitInterval до timeout.
+func waitDurations(c *gin.Context, defaultTimeout time.Duration, defaultInterval time.Duration) (time.Duration, time.Duration, error) {
+	timeout, err := durationQuery(c, "timeout", defaultTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	if timeout <= 0 || timeout > maxWaitTimeout {
+		return 0, 0, fmt.Errorf("timeout must be a positive duration up to %s", maxWaitTimeout)
+	}
+	interval, err := durationQuery(c, "interval", min(defaultInterval, timeout))
+	if err != nil {
+		return 0, 0, err
+	}
+	if interval < minWaitInterval || interval > timeout {
+		return 0, 0, fmt.Errorf("interval must be between %s and timeout", minWaitInterval)
+	}
+	return timeout, interval, nil
+}
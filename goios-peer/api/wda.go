@@ -2,10 +2,16 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/danielpaulus/go-ios/ios"
 	"github.com/danielpaulus/go-ios/ios/forward"
@@ -28,11 +34,54 @@ type WdaSessionKey struct {
 	sessionID string
 }
 
+// WdaSessionState описывает текущее состояние сессии WDA.
+type WdaSessionState string
+
+const (
+	WdaSessionStarting WdaSessionState = "starting"
+	WdaSessionRunning  WdaSessionState = "running"
+	WdaSessionStopping WdaSessionState = "stopping"
+	// WdaSessionStopped не хранится в сессии: сессия в этот момент удаляется. Состояние
+	// передаётся только в событиях wda.session.
+	WdaSessionStopped WdaSessionState = "stopped"
+)
+
+// WdaSessionEvent — изменение состояния сессии WDA в событиях wda.session.
+type WdaSessionEvent struct {
+	SessionId string          `json:"sessionId"`
+	Udid      string          `json:"udid"`
+	State     WdaSessionState `json:"state"`
+}
+
+func notifyWdaSessionState(key WdaSessionKey, state WdaSessionState) {
+	publishEvent(EventWdaSession, key.udid, WdaSessionEvent{SessionId: key.sessionID, Udid: key.udid, State: state})
+}
+
+// errWdaForward возвращается, когда не удалось пробросить порт WDA на хост.
+var errWdaForward = errors.New("failed to forward WDA port")
+
+// wdaServerURLMarker печатается WebDriverAgent, когда его HTTP-сервер готов принимать запросы.
+const wdaServerURLMarker = "ServerURLHere->"
+
 type WdaSession struct {
-	Config    WdaConfig `json:"config" binding:"required"`
-	SessionId string    `json:"sessionId" binding:"required"`
-	Udid      string    `json:"udid" binding:"required"`
-	stopWda   context.CancelFunc
+	Config    WdaConfig       `json:"config" binding:"required"`
+	SessionId string          `json:"sessionId" binding:"required"`
+	Udid      string          `json:"udid" binding:"required"`
+	State     WdaSessionState `json:"state"`
+	StartedAt time.Time       `json:"startedAt"`
+	// WdaPort и MjpegPort — порты WDA на устройстве, HostWdaPort и HostMjpegPort — свободные
+	// порты хоста, выделенные под сессию, чтобы WDA нескольких устройств не делили один порт.
+	WdaPort       uint16 `json:"wdaPort"`
+	MjpegPort     uint16 `json:"mjpegPort"`
+	HostWdaPort   uint16 `json:"hostWdaPort"`
+	HostMjpegPort uint16 `json:"hostMjpegPort"`
+	stopWda       context.CancelFunc
+}
+
+// WdaSessionSummary — сессия WDA вместе со временем её работы, используется в списке сессий.
+type WdaSessionSummary struct {
+	WdaSession
+	Uptime string `json:"uptime"`
 }
 
 func (session *WdaSession) Write(p []byte) (n int, err error) {
@@ -41,10 +90,57 @@ func (session *WdaSession) Write(p []byte) (n int, err error) {
 		WithField("sessionId", session.SessionId).
 		Debugf("WDA_LOG %s", p)
 
+	if strings.Contains(string(p), wdaServerURLMarker) {
+		setWdaSessionState(WdaSessionKey{udid: session.Udid, sessionID: session.SessionId}, WdaSessionRunning)
+	}
+
 	return len(p), nil
 }
 
-var globalSessions = sync.Map{}
+var (
+	globalSessions = sync.Map{}
+	// wdaSessionsMu защищает обновление состояния сессии от гонки с её удалением.
+	wdaSessionsMu sync.Mutex
+)
+
+// setWdaSessionState обновляет состояние сессии, если она ещё существует.
+func setWdaSessionState(key WdaSessionKey, state WdaSessionState) {
+	wdaSessionsMu.Lock()
+	defer wdaSessionsMu.Unlock()
+	value, ok := globalSessions.Load(key)
+	if !ok {
+		return
+	}
+	session := value.(WdaSession)
+	if session.State == WdaSessionStopping || session.State == state {
+		return
+	}
+	session.State = state
+	globalSessions.Store(key, session)
+	notifyWdaSessionState(key, state)
+}
+
+func deleteWdaSession(key WdaSessionKey) {
+	wdaSessionsMu.Lock()
+	defer wdaSessionsMu.Unlock()
+	if _, loaded := globalSessions.LoadAndDelete(key); loaded {
+		notifyWdaSessionState(key, WdaSessionStopped)
+	}
+	dropWdaClient(key.sessionID)
+}
+
+// parseWdaPort читает номер порта из переменной окружения WDA.
+func parseWdaPort(env map[string]interface{}, name string) (uint16, error) {
+	portStr, ok := env[name].(string)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a string", name)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return uint16(port), nil
+}
 
 // @Summary Создать новую сессию WDA
 // @Description Создать новую сессию WebDriverAgent для указанного устройства
@@ -54,6 +150,7 @@ var globalSessions = sync.Map{}
 // @Param config body WdaConfig true "Конфигурация WebDriverAgent"
 // @Success 200 {object} WdaSession
 // @Failure 400 {object} GenericResponse
+// @Failure 500 {object} GenericResponse
 // @Router /wda/session [post]
 func CreateWdaSession(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
@@ -70,72 +167,113 @@ func CreateWdaSession(c *gin.Context) {
 
 	var config WdaConfig
 	if err := c.ShouldBindJSON(&config); err != nil {
-		config = WdaConfig{
-			BundleID:     "com.facebook.WebDriverAgentRunner.xctrunner",
-			TestbundleID: "com.facebook.WebDriverAgentRunner.xctrunner",
-			XCTestConfig: "WebDriverAgentRunner.xctest",
-			Args:         []string{},
-			Env: map[string]interface{}{
-				"MJPEG_SERVER_PORT":         "8001",
-				"USE_PORT":                  "8100",
-				"UITEST_DISABLE_ANIMATIONS": "YES",
-			},
+		config = defaultWdaConfig()
+	}
+
+	session, err := startWdaSession(device, config)
+	if errors.Is(err, errWdaForward) {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// defaultWdaConfig возвращает конфигурацию для стандартной сборки WebDriverAgentRunner.
+func defaultWdaConfig() WdaConfig {
+	return WdaConfig{
+		BundleID:     "com.facebook.WebDriverAgentRunner.xctrunner",
+		TestbundleID: "com.facebook.WebDriverAgentRunner.xctrunner",
+		XCTestConfig: "WebDriverAgentRunner.xctest",
+		Args:         []string{},
+		Env: map[string]interface{}{
+			"MJPEG_SERVER_PORT":         "8001",
+			"USE_PORT":                  "8100",
+			"UITEST_DISABLE_ANIMATIONS": "YES",
+		},
+	}
+}
+
+// forwardToFreePort пробрасывает порт phonePort устройства на свободный порт хоста.
+// Порт может занять кто-то другой между проверкой и пробросом, поэтому попыток несколько.
+func forwardToFreePort(device ios.DeviceEntry, phonePort uint16) (*forward.ConnListener, uint16, error) {
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		l, err := net.Listen("tcp", "0.0.0.0:0")
+		if err != nil {
+			return nil, 0, err
+		}
+		hostPort := uint16(l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		fwd, err := forward.Forward(device, hostPort, phonePort)
+		if err == nil {
+			return fwd, hostPort, nil
 		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// startWdaSession пробрасывает порты WDA на свободные порты хоста, запускает WDA в фоне
+// и регистрирует сессию. Ошибки запуска WDA логируются, ошибки конфигурации и проброса
+// возвращаются.
+func startWdaSession(device ios.DeviceEntry, config WdaConfig) (WdaSession, error) {
+	mjpegPort, err := parseWdaPort(config.Env, "MJPEG_SERVER_PORT")
+	if err != nil {
+		return WdaSession{}, err
 	}
+	usePort, err := parseWdaPort(config.Env, "USE_PORT")
+	if err != nil {
+		return WdaSession{}, err
+	}
+
 	sessionKey := WdaSessionKey{
 		udid:      device.Properties.SerialNumber,
 		sessionID: uuid.New().String(),
 	}
 
+	/* прокидываем порт для mjpeg трафика*/
+	fwdMjpeg, hostMjpegPort, err := forwardToFreePort(device, mjpegPort)
+	if err != nil {
+		return WdaSession{}, fmt.Errorf("%w %d (MJPEG): %v", errWdaForward, mjpegPort, err)
+	}
+	log.
+		WithField("udid", device.Properties.SerialNumber).
+		WithField("port", mjpegPort).
+		WithField("hostPort", hostMjpegPort).
+		Debugf("PortForward mjpeg server")
+
+	/* прокидываем порт для wda трафика */
+	fwdWda, hostWdaPort, err := forwardToFreePort(device, usePort)
+	if err != nil {
+		fwdMjpeg.Close()
+		return WdaSession{}, fmt.Errorf("%w %d: %v", errWdaForward, usePort, err)
+	}
+	log.
+		WithField("udid", device.Properties.SerialNumber).
+		WithField("port", usePort).
+		WithField("hostPort", hostWdaPort).
+		Debugf("PortForward wda server")
+
 	wdaCtx, stopWda := context.WithCancel(context.Background())
 
 	session := WdaSession{
-		Udid:      sessionKey.udid,
-		SessionId: sessionKey.sessionID,
-		Config:    config,
-		stopWda:   stopWda,
+		Udid:          sessionKey.udid,
+		SessionId:     sessionKey.sessionID,
+		Config:        config,
+		State:         WdaSessionStarting,
+		StartedAt:     time.Now(),
+		WdaPort:       usePort,
+		MjpegPort:     mjpegPort,
+		HostWdaPort:   hostWdaPort,
+		HostMjpegPort: hostMjpegPort,
+		stopWda:       stopWda,
 	}
 	go func() {
-		/* прокидываем порт для mjpeg трафика*/
-		mjpegPortStr, ok := config.Env["MJPEG_SERVER_PORT"].(string)
-		if !ok {
-			log.Error("MJPEG_SERVER_PORT is not a string")
-			return
-		}
-		mjpegPort, err := strconv.ParseUint(mjpegPortStr, 10, 16)
-		if err != nil {
-			log.Errorf("Invalid MJPEG_SERVER_PORT: %v", err)
-			return
-		}
-		fwdMjpeg, err := forward.Forward(device, uint16(mjpegPort), uint16(mjpegPort))
-		if err != nil {
-			log.Info(err)
-		}
-		log.
-			WithField("udid", device.Properties.SerialNumber).
-			WithField("port", mjpegPort).
-			Debugf("PortForward mjpeg server")
-
-		/* прокидываем порт для wda трафика */
-		usePortStr, ok := config.Env["USE_PORT"].(string)
-		if !ok {
-			log.Error("USE_PORT is not a string")
-			return
-		}
-		usePort, err := strconv.ParseUint(usePortStr, 10, 16)
-		if err != nil {
-			log.Errorf("Invalid USE_PORT: %v", err)
-			return
-		}
-		fwdWda, err := forward.Forward(device, uint16(usePort), uint16(usePort))
-		if err != nil {
-			log.Info(err)
-		}
-		log.
-			WithField("udid", device.Properties.SerialNumber).
-			WithField("port", fwdWda).
-			Debugf("PortForward wda server")
-
 		/* запускаем wda */
 		_, err = testmanagerd.RunTestWithConfig(wdaCtx, testmanagerd.TestConfig{
 			BundleId:           config.BundleID,
@@ -157,7 +295,7 @@ func CreateWdaSession(c *gin.Context) {
 		stopWda()
 		fwdMjpeg.Close()
 		fwdWda.Close()
-		globalSessions.Delete(sessionKey)
+		deleteWdaSession(sessionKey)
 
 		log.
 			WithField("udid", sessionKey.udid).
@@ -166,13 +304,14 @@ func CreateWdaSession(c *gin.Context) {
 	}()
 
 	globalSessions.Store(sessionKey, session)
+	notifyWdaSessionState(sessionKey, WdaSessionStarting)
 
 	log.
 		WithField("udid", sessionKey.udid).
 		WithField("sessionId", sessionKey.sessionID).
 		Debugf("Requested to start WDA session")
 
-	c.JSON(http.StatusOK, session)
+	return session, nil
 }
 
 // @Summary Получить сессию WebDriverAgent
@@ -239,14 +378,120 @@ func DeleteWdaSession(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cast session"})
 		return
 	}
-	wdaSession.stopWda()
+
+	c.JSON(http.StatusOK, stopWdaSession(sessionKey, wdaSession))
+}
+
+// stopWdaSession переводит сессию в состояние stopping и останавливает WDA.
+// Сама сессия удаляется из globalSessions горутиной, запустившей WDA.
+func stopWdaSession(key WdaSessionKey, session WdaSession) WdaSession {
+	wdaSessionsMu.Lock()
+	if _, loaded := globalSessions.Load(key); loaded {
+		session.State = WdaSessionStopping
+		globalSessions.Store(key, session)
+		notifyWdaSessionState(key, WdaSessionStopping)
+	}
+	wdaSessionsMu.Unlock()
+
+	session.stopWda()
 
 	log.
-		WithField("udid", sessionKey.udid).
-		WithField("sessionId", sessionKey.sessionID).
+		WithField("udid", key.udid).
+		WithField("sessionId", key.sessionID).
 		Debug("Requested to stop WDA")
 
-	c.JSON(http.StatusOK, session)
+	return session
+}
+
+// filterWdaSessions возвращает сессии, подходящие под фильтры udid и state.
+// Пустой фильтр подходит под любое значение.
+func filterWdaSessions(udid string, state WdaSessionState) map[WdaSessionKey]WdaSession {
+	sessions := make(map[WdaSessionKey]WdaSession)
+	globalSessions.Range(func(key, value any) bool {
+		sk, ok := key.(WdaSessionKey)
+		if !ok {
+			return true
+		}
+		ws, ok := value.(WdaSession)
+		if !ok {
+			return true
+		}
+		if udid != "" && sk.udid != udid {
+			return true
+		}
+		if state != "" && ws.State != state {
+			return true
+		}
+		sessions[sk] = ws
+		return true
+	})
+	return sessions
+}
+
+// wdaStateQuery читает фильтр ?state=. Неизвестное состояние — ошибка: иначе опечатка
+// молча не подошла бы ни под одну сессию.
+func wdaStateQuery(c *gin.Context) (WdaSessionState, error) {
+	state := WdaSessionState(c.Query("state"))
+	switch state {
+	case "", WdaSessionStarting, WdaSessionRunning, WdaSessionStopping, WdaSessionStopped:
+		return state, nil
+	}
+	return "", fmt.Errorf("state must be starting, running, stopping or stopped")
+}
+
+func summarizeWdaSessions(sessions map[WdaSessionKey]WdaSession) []WdaSessionSummary {
+	summaries := make([]WdaSessionSummary, 0, len(sessions))
+	for _, session := range sessions {
+		summaries = append(summaries, WdaSessionSummary{
+			WdaSession: session,
+			Uptime:     time.Since(session.StartedAt).Round(time.Second).String(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StartedAt.Before(summaries[j].StartedAt)
+	})
+	return summaries
+}
+
+// @Summary Список сессий WebDriverAgent
+// @Description Возвращает все сессии WDA на этом хосте с состоянием, временем работы, портами и конфигурацией
+// @Tags WebDriverAgent
+// @Produce json
+// @Param udid query string false "Фильтр по UDID устройства"
+// @Param state query string false "Фильтр по состоянию: starting, running, stopping или stopped"
+// @Success 200 {object} []WdaSessionSummary
+// @Failure 422 {object} GenericResponse
+// @Router /wda/sessions [get]
+func ListWdaSessions(c *gin.Context) {
+	state, err := wdaStateQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	sessions := filterWdaSessions(c.Query("udid"), state)
+	c.JSON(http.StatusOK, summarizeWdaSessions(sessions))
+}
+
+// @Summary Остановить сессии WebDriverAgent
+// @Description Останавливает все сессии WDA на этом хосте или только подходящие под фильтры
+// @Tags WebDriverAgent
+// @Produce json
+// @Param udid query string false "Фильтр по UDID устройства"
+// @Param state query string false "Фильтр по состоянию: starting, running, stopping или stopped"
+// @Success 200 {object} []WdaSessionSummary
+// @Failure 422 {object} GenericResponse
+// @Router /wda/sessions [delete]
+func DeleteWdaSessions(c *gin.Context) {
+	state, err := wdaStateQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	sessions := filterWdaSessions(c.Query("udid"), state)
+	for key, session := range sessions {
+		sessions[key] = stopWdaSession(key, session)
+	}
+	c.JSON(http.StatusOK, summarizeWdaSessions(sessions))
 }
 
 func FindSessionByUdid(udid string) (WdaSessionKey, *WdaSession, bool) {
@@ -0,0 +1,477 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	log "github.com/sirupsen/logrus"
+)
+
+// errNoWdaSession возвращается, когда для устройства нет запущенной сессии WDA
+// и автозапуск через WDA_AUTOSTART не включён.
+var errNoWdaSession = errors.New("no active WDA session for this device, create one via /wda/session or set WDA_AUTOSTART=true")
+
+// wdaClient выполняет HTTP-запросы к WebDriverAgent через проброшенный порт
+// и хранит WebDriver-сессию, открытую внутри WDA.
+type wdaClient struct {
+	baseURL string
+	http    http.Client
+
+	mu        sync.Mutex
+	sessionID string
+	scale     float64
+
+	// settingsMu не даёт поискам с атрибутами перемешать временные настройки WDA.
+	settingsMu sync.Mutex
+}
+
+// wdaResponse — общий конверт ответов WebDriverAgent.
+type wdaResponse struct {
+	Value     json.RawMessage `json:"value"`
+	SessionID string          `json:"sessionId"`
+}
+
+type wdaError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// wdaRequestError — ответ WDA с кодом, отличным от 200.
+type wdaRequestError struct {
+	method string
+	path   string
+	status int
+	wdaError
+}
+
+func (e *wdaRequestError) Error() string {
+	return fmt.Sprintf("WDA %s %s failed with status %d: %s %s", e.method, e.path, e.status, e.wdaError.Error, e.Message)
+}
+
+// isWdaInvalidSelector сообщает, что WDA отклонил запрос элементов как некорректный.
+func isWdaInvalidSelector(err error) bool {
+	var requestErr *wdaRequestError
+	return errors.As(err, &requestErr) && requestErr.wdaError.Error == "invalid selector"
+}
+
+// Клиенты WDA по sessionId сессии peer: новая сессия WDA всегда получает новый клиент.
+var (
+	wdaClientsMu sync.Mutex
+	wdaClients   = make(map[string]*wdaClient)
+)
+
+// Автозапуск WDA выполняется по одному на устройство, чтобы одновременные запросы
+// не запустили две сессии.
+var (
+	wdaAutostartMu    sync.Mutex
+	wdaAutostartLocks = make(map[string]*sync.Mutex)
+)
+
+func wdaAutostartLock(udid string) *sync.Mutex {
+	wdaAutostartMu.Lock()
+	defer wdaAutostartMu.Unlock()
+	lock, ok := wdaAutostartLocks[udid]
+	if !ok {
+		lock = &sync.Mutex{}
+		wdaAutostartLocks[udid] = lock
+	}
+	return lock
+}
+
+// wdaClientForDevice возвращает клиент WDA для активной сессии устройства.
+// Если сессии нет и WDA_AUTOSTART=true, запускает WDA с конфигурацией по умолчанию и ждёт готовности.
+// Если WDA не ответил вовремя, запущенная сессия останавливается.
+func wdaClientForDevice(device ios.DeviceEntry) (*wdaClient, error) {
+	udid := device.Properties.SerialNumber
+	if _, session, found := FindSessionByUdid(udid); found {
+		return wdaClientForSession(session), nil
+	}
+	if os.Getenv("WDA_AUTOSTART") != "true" {
+		return nil, errNoWdaSession
+	}
+
+	lock := wdaAutostartLock(udid)
+	lock.Lock()
+	defer lock.Unlock()
+	// Пока запрос ждал блокировку, сессию мог запустить другой запрос.
+	if _, session, found := FindSessionByUdid(udid); found {
+		return wdaClientForSession(session), nil
+	}
+	started, err := startWdaSession(device, defaultWdaConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := waitForWdaReady(started, defaultWdaReadyTimeout); err != nil {
+		stopWdaSession(WdaSessionKey{udid: started.Udid, sessionID: started.SessionId}, started)
+		return nil, err
+	}
+	return wdaClientForSession(&started), nil
+}
+
+// existingWdaClient возвращает клиент WDA, только если сессия устройства уже запущена, и никогда не запускает WDA.
+func existingWdaClient(udid string) (*wdaClient, bool) {
+	_, session, found := FindSessionByUdid(udid)
+	if !found {
+		return nil, false
+	}
+	return wdaClientForSession(session), true
+}
+
+func wdaClientForSession(session *WdaSession) *wdaClient {
+	wdaClientsMu.Lock()
+	defer wdaClientsMu.Unlock()
+	client, ok := wdaClients[session.SessionId]
+	if !ok {
+		client = &wdaClient{
+			baseURL: fmt.Sprintf("http://localhost:%d", session.HostWdaPort),
+			http:    http.Client{Timeout: 60 * time.Second},
+		}
+		wdaClients[session.SessionId] = client
+	}
+	return client
+}
+
+func dropWdaClient(sessionID string) {
+	wdaClientsMu.Lock()
+	defer wdaClientsMu.Unlock()
+	delete(wdaClients, sessionID)
+}
+
+// do отправляет запрос к WDA и раскладывает поле value ответа в out, если он не nil.
+func (w *wdaClient) do(method string, path string, body interface{}, out interface{}) (wdaResponse, error) {
+	var response wdaResponse
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return response, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, w.baseURL+path, reader)
+	if err != nil {
+		return response, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, fmt.Errorf("unexpected WDA response for %s %s: %s", method, path, data)
+	}
+	if resp.StatusCode != http.StatusOK {
+		requestErr := &wdaRequestError{method: method, path: path, status: resp.StatusCode}
+		json.Unmarshal(response.Value, &requestErr.wdaError)
+		return response, requestErr
+	}
+	if out != nil {
+		if err := json.Unmarshal(response.Value, out); err != nil {
+			return response, err
+		}
+	}
+	return response, nil
+}
+
+// ensureSession открывает WebDriver-сессию внутри WDA, если она ещё не открыта.
+func (w *wdaClient) ensureSession() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sessionID != "" {
+		return w.sessionID, nil
+	}
+	var value struct {
+		SessionID string `json:"sessionId"`
+	}
+	response, err := w.do(http.MethodPost, "/session", map[string]interface{}{"capabilities": map[string]interface{}{}}, &value)
+	if err != nil {
+		return "", err
+	}
+	w.sessionID = response.SessionID
+	if w.sessionID == "" {
+		w.sessionID = value.SessionID
+	}
+	if w.sessionID == "" {
+		return "", fmt.Errorf("WDA did not return a session id")
+	}
+	log.WithField("wdaSessionId", w.sessionID).Debug("Opened WDA WebDriver session")
+	return w.sessionID, nil
+}
+
+// sessionDo выполняет запрос в рамках WebDriver-сессии и один раз переоткрывает её,
+// если WDA сообщил, что сессия больше не существует.
+func (w *wdaClient) sessionDo(method string, path string, body interface{}, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		sessionID, err := w.ensureSession()
+		if err != nil {
+			return err
+		}
+		_, err = w.do(method, "/session/"+sessionID+path, body, out)
+		if err != nil && attempt == 0 && strings.Contains(err.Error(), "invalid session id") {
+			w.mu.Lock()
+			w.sessionID = ""
+			w.mu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// screenScale возвращает отношение пикселей скриншота к точкам экрана.
+func (w *wdaClient) screenScale() (float64, error) {
+	w.mu.Lock()
+	scale := w.scale
+	w.mu.Unlock()
+	if scale > 0 {
+		return scale, nil
+	}
+	var screen struct {
+		Scale float64 `json:"scale"`
+	}
+	if err := w.sessionDo(http.MethodGet, "/wda/screen", nil, &screen); err != nil {
+		return 0, err
+	}
+	if screen.Scale <= 0 {
+		screen.Scale = 1
+	}
+	w.mu.Lock()
+	w.scale = screen.Scale
+	w.mu.Unlock()
+	return screen.Scale, nil
+}
+
+// toPoints переводит координаты из пикселей скриншота в точки экрана WDA.
+func (w *wdaClient) toPoints(x float64, y float64) (float64, float64, error) {
+	scale, err := w.screenScale()
+	if err != nil {
+		return 0, 0, err
+	}
+	return x / scale, y / scale, nil
+}
+
+// performPointer выполняет последовательность W3C pointer actions одним пальцем.
+func (w *wdaClient) performPointer(actions []map[string]interface{}) error {
+	body := map[string]interface{}{
+		"actions": []map[string]interface{}{{
+			"type":       "pointer",
+			"id":         "finger1",
+			"parameters": map[string]interface{}{"pointerType": "touch"},
+			"actions":    actions,
+		}},
+	}
+	return w.sessionDo(http.MethodPost, "/actions", body, nil)
+}
+
+func pointerMove(x float64, y float64, durationMs int) map[string]interface{} {
+	return map[string]interface{}{"type": "pointerMove", "duration": durationMs, "x": x, "y": y}
+}
+
+func pointerDown() map[string]interface{} {
+	return map[string]interface{}{"type": "pointerDown", "button": 0}
+}
+
+func pointerUp() map[string]interface{} {
+	return map[string]interface{}{"type": "pointerUp", "button": 0}
+}
+
+func pointerPause(durationMs int) map[string]interface{} {
+	return map[string]interface{}{"type": "pause", "duration": durationMs}
+}
+
+// Tap, Swipe и LongPress принимают координаты в пикселях скриншота.
+func (w *wdaClient) Tap(x float64, y float64) error {
+	return w.LongPress(x, y, 50)
+}
+
+func (w *wdaClient) LongPress(x float64, y float64, durationMs int) error {
+	px, py, err := w.toPoints(x, y)
+	if err != nil {
+		return err
+	}
+	return w.performPointer([]map[string]interface{}{
+		pointerMove(px, py, 0),
+		pointerDown(),
+		pointerPause(durationMs),
+		pointerUp(),
+	})
+}
+
+func (w *wdaClient) Swipe(fromX float64, fromY float64, toX float64, toY float64, durationMs int) error {
+	fx, fy, err := w.toPoints(fromX, fromY)
+	if err != nil {
+		return err
+	}
+	tx, ty, err := w.toPoints(toX, toY)
+	if err != nil {
+		return err
+	}
+	return w.performPointer([]map[string]interface{}{
+		pointerMove(fx, fy, 0),
+		pointerDown(),
+		pointerMove(tx, ty, durationMs),
+		pointerUp(),
+	})
+}
+
+func (w *wdaClient) TypeText(text string) error {
+	return w.sessionDo(http.MethodPost, "/wda/keys", map[string]interface{}{"value": strings.Split(text, "")}, nil)
+}
+
+// PressButton нажимает аппаратную кнопку: home, volumeUp или volumeDown.
+func (w *wdaClient) PressButton(name string) error {
+	return w.sessionDo(http.MethodPost, "/wda/pressButton", map[string]interface{}{"name": name}, nil)
+}
+
+func (w *wdaClient) Home() error {
+	_, err := w.do(http.MethodPost, "/wda/homescreen", nil, nil)
+	return err
+}
+
+func (w *wdaClient) Lock() error {
+	_, err := w.do(http.MethodPost, "/wda/lock", nil, nil)
+	return err
+}
+
+func (w *wdaClient) Unlock() error {
+	_, err := w.do(http.MethodPost, "/wda/unlock", nil, nil)
+	return err
+}
+
+// Ориентации интерфейса, которые peer отдаёт клиентам. WDA называет их по-разному в зависимости
+// от версии, поэтому её значения приводятся к этому набору в wdaOrientation.
+const (
+	OrientationPortrait           = "portrait"
+	OrientationPortraitUpsideDown = "portraitUpsideDown"
+	OrientationLandscapeLeft      = "landscapeLeft"
+	OrientationLandscapeRight     = "landscapeRight"
+)
+
+// wdaOrientation приводит ориентацию из WDA (PORTRAIT, LANDSCAPE, LANDSCAPE_LEFT,
+// UIA_DEVICE_ORIENTATION_LANDSCAPERIGHT и т. п.) к одному из значений Orientation*.
+func wdaOrientation(value string) string {
+	switch strings.TrimPrefix(strings.ReplaceAll(strings.ToUpper(value), "_", ""), "UIADEVICEORIENTATION") {
+	case "LANDSCAPE", "LANDSCAPELEFT":
+		return OrientationLandscapeLeft
+	case "LANDSCAPERIGHT":
+		return OrientationLandscapeRight
+	case "PORTRAITUPSIDEDOWN":
+		return OrientationPortraitUpsideDown
+	default:
+		return OrientationPortrait
+	}
+}
+
+// Orientation возвращает ориентацию интерфейса: одно из значений Orientation*.
+func (w *wdaClient) Orientation() (string, error) {
+	var orientation string
+	if err := w.sessionDo(http.MethodGet, "/orientation", nil, &orientation); err != nil {
+		return "", err
+	}
+	return wdaOrientation(orientation), nil
+}
+
+// Source возвращает XML-дерево элементов текущего экрана.
+func (w *wdaClient) Source() (string, error) {
+	var source string
+	_, err := w.do(http.MethodGet, "/source", nil, &source)
+	return source, err
+}
+
+// wdaElementAttributes — атрибуты, которые WDA включает в ответ /elements при
+// shouldUseCompactResponses=false. Поле name WDA заполняет типом элемента,
+// поэтому имя запрашивается как attribute/name.
+const wdaElementAttributes = "type,rect,enabled,displayed,attribute/name,attribute/label,attribute/value"
+
+// wdaElementInfo — элемент из ответа /elements вместе с атрибутами.
+type wdaElementInfo struct {
+	ID        string      `json:"ELEMENT"`
+	Type      string      `json:"type"`
+	Rect      UIFrame     `json:"rect"`
+	Enabled   bool        `json:"enabled"`
+	Displayed bool        `json:"displayed"`
+	Name      interface{} `json:"attribute/name"`
+	Label     interface{} `json:"attribute/label"`
+	Value     interface{} `json:"attribute/value"`
+}
+
+// FindElementsWithAttributes ищет элементы и получает их атрибуты тем же запросом,
+// а не отдельным запросом на каждый атрибут. Настройки ответа в WDA общие для всех
+// клиентов сессии, поэтому они задаются на время поиска, а затем возвращаются прежние.
+func (w *wdaClient) FindElementsWithAttributes(using string, value string) ([]wdaElementInfo, error) {
+	w.settingsMu.Lock()
+	defer w.settingsMu.Unlock()
+	var previous map[string]interface{}
+	if err := w.sessionDo(http.MethodGet, "/appium/settings", nil, &previous); err != nil {
+		return nil, err
+	}
+	restore := map[string]interface{}{}
+	for _, name := range []string{"shouldUseCompactResponses", "elementResponseAttributes"} {
+		if v, ok := previous[name]; ok {
+			restore[name] = v
+		}
+	}
+	settings := map[string]interface{}{"settings": map[string]interface{}{
+		"shouldUseCompactResponses": false,
+		"elementResponseAttributes": wdaElementAttributes,
+	}}
+	if err := w.sessionDo(http.MethodPost, "/appium/settings", settings, nil); err != nil {
+		return nil, err
+	}
+	var found []wdaElementInfo
+	findErr := w.sessionDo(http.MethodPost, "/elements", map[string]interface{}{"using": using, "value": value}, &found)
+	if len(restore) > 0 {
+		if err := w.sessionDo(http.MethodPost, "/appium/settings", map[string]interface{}{"settings": restore}, nil); err != nil && findErr == nil {
+			return nil, err
+		}
+	}
+	if findErr != nil {
+		return nil, findErr
+	}
+	return found, nil
+}
+
+// GesturePoint — точка жеста в пикселях скриншота и задержка от предыдущей точки.
+type GesturePoint struct {
+	X       float64
+	Y       float64
+	DelayMs int
+}
+
+// Gesture выполняет произвольный жест одним пальцем: палец опускается в первой точке,
+// проходит через остальные и поднимается в последней.
+func (w *wdaClient) Gesture(points []GesturePoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	actions := make([]map[string]interface{}, 0, len(points)+2)
+	for i, p := range points {
+		px, py, err := w.toPoints(p.X, p.Y)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			actions = append(actions, pointerMove(px, py, 0), pointerDown())
+			continue
+		}
+		actions = append(actions, pointerMove(px, py, p.DelayMs))
+	}
+	actions = append(actions, pointerUp())
+	return w.performPointer(actions)
+}
@@ -0,0 +1,384 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/installationproxy"
+	"github.com/danielpaulus/go-ios/ios/zipconduit"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"howett.net/plist"
+)
+
+const (
+	ProvisionStepOK      = "ok"
+	ProvisionStepSkipped = "skipped"
+	ProvisionStepFailed  = "failed"
+
+	defaultWdaReadyTimeout = 60 * time.Second
+)
+
+// ipaInfoPlistPattern находит Info.plist основного бандла внутри IPA.
+var ipaInfoPlistPattern = regexp.MustCompile(`^Payload/[^/]+\.app/Info\.plist$`)
+
+// ProvisionStep — результат одного шага подготовки WDA.
+type ProvisionStep struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// WdaProvisionReport — пошаговый отчёт о подготовке WDA на устройстве.
+type WdaProvisionReport struct {
+	Udid    string          `json:"udid"`
+	Success bool            `json:"success"`
+	Steps   []ProvisionStep `json:"steps"`
+	Session *WdaSession     `json:"session,omitempty"`
+}
+
+func (r *WdaProvisionReport) step(name string, start time.Time, status string, message string) {
+	r.Steps = append(r.Steps, ProvisionStep{
+		Name:     name,
+		Status:   status,
+		Message:  message,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	})
+	if status == ProvisionStepFailed {
+		r.Success = false
+	}
+}
+
+// ipaBundleInfo содержит версию бандла, прочитанную из Info.plist внутри IPA.
+type ipaBundleInfo struct {
+	BundleID      string `plist:"CFBundleIdentifier"`
+	ShortVersion  string `plist:"CFBundleShortVersionString"`
+	BundleVersion string `plist:"CFBundleVersion"`
+}
+
+// @Summary Подготовить WebDriverAgent на устройстве
+// @Description Проверяет, установлен ли WDA, при необходимости устанавливает IPA (загруженный или из WDA_IPA_PATH), запускает сессию и ждёт готовности WDA. Если CFBundleIdentifier в IPA не совпадает с bundleId конфигурации, возвращается 422 до установки; testBundleId, отличный от bundleId, должен быть уже установлен
+// @Tags WebDriverAgent
+// @Accept json,mpfd
+// @Produce json
+// @Param udid path string true "UDID устройства"
+// @Param config body WdaConfig false "Конфигурация WebDriverAgent"
+// @Param file formData file false "IPA-файл WebDriverAgent"
+// @Param timeout query string false "Время ожидания готовности WDA, например 90s"
+// @Success 200 {object} WdaProvisionReport
+// @Failure 422 {object} GenericResponse
+// @Failure 500 {object} WdaProvisionReport
+// @Router /device/{udid}/wda/provision [post]
+func ProvisionWda(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+
+	timeout, err := durationQuery(c, "timeout", defaultWdaReadyTimeout)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "invalid timeout: " + err.Error()})
+		return
+	}
+
+	config := defaultWdaConfig()
+	ipaPath := os.Getenv("WDA_IPA_PATH")
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		if raw := c.PostForm("config"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &config); err != nil {
+				c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "invalid config: " + err.Error()})
+				return
+			}
+		}
+		if file, err := c.FormFile("file"); err == nil {
+			if file.Size == 0 {
+				c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "uploaded file is empty"})
+				return
+			}
+			if file.Size > 200*1024*1024 {
+				c.JSON(http.StatusRequestEntityTooLarge, GenericResponse{Error: "file size exceeds the 200MB limit"})
+				return
+			}
+			appDownloadFolder := os.Getenv("APP_DOWNLOAD_FOLDER")
+			if appDownloadFolder == "" {
+				appDownloadFolder = os.TempDir()
+			}
+			dst := path.Join(appDownloadFolder, uuid.New().String()+".ipa")
+			if err := c.SaveUploadedFile(file, dst); err != nil {
+				c.JSON(http.StatusInternalServerError, GenericResponse{Error: "failed to save uploaded file"})
+				return
+			}
+			defer os.Remove(dst)
+			ipaPath = dst
+		}
+	} else if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&config); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "invalid config: " + err.Error()})
+			return
+		}
+	}
+
+	// IPA с другим бандлом установился бы, но WDA не запустился бы до истечения timeout.
+	var ipa *ipaBundleInfo
+	if ipaPath != "" {
+		info, err := readIpaBundleInfo(ipaPath)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "invalid IPA: " + err.Error()})
+			return
+		}
+		if info.BundleID != config.BundleID {
+			c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: fmt.Sprintf("IPA bundle %s does not match bundleId %s", info.BundleID, config.BundleID)})
+			return
+		}
+		ipa = &info
+	}
+
+	report := WdaProvisionReport{Udid: udid, Success: true}
+	provisionWda(device, config, ipa, ipaPath, timeout, &report)
+
+	log.
+		WithField("udid", udid).
+		WithField("success", report.Success).
+		Debug("WDA provisioning finished")
+
+	if !report.Success {
+		c.JSON(http.StatusInternalServerError, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// provisionWda выполняет шаги подготовки и останавливается на первом неудачном.
+// ipa — бандл из ipaPath, уже сверенный с config.BundleID. Если WDA не стал готов,
+// сессия, запущенная этим вызовом, останавливается.
+func provisionWda(device ios.DeviceEntry, config WdaConfig, ipa *ipaBundleInfo, ipaPath string, timeout time.Duration, report *WdaProvisionReport) {
+	start := time.Now()
+	installed, err := findInstalledApp(device, config.BundleID)
+	if err != nil {
+		report.step("check-installed", start, ProvisionStepFailed, err.Error())
+		return
+	}
+	if installed == nil {
+		report.step("check-installed", start, ProvisionStepOK, config.BundleID+" is not installed")
+	} else {
+		report.step("check-installed", start, ProvisionStepOK, fmt.Sprintf("%s %s (%s) is installed", config.BundleID, installed.CFBundleShortVersionString(), appBundleVersion(*installed)))
+	}
+
+	start = time.Now()
+	switch {
+	case ipaPath == "" && installed == nil:
+		report.step("install", start, ProvisionStepFailed, "WDA is not installed and no IPA was uploaded or configured in WDA_IPA_PATH")
+		return
+	case ipaPath == "":
+		report.step("install", start, ProvisionStepSkipped, "no IPA was uploaded or configured in WDA_IPA_PATH")
+	default:
+		if installed != nil && !isAppOutdated(*installed, *ipa) {
+			report.step("install", start, ProvisionStepSkipped, fmt.Sprintf("installed version is up to date with IPA %s (%s)", ipa.ShortVersion, ipa.BundleVersion))
+			break
+		}
+		conn, err := zipconduit.New(device)
+		if err != nil {
+			report.step("install", start, ProvisionStepFailed, "unable to setup ZipConduit connection: "+err.Error())
+			return
+		}
+		err = conn.SendFile(ipaPath)
+		conn.Close()
+		if err != nil {
+			report.step("install", start, ProvisionStepFailed, "unable to install IPA: "+err.Error())
+			return
+		}
+		report.step("install", start, ProvisionStepOK, fmt.Sprintf("installed %s %s (%s)", ipa.BundleID, ipa.ShortVersion, ipa.BundleVersion))
+	}
+
+	if config.TestbundleID != config.BundleID {
+		start = time.Now()
+		runner, err := findInstalledApp(device, config.TestbundleID)
+		if err != nil {
+			report.step("check-test-bundle", start, ProvisionStepFailed, err.Error())
+			return
+		}
+		if runner == nil {
+			report.step("check-test-bundle", start, ProvisionStepFailed, config.TestbundleID+" is not installed")
+			return
+		}
+		report.step("check-test-bundle", start, ProvisionStepOK, config.TestbundleID+" is installed")
+	}
+
+	start = time.Now()
+	var session *WdaSession
+	startedHere := false
+	if _, existing, found := FindSessionByUdid(device.Properties.SerialNumber); found {
+		session = existing
+		report.step("start-session", start, ProvisionStepSkipped, "reusing existing session "+existing.SessionId)
+	} else {
+		started, err := startWdaSession(device, config)
+		if err != nil {
+			report.step("start-session", start, ProvisionStepFailed, err.Error())
+			return
+		}
+		session = &started
+		startedHere = true
+		report.step("start-session", start, ProvisionStepOK, "started session "+started.SessionId)
+	}
+	report.Session = session
+
+	start = time.Now()
+	if err := waitForWdaReady(*session, timeout); err != nil {
+		report.step("wait-ready", start, ProvisionStepFailed, err.Error())
+		// Сессию, запущенную этим вызовом, останавливаем, как и при автозапуске; чужую не трогаем.
+		if startedHere {
+			*session = stopWdaSession(WdaSessionKey{udid: session.Udid, sessionID: session.SessionId}, *session)
+		}
+		return
+	}
+	setWdaSessionState(WdaSessionKey{udid: session.Udid, sessionID: session.SessionId}, WdaSessionRunning)
+	session.State = WdaSessionRunning
+	report.step("wait-ready", start, ProvisionStepOK, fmt.Sprintf("WDA is responding on host port %d", session.HostWdaPort))
+}
+
+// findInstalledApp возвращает приложение с указанным bundleID или nil, если оно не установлено.
+func findInstalledApp(device ios.DeviceEntry, bundleID string) (*installationproxy.AppInfo, error) {
+	svc, err := installationproxy.New(device)
+	if err != nil {
+		return nil, err
+	}
+	defer svc.Close()
+
+	apps, err := svc.BrowseAllApps()
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		if app.CFBundleIdentifier() == bundleID {
+			return &app, nil
+		}
+	}
+	return nil, nil
+}
+
+func appBundleVersion(app installationproxy.AppInfo) string {
+	if version, ok := app["CFBundleVersion"].(string); ok {
+		return version
+	}
+	return ""
+}
+
+// readIpaBundleInfo читает идентификатор и версию бандла из Info.plist внутри IPA.
+func readIpaBundleInfo(ipaPath string) (ipaBundleInfo, error) {
+	var info ipaBundleInfo
+	archive, err := zip.OpenReader(ipaPath)
+	if err != nil {
+		return info, fmt.Errorf("failed to open IPA: %w", err)
+	}
+	defer archive.Close()
+
+	for _, f := range archive.File {
+		if !ipaInfoPlistPattern.MatchString(f.Name) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return info, fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return info, fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		if _, err := plist.Unmarshal(data, &info); err != nil {
+			return info, fmt.Errorf("failed to parse %s: %w", f.Name, err)
+		}
+		return info, nil
+	}
+	return info, fmt.Errorf("Info.plist not found in IPA")
+}
+
+// isAppOutdated сравнивает установленную версию с версией из IPA.
+// Если версии не разбираются как semver, любое отличие считается устаревшей версией.
+func isAppOutdated(installed installationproxy.AppInfo, ipa ipaBundleInfo) bool {
+	if versionLess(installed.CFBundleShortVersionString(), ipa.ShortVersion) {
+		return true
+	}
+	if installed.CFBundleShortVersionString() != ipa.ShortVersion {
+		return false
+	}
+	return versionLess(appBundleVersion(installed), ipa.BundleVersion)
+}
+
+func versionLess(installed string, expected string) bool {
+	a, errA := semver.NewVersion(installed)
+	b, errB := semver.NewVersion(expected)
+	if errA != nil || errB != nil {
+		return installed != expected
+	}
+	return a.LessThan(b)
+}
+
+// waitForWdaReady опрашивает /status WDA через проброшенный порт, пока он не ответит
+// или пока не истечёт timeout, и проверяет, что ответил WDA нужного устройства.
+// Возвращает ошибку, если сессия завершилась раньше.
+func waitForWdaReady(session WdaSession, timeout time.Duration) error {
+	key := WdaSessionKey{udid: session.Udid, sessionID: session.SessionId}
+	statusURL := fmt.Sprintf("http://localhost:%d/status", session.HostWdaPort)
+	client := http.Client{Timeout: 2 * time.Second}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, ok := globalSessions.Load(key); !ok {
+			return fmt.Errorf("WDA session %s ended before becoming ready", session.SessionId)
+		}
+		resp, err := client.Get(statusURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return checkWdaDevice(session, &client)
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("WDA did not become ready within %s", timeout)
+}
+
+// checkWdaDevice проверяет, что на порту сессии отвечает WDA устройства сессии. WDA не сообщает
+// UDID, поэтому имя устройства из /wda/device/info сравнивается с DeviceName из lockdown.
+// Если WDA не поддерживает /wda/device/info, проверка пропускается.
+func checkWdaDevice(session WdaSession, client *http.Client) error {
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/wda/device/info", session.HostWdaPort))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.WithField("udid", session.Udid).Warnf("WDA device info returned %d, device is not verified", resp.StatusCode)
+		return nil
+	}
+	var info struct {
+		Value struct {
+			Name string `json:"name"`
+		} `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("unexpected WDA device info: %w", err)
+	}
+	device, err := lookupDevice(session.Udid)
+	if err != nil {
+		return err
+	}
+	values, err := ios.GetValues(device)
+	if err != nil {
+		return err
+	}
+	if info.Value.Name != values.Value.DeviceName {
+		return fmt.Errorf("WDA on host port %d belongs to device %q, expected %s (%q)", session.HostWdaPort, info.Value.Name, session.Udid, values.Value.DeviceName)
+	}
+	return nil
+}
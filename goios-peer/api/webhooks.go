@@ -0,0 +1,440 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookEventTypes — события шины, на которые можно подписать вебхук.
+var webhookEventTypes = []string{EventDeviceAttached, EventDeviceDetached, EventAppState, EventWdaSession, EventImageMount}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+	// WebhookDeliveryDropped — событие не поставлено в очередь: получатель не успевает.
+	WebhookDeliveryDropped WebhookDeliveryStatus = "dropped"
+)
+
+const (
+	webhookMaxAttempts   = 5
+	webhookFirstBackoff  = time.Second
+	webhookMaxBackoff    = 30 * time.Second
+	webhookTimeout       = 10 * time.Second
+	webhookQueueSize     = 1000
+	webhookDeliveryLog   = 200
+	webhookSignatureHead = "X-Goios-Signature"
+)
+
+// WebhookConfig — параметры регистрации вебхука.
+type WebhookConfig struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required"`
+	// Udids ограничивает события устройствами; пустой список — все устройства.
+	Udids []string `json:"udids,omitempty"`
+	// Secret — ключ подписи HMAC-SHA256. Если не задан, генерируется и возвращается один раз при создании.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Webhook — зарегистрированный вебхук. Секрет возвращается только при создании.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Udids     []string  `json:"udids,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookEvent — тело доставки: событие шины с идентификатором доставки.
+type WebhookEvent struct {
+	ID string `json:"id"`
+	BusEvent
+}
+
+// WebhookDelivery — запись журнала доставок.
+type WebhookDelivery struct {
+	ID          string                `json:"id"`
+	Event       string                `json:"event"`
+	Udid        string                `json:"udid,omitempty"`
+	Status      WebhookDeliveryStatus `json:"status"`
+	Attempts    int                   `json:"attempts"`
+	StatusCode  int                   `json:"statusCode,omitempty"`
+	Error       string                `json:"error,omitempty"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	DeliveredAt *time.Time            `json:"deliveredAt,omitempty"`
+}
+
+// webhook доставляет события по очереди: следующее событие отправляется после успеха
+// или исчерпания попыток предыдущего, поэтому получатель видит события в порядке их появления.
+type webhook struct {
+	config Webhook
+	queue  chan webhookJob
+	stop   chan struct{}
+
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+type webhookJob struct {
+	event WebhookEvent
+	body  []byte
+}
+
+var (
+	webhooksMu sync.Mutex
+	webhooks   = make(map[string]*webhook)
+
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+func init() {
+	onBusEvent(dispatchWebhookEvent)
+	onDeviceAttached(func(string) { ensureAppStateFollowers() })
+	onDeviceDetached(releaseAppStateFeed)
+}
+
+// wants сообщает, подписан ли вебхук на событие eventType устройства udid.
+func (w *webhook) wants(eventType string, udid string) bool {
+	if !slices.Contains(w.config.Events, eventType) {
+		return false
+	}
+	return len(w.config.Udids) == 0 || udid == "" || slices.Contains(w.config.Udids, udid)
+}
+
+// dispatchWebhookEvent ставит событие шины в очередь всех подписанных вебхуков.
+func dispatchWebhookEvent(e BusEvent) {
+	webhooksMu.Lock()
+	var targets []*webhook
+	for _, w := range webhooks {
+		if w.wants(e.Type, e.Udid) {
+			targets = append(targets, w)
+		}
+	}
+	webhooksMu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	event := WebhookEvent{ID: uuid.New().String(), BusEvent: e}
+	body := []byte(MustMarshal(event))
+	for _, w := range targets {
+		w.enqueue(webhookJob{event: event, body: body})
+	}
+}
+
+func (w *webhook) enqueue(job webhookJob) {
+	delivery := WebhookDelivery{
+		ID:        job.event.ID,
+		Event:     job.event.Type,
+		Udid:      job.event.Udid,
+		Status:    WebhookDeliveryPending,
+		CreatedAt: job.event.Timestamp,
+	}
+	select {
+	case w.queue <- job:
+	default:
+		delivery.Status = WebhookDeliveryDropped
+		delivery.Error = "delivery queue is full"
+		log.WithField("webhook", w.config.ID).Warnf("dropped %s event, delivery queue is full", job.event.Type)
+	}
+	w.record(delivery)
+}
+
+// record добавляет запись в журнал или обновляет её, если доставка уже записана.
+func (w *webhook) record(delivery WebhookDelivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := len(w.deliveries) - 1; i >= 0; i-- {
+		if w.deliveries[i].ID == delivery.ID {
+			w.deliveries[i] = delivery
+			return
+		}
+	}
+	w.deliveries = append(w.deliveries, delivery)
+	if len(w.deliveries) > webhookDeliveryLog {
+		w.deliveries = w.deliveries[len(w.deliveries)-webhookDeliveryLog:]
+	}
+}
+
+func (w *webhook) log() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WebhookDelivery{}, w.deliveries...)
+}
+
+// run доставляет события из очереди, пока вебхук не удалён.
+func (w *webhook) run() {
+	for {
+		select {
+		case <-w.stop:
+			return
+		case job := <-w.queue:
+			w.deliver(job)
+		}
+	}
+}
+
+// deliver отправляет событие с повторами: пауза удваивается от webhookFirstBackoff до webhookMaxBackoff.
+// Успешной считается доставка с ответом 2xx.
+func (w *webhook) deliver(job webhookJob) {
+	delivery := WebhookDelivery{
+		ID:        job.event.ID,
+		Event:     job.event.Type,
+		Udid:      job.event.Udid,
+		Status:    WebhookDeliveryPending,
+		CreatedAt: job.event.Timestamp,
+	}
+	backoff := webhookFirstBackoff
+	for delivery.Attempts < webhookMaxAttempts {
+		delivery.Attempts++
+		code, err := w.post(job)
+		delivery.StatusCode = code
+		if err == nil {
+			now := time.Now().UTC()
+			delivery.Status = WebhookDeliveryDelivered
+			delivery.Error = ""
+			delivery.DeliveredAt = &now
+			w.record(delivery)
+			return
+		}
+		delivery.Error = err.Error()
+		w.record(delivery)
+		if delivery.Attempts == webhookMaxAttempts {
+			break
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+	delivery.Status = WebhookDeliveryFailed
+	w.record(delivery)
+	log.WithField("webhook", w.config.ID).Warnf("failed delivering %s event %s: %s", job.event.Type, job.event.ID, delivery.Error)
+}
+
+// post отправляет тело события с подписью HMAC-SHA256 в заголовке X-Goios-Signature: sha256=<hex>.
+func (w *webhook) post(job webhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goios-Event", job.event.Type)
+	req.Header.Set("X-Goios-Delivery", job.event.ID)
+	req.Header.Set(webhookSignatureHead, "sha256="+signWebhookBody(w.config.Secret, job.body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateWebhookConfig проверяет адрес и типы событий.
+func validateWebhookConfig(config WebhookConfig) error {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if len(config.Events) == 0 {
+		return fmt.Errorf("events must not be empty, supported: %v", webhookEventTypes)
+	}
+	for _, event := range config.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			return fmt.Errorf("unknown event %q, supported: %v", event, webhookEventTypes)
+		}
+	}
+	return nil
+}
+
+func findWebhook(id string) (*webhook, bool) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	w, ok := webhooks[id]
+	return w, ok
+}
+
+// appStateFeeds — устройства, поток состояний приложений которых удерживается для вебхуков app.state.
+var (
+	appStateFeedsMu sync.Mutex
+	appStateFeeds   = make(map[string]bool)
+)
+
+// wantsAppState сообщает, подписан ли хоть один вебхук на app.state устройства udid.
+func wantsAppState(udid string) bool {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	for _, w := range webhooks {
+		if w.wants(EventAppState, udid) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureAppStateFollowers удерживает поток состояний приложений на подключённых устройствах,
+// на которые подписаны вебхуки, и отпускает его на остальных.
+func ensureAppStateFollowers() {
+	attached := attachedDevices()
+	appStateFeedsMu.Lock()
+	defer appStateFeedsMu.Unlock()
+	for udid := range appStateFeeds {
+		if !slices.Contains(attached, udid) || !wantsAppState(udid) {
+			releaseBusFeed(EventAppState, udid)
+			delete(appStateFeeds, udid)
+		}
+	}
+	for _, udid := range attached {
+		if !appStateFeeds[udid] && wantsAppState(udid) {
+			retainBusFeed(EventAppState, udid)
+			appStateFeeds[udid] = true
+		}
+	}
+}
+
+func releaseAppStateFeed(udid string) {
+	appStateFeedsMu.Lock()
+	defer appStateFeedsMu.Unlock()
+	if appStateFeeds[udid] {
+		releaseBusFeed(EventAppState, udid)
+		delete(appStateFeeds, udid)
+	}
+}
+
+// CreateWebhook godoc
+// @Summary      Зарегистрировать вебхук
+// @Description  Регистрирует URL, на который peer отправляет POST с WebhookEvent для событий: device.attached, device.detached, app.state, wda.session, ddi.mount. Тело подписывается HMAC-SHA256 секретом, подпись передаётся в заголовке X-Goios-Signature как sha256=<hex>. Неудачные доставки повторяются до 5 раз с растущей паузой. Если секрет не задан, он генерируется и возвращается только в этом ответе.
+// @Tags         webhooks
+// @Accept       json
+// @Produce      json
+// @Param        webhook  body  WebhookConfig  true  "Параметры вебхука"
+// @Success      201  {object}  Webhook
+// @Failure      422  {object}  GenericResponse
+// @Router       /webhooks [post]
+func CreateWebhook(c *gin.Context) {
+	var config WebhookConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := validateWebhookConfig(config); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if config.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		config.Secret = hex.EncodeToString(secret)
+	}
+	w := &webhook{
+		config: Webhook{
+			ID:        uuid.New().String(),
+			URL:       config.URL,
+			Events:    slices.Compact(slices.Sorted(slices.Values(config.Events))),
+			Udids:     config.Udids,
+			Secret:    config.Secret,
+			CreatedAt: time.Now().UTC(),
+		},
+		queue: make(chan webhookJob, webhookQueueSize),
+		stop:  make(chan struct{}),
+	}
+	webhooksMu.Lock()
+	webhooks[w.config.ID] = w
+	webhooksMu.Unlock()
+	go w.run()
+	ensureAppStateFollowers()
+	log.WithField("webhook", w.config.ID).Infof("webhook registered for %v at %s", w.config.Events, w.config.URL)
+	c.JSON(http.StatusCreated, w.config)
+}
+
+// ListWebhooks godoc
+// @Summary      Список вебхуков
+// @Tags         webhooks
+// @Produce      json
+// @Success      200  {array}  Webhook
+// @Router       /webhooks [get]
+func ListWebhooks(c *gin.Context) {
+	webhooksMu.Lock()
+	list := make([]Webhook, 0, len(webhooks))
+	for _, w := range webhooks {
+		config := w.config
+		config.Secret = ""
+		list = append(list, config)
+	}
+	webhooksMu.Unlock()
+	slices.SortFunc(list, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	c.JSON(http.StatusOK, list)
+}
+
+// DeleteWebhook godoc
+// @Summary      Удалить вебхук
+// @Description  Удаляет вебхук; события, которые ещё ждут доставки, не отправляются.
+// @Tags         webhooks
+// @Produce      json
+// @Param        id  path      string  true  "Идентификатор вебхука"
+// @Success      200  {object}  GenericResponse
+// @Failure      404  {object}  GenericResponse
+// @Router       /webhooks/{id} [delete]
+func DeleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+	webhooksMu.Lock()
+	w, ok := webhooks[id]
+	delete(webhooks, id)
+	webhooksMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "webhook not found"})
+		return
+	}
+	close(w.stop)
+	ensureAppStateFollowers()
+	c.JSON(http.StatusOK, GenericResponse{Message: "webhook deleted"})
+}
+
+// ListWebhookDeliveries godoc
+// @Summary      Журнал доставок вебхука
+// @Description  Последние 200 доставок от старых к новым: статус, число попыток, код ответа и последняя ошибка.
+// @Tags         webhooks
+// @Produce      json
+// @Param        id  path      string  true  "Идентификатор вебхука"
+// @Success      200  {array}  WebhookDelivery
+// @Failure      404  {object}  GenericResponse
+// @Router       /webhooks/{id}/deliveries [get]
+func ListWebhookDeliveries(c *gin.Context) {
+	w, ok := findWebhook(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, w.log())
+}
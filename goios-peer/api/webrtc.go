@@ -0,0 +1,370 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	log "github.com/sirupsen/logrus"
+	"goios-peer/vp8"
+)
+
+const (
+	// defaultWebRTCMaxWidth ограничивает ширину видео, если клиент не задал maxWidth:
+	// кодировщик VP8 работает на CPU, и полноразмерный экран заметно снижает частоту кадров.
+	defaultWebRTCMaxWidth = 720
+	// webrtcJPEGQuality — качество промежуточного JPEG из StreamManager. Итоговое качество
+	// видео задаётся параметром quality и применяется в кодировщике VP8.
+	webrtcJPEGQuality = 95
+	// webrtcGatherTimeout ограничивает сбор ICE-кандидатов перед ответом на предложение.
+	webrtcGatherTimeout = 5 * time.Second
+	// webrtcConnectTimeout — сколько сессия ждёт соединения после ответа, прежде чем закрыться.
+	webrtcConnectTimeout = 30 * time.Second
+	// webrtcKeyFrameInterval — как часто отправляется ключевой кадр, даже если браузер его не запрашивал.
+	webrtcKeyFrameInterval = 5 * time.Second
+)
+
+// errInvalidOffer — предложение, на которое нельзя ответить.
+var errInvalidOffer = errors.New("invalid webrtc offer")
+
+// WebRTCOffer — SDP-предложение браузера.
+type WebRTCOffer struct {
+	Type string `json:"type" binding:"required"`
+	SDP  string `json:"sdp" binding:"required"`
+}
+
+// WebRTCAnswer — SDP-ответ сервера со всеми ICE-кандидатами и идентификатор сессии для её закрытия.
+type WebRTCAnswer struct {
+	SessionID string `json:"sessionId"`
+	Type      string `json:"type"`
+	SDP       string `json:"sdp"`
+}
+
+// webrtcEnabled сообщает, включён ли WebRTC переменной WEBRTC_ENABLED=true.
+func webrtcEnabled() bool {
+	return os.Getenv("WEBRTC_ENABLED") == "true"
+}
+
+// webrtcSession — одно подключение WebRTC: видеодорожка экрана и канал данных для ввода.
+type webrtcSession struct {
+	id      string
+	device  ios.DeviceEntry
+	pc      *webrtc.PeerConnection
+	track   *webrtc.TrackLocalStaticSample
+	control *controlSession
+	// keyFrame выставляется, когда браузер потерял кадры и запросил ключевой (PLI или FIR).
+	keyFrame atomic.Bool
+
+	connectOnce sync.Once
+	connected   chan struct{}
+	closeOnce   sync.Once
+	done        chan struct{}
+}
+
+var (
+	webrtcSessionsMu sync.Mutex
+	webrtcSessions   = make(map[string]*webrtcSession)
+)
+
+// close закрывает соединение и убирает сессию из списка. Вызывается из любой горутины сессии.
+func (s *webrtcSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		webrtcSessionsMu.Lock()
+		delete(webrtcSessions, s.id)
+		webrtcSessionsMu.Unlock()
+		if err := s.pc.Close(); err != nil {
+			log.WithField("udid", s.device.Properties.SerialNumber).WithError(err).Debug("failed closing peer connection")
+		}
+		log.WithField("udid", s.device.Properties.SerialNumber).Infof("webrtc session %s closed", s.id)
+	})
+}
+
+// awaitConnection закрывает сессию, если соединение не установилось за webrtcConnectTimeout.
+func (s *webrtcSession) awaitConnection() {
+	select {
+	case <-s.connected:
+	case <-s.done:
+	case <-time.After(webrtcConnectTimeout):
+		log.WithField("udid", s.device.Properties.SerialNumber).Warnf("webrtc session %s did not connect in %s", s.id, webrtcConnectTimeout)
+		s.close()
+	}
+}
+
+// readRTCP вычитывает RTCP отправителя: без этого не работают перехватчики pion (NACK, отчёты).
+// Запросы ключевого кадра передаются кодировщику.
+func (s *webrtcSession) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.keyFrame.Store(true)
+			}
+		}
+	}
+}
+
+// stream кодирует кадры StreamManager в VP8 и отправляет их в видеодорожку.
+// Если кодировщик не успевает, отправляется только самый свежий кадр. Между ключевыми
+// кадрами передаются только изменения, поэтому ключевой кадр отправляется по запросу
+// браузера и не реже раза в webrtcKeyFrameInterval.
+func (s *webrtcSession) stream(ch chan StreamFrame, period time.Duration, quality int) {
+	defer s.close()
+	encoder := vp8.NewEncoder(quality)
+	var last time.Time
+	lastKeyFrame := time.Now()
+	for {
+		var frame StreamFrame
+		select {
+		case <-s.done:
+			return
+		case f, ok := <-ch:
+			if !ok {
+				return
+			}
+			frame = f
+		}
+	drain:
+		for {
+			select {
+			case f, ok := <-ch:
+				if !ok {
+					return
+				}
+				frame = f
+			default:
+				break drain
+			}
+		}
+		s.control.rememberFrameSize(frame)
+
+		img, err := jpeg.Decode(bytes.NewReader(frame.JPEG))
+		if err != nil {
+			log.Warnf("failed decoding jpg %v", err)
+			continue
+		}
+		if s.keyFrame.Swap(false) || time.Since(lastKeyFrame) >= webrtcKeyFrameInterval {
+			encoder.ForceKeyFrame()
+			lastKeyFrame = time.Now()
+		}
+		data, err := encoder.Encode(img)
+		if err != nil {
+			log.Warnf("failed encoding vp8 %v", err)
+			continue
+		}
+		duration := period
+		if !last.IsZero() && frame.CapturedAt.After(last) {
+			duration = frame.CapturedAt.Sub(last)
+		}
+		last = frame.CapturedAt
+		if err := s.track.WriteSample(media.Sample{Data: data, Duration: duration}); err != nil {
+			log.WithField("udid", s.device.Properties.SerialNumber).WithError(err).Warn("failed writing webrtc sample")
+			return
+		}
+	}
+}
+
+// handleMessage выполняет событие ввода из канала данных. Для событий, которые отправляются
+// в WDA, нужна активная сессия WDA; без неё ошибка возвращается клиенту в тот же канал.
+func (s *webrtcSession) handleMessage(dc *webrtc.DataChannel, msg webrtc.DataChannelMessage) {
+	var event ControlEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		sendDataChannelError(dc, fmt.Errorf("invalid control event: %w", err))
+		return
+	}
+	var client *wdaClient
+	switch event.Type {
+	case ControlEventUp, ControlEventText, ControlEventHome:
+		var err error
+		client, err = wdaClientForDevice(s.device)
+		if err != nil {
+			s.control.takeGesture()
+			sendDataChannelError(dc, err)
+			return
+		}
+	}
+	if err := s.control.handleEvent(client, event); err != nil {
+		sendDataChannelError(dc, err)
+	}
+}
+
+func sendDataChannelError(dc *webrtc.DataChannel, err error) {
+	dc.SendText(MustMarshal(ControlMessage{Type: "error", Message: err.Error()}))
+}
+
+// WebRTCOfferHandler godoc
+// @Summary      Поток экрана через WebRTC
+// @Description  Принимает SDP-предложение браузера и возвращает ответ. Сервер отправляет экран видеодорожкой VP8 и принимает события ввода (как в /control) через канал данных, созданный браузером. Используются только локальные host-кандидаты, STUN и TURN не нужны. Сессия закрывается, если соединение не установилось за 30 секунд или разорвано. Доступно при WEBRTC_ENABLED=true.
+// @Tags         stream
+// @Accept       json
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        offer  body  WebRTCOffer  true  "SDP-предложение"
+// @Param        fps  query  int  false  "Частота кадров, 1-30, по умолчанию 10"
+// @Param        quality  query  int  false  "Качество видео, 1-100, по умолчанию 80"
+// @Param        maxWidth  query  int  false  "Максимальная ширина кадра, по умолчанию 720"
+// @Param        maxHeight  query  int  false  "Максимальная высота кадра"
+// @Param        grayscale  query  bool  false  "Кадры в оттенках серого"
+// @Success      200  {object}  WebRTCAnswer
+// @Failure      422  {object}  GenericResponse
+// @Failure      500  {object}  GenericResponse
+// @Router       /device/{udid}/webrtc/offer [post]
+func WebRTCOfferHandler(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	opts, err := parseStreamOptions(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if c.Query("maxWidth") == "" {
+		opts.MaxWidth = defaultWebRTCMaxWidth
+	}
+	quality := opts.Quality
+	opts.Quality = webrtcJPEGQuality
+
+	var offer WebRTCOffer
+	if err := c.ShouldBindJSON(&offer); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if offer.Type != webrtc.SDPTypeOffer.String() {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: "type must be offer"})
+		return
+	}
+
+	session, err := newWebRTCSession(device, offer.SDP)
+	if errors.Is(err, errInvalidOffer) {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	sm := getStreamManager(device)
+	ch := sm.AddClient(opts)
+	go func() {
+		defer sm.RemoveClient(ch)
+		session.stream(ch, opts.period(), quality)
+	}()
+
+	log.WithField("udid", udid).Infof("webrtc session %s started with %+v", session.id, opts)
+	local := session.pc.LocalDescription()
+	c.JSON(http.StatusOK, WebRTCAnswer{SessionID: session.id, Type: local.Type.String(), SDP: local.SDP})
+}
+
+// newWebRTCSession создаёт соединение по SDP-предложению и собирает ICE-кандидаты для ответа,
+// который возвращает pc.LocalDescription. Сессия регистрируется до сбора кандидатов, чтобы её
+// можно было закрыть в любой момент, и закрывается, если соединение не установилось
+// за webrtcConnectTimeout или было разорвано.
+func newWebRTCSession(device ios.DeviceEntry, offer string) (*webrtcSession, error) {
+	udid := device.Properties.SerialNumber
+	// Без ICE-серверов собираются только host-кандидаты.
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "screen", udid)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	session := &webrtcSession{
+		id:        uuid.New().String(),
+		device:    device,
+		pc:        pc,
+		track:     track,
+		control:   &controlSession{},
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	webrtcSessionsMu.Lock()
+	webrtcSessions[session.id] = session
+	webrtcSessionsMu.Unlock()
+
+	go session.readRTCP(sender)
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			session.handleMessage(dc, msg)
+		})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.WithField("udid", udid).Debugf("webrtc session %s state %s", session.id, state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			session.connectOnce.Do(func() { close(session.connected) })
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go session.close()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		session.close()
+		return nil, fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		session.close()
+		return nil, fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		session.close()
+		return nil, err
+	}
+	select {
+	case <-gathered:
+	case <-session.done:
+		return nil, fmt.Errorf("webrtc session %s closed during ICE gathering", session.id)
+	case <-time.After(webrtcGatherTimeout):
+		log.WithField("udid", udid).Warn("webrtc ice gathering timed out, answering with the candidates found so far")
+	}
+	go session.awaitConnection()
+	return session, nil
+}
+
+// DeleteWebRTCSession godoc
+// @Summary      Закрыть сессию WebRTC
+// @Tags         stream
+// @Produce      json
+// @Param        udid  path      string  true  "UDID устройства"
+// @Param        sessionId  path      string  true  "Идентификатор сессии"
+// @Success      200  {object}  GenericResponse
+// @Failure      404  {object}  GenericResponse
+// @Router       /device/{udid}/webrtc/{sessionId} [delete]
+func DeleteWebRTCSession(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	webrtcSessionsMu.Lock()
+	session, ok := webrtcSessions[c.Param("sessionId")]
+	webrtcSessionsMu.Unlock()
+	if !ok || session.device.Properties.SerialNumber != device.Properties.SerialNumber {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "webrtc session not found"})
+		return
+	}
+	session.close()
+	c.JSON(http.StatusOK, GenericResponse{Message: "webrtc session closed"})
+}
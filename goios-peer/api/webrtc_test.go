@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/pion/webrtc/v4"
+)
+
+func findWebRTCSession(id string) bool {
+	webrtcSessionsMu.Lock()
+	defer webrtcSessionsMu.Unlock()
+	_, ok := webrtcSessions[id]
+	return ok
+}
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// TestWebRTCLoopback соединяет клиент pion с сессией на локальных host-кандидатах и проверяет,
+// что открывается канал данных, приходит видео, а после закрытия клиента сессия удаляется.
+func TestWebRTCLoopback(t *testing.T) {
+	device := ios.DeviceEntry{Properties: ios.DeviceProperties{SerialNumber: "webrtc-loopback"}}
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	dc, err := client.CreateDataChannel("control", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	dc.OnOpen(func() { close(opened) })
+	received := make(chan string, 1)
+	client.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track.Codec().MimeType
+		}
+	})
+
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	session, err := newWebRTCSession(device, client.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.close()
+	if !findWebRTCSession(session.id) {
+		t.Fatal("session is not registered")
+	}
+	if err := client.SetRemoteDescription(*session.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(chan StreamFrame)
+	go session.stream(frames, 100*time.Millisecond, 80)
+	frame := StreamFrame{Width: 64, Height: 48, SourceWidth: 64, SourceHeight: 48, JPEG: testJPEG(t, 64, 48)}
+	timeout := time.After(20 * time.Second)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case mime := <-received:
+			if mime != webrtc.MimeTypeVP8 {
+				t.Fatalf("track codec %s, want %s", mime, webrtc.MimeTypeVP8)
+			}
+			done = true
+		case <-ticker.C:
+			frame.Seq++
+			frame.CapturedAt = time.Now()
+			select {
+			case frames <- frame:
+			case <-session.done:
+				t.Fatal("session closed before the video arrived")
+			}
+		case <-timeout:
+			t.Fatal("no video received over the loopback connection")
+		}
+	}
+	select {
+	case <-opened:
+	case <-timeout:
+		t.Fatal("data channel did not open")
+	}
+
+	client.Close()
+	select {
+	case <-session.done:
+	case <-time.After(40 * time.Second):
+		t.Fatal("session was not closed after the client disconnected")
+	}
+	if findWebRTCSession(session.id) {
+		t.Fatal("closed session is still registered")
+	}
+}
+
+func TestWebRTCInvalidOffer(t *testing.T) {
+	device := ios.DeviceEntry{Properties: ios.DeviceProperties{SerialNumber: "webrtc-invalid"}}
+	_, err := newWebRTCSession(device, "not an sdp")
+	if !errors.Is(err, errInvalidOffer) {
+		t.Fatalf("newWebRTCSession error = %v, want errInvalidOffer", err)
+	}
+	webrtcSessionsMu.Lock()
+	defer webrtcSessionsMu.Unlock()
+	for _, session := range webrtcSessions {
+		if session.device.Properties.SerialNumber == device.Properties.SerialNumber {
+			t.Fatal("session of a rejected offer is still registered")
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package avi
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// MJPEGWriter пишет последовательность JPEG-кадров в контейнер AVI (RIFF) с кодеком MJPG.
+// AVI хранит кадры с постоянной частотой, поэтому реальное время кадров сохраняется так:
+// кадр кладётся в слот, соответствующий его времени, а пропущенные слоты заполняются
+// пустыми чанками, которые плееры показывают как повтор предыдущего кадра.
+type MJPEGWriter struct {
+	w   io.WriteSeeker
+	fps int
+
+	width  int
+	height int
+
+	headerWritten bool
+	riffSizePos   int64
+	totalFramesAt int64
+	lengthAt      int64
+	moviSizePos   int64
+	moviStart     int64
+	pos           int64
+
+	slots   int
+	frames  int
+	index   []indexEntry
+	maxLen  uint32
+	maxSize int64
+}
+
+type indexEntry struct {
+	flags  uint32
+	offset uint32
+	size   uint32
+}
+
+const (
+	avifHasIndex  = 0x10
+	aviifKeyframe = 0x10
+)
+
+// MaxFileSize — предел размера файла: смещения и размеры в AVI 1.0 (RIFF без OpenDML)
+// 32-битные, а многие плееры не читают RIFF больше 1 ГБ.
+const MaxFileSize = 1 << 30
+
+var ErrClosed = errors.New("avi: writer is closed")
+
+// ErrFileTooLarge возвращается, когда кадр не помещается в MaxFileSize вместе с индексом.
+// Записанное до этого остаётся целым, его можно закрыть через Close.
+var ErrFileTooLarge = errors.New("avi: file size limit reached")
+
+// NewMJPEGWriter создаёт writer с номинальной частотой fps. Заголовки пишутся при первом кадре,
+// когда становится известен размер изображения.
+func NewMJPEGWriter(w io.WriteSeeker, fps int) *MJPEGWriter {
+	if fps <= 0 {
+		fps = 10
+	}
+	return &MJPEGWriter{w: w, fps: fps, maxSize: MaxFileSize}
+}
+
+// Frames возвращает число реальных (непустых) кадров.
+func (m *MJPEGWriter) Frames() int {
+	return m.frames
+}
+
+// Duration возвращает длительность записанного видео.
+func (m *MJPEGWriter) Duration() time.Duration {
+	return time.Duration(m.slots) * time.Second / time.Duration(m.fps)
+}
+
+// WriteFrame записывает JPEG-кадр, снятый через at после начала записи.
+// Кадр, попавший в уже занятый слот, отбрасывается. Если файл дошёл бы до MaxFileSize,
+// возвращается ErrFileTooLarge.
+func (m *MJPEGWriter) WriteFrame(jpeg []byte, width int, height int, at time.Duration) error {
+	if m.w == nil {
+		return ErrClosed
+	}
+	if !m.headerWritten {
+		m.width, m.height = width, height
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+	}
+	slot := m.slotAt(at)
+	if slot < m.slots {
+		return nil
+	}
+	if err := m.fillTo(slot); err != nil {
+		return err
+	}
+	if err := m.writeChunk(jpeg, aviifKeyframe); err != nil {
+		return err
+	}
+	m.frames++
+	return nil
+}
+
+// Extend продлевает показ последнего кадра до момента at, например до времени остановки записи,
+// если экран перед этим не менялся.
+func (m *MJPEGWriter) Extend(at time.Duration) error {
+	if m.w == nil {
+		return ErrClosed
+	}
+	if !m.headerWritten {
+		return nil
+	}
+	return m.fillTo(m.slotAt(at))
+}
+
+func (m *MJPEGWriter) slotAt(at time.Duration) int {
+	return int(at * time.Duration(m.fps) / time.Second)
+}
+
+// fillTo дописывает пустые чанки до слота slot (не включая его).
+func (m *MJPEGWriter) fillTo(slot int) error {
+	for m.slots < slot {
+		if err := m.writeChunk(nil, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close дописывает индекс, исправляет размеры в заголовках и закрывает запись.
+// Нижележащий io.WriteSeeker не закрывается.
+func (m *MJPEGWriter) Close() error {
+	if m.w == nil {
+		return ErrClosed
+	}
+	defer func() { m.w = nil }()
+	if !m.headerWritten {
+		return nil
+	}
+
+	moviEnd := m.pos
+	idx := make([]byte, 0, 8+16*len(m.index))
+	idx = append(idx, "idx1"...)
+	idx = binary.LittleEndian.AppendUint32(idx, uint32(16*len(m.index)))
+	for _, e := range m.index {
+		idx = append(idx, "00dc"...)
+		idx = binary.LittleEndian.AppendUint32(idx, e.flags)
+		idx = binary.LittleEndian.AppendUint32(idx, e.offset)
+		idx = binary.LittleEndian.AppendUint32(idx, e.size)
+	}
+	if err := m.write(idx); err != nil {
+		return err
+	}
+	end := m.pos
+
+	patches := []struct {
+		at    int64
+		value uint32
+	}{
+		{m.riffSizePos, uint32(end - 8)},
+		{m.totalFramesAt, uint32(m.slots)},
+		{m.lengthAt, uint32(m.slots)},
+		{m.moviSizePos, uint32(moviEnd - m.moviSizePos - 4)},
+		{m.suggestedBufferAt(), m.maxLen},
+	}
+	for _, p := range patches {
+		if _, err := m.w.Seek(p.at, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(m.w, binary.LittleEndian, p.value); err != nil {
+			return err
+		}
+	}
+	_, err := m.w.Seek(end, io.SeekStart)
+	return err
+}
+
+// suggestedBufferAt — смещение поля dwSuggestedBufferSize в заголовке strh.
+func (m *MJPEGWriter) suggestedBufferAt() int64 {
+	return m.lengthAt + 4
+}
+
+func (m *MJPEGWriter) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.pos += int64(n)
+	return err
+}
+
+func (m *MJPEGWriter) writeChunk(data []byte, flags uint32) error {
+	// Место под индекс с записью этого чанка резервируется заранее, чтобы Close всегда помещался.
+	chunkSize := int64(8 + len(data) + len(data)%2)
+	if m.pos+chunkSize+8+16*int64(len(m.index)+1) > m.maxSize {
+		return ErrFileTooLarge
+	}
+	offset := m.pos - m.moviStart
+	chunk := make([]byte, 0, 8+len(data)+1)
+	chunk = append(chunk, "00dc"...)
+	chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	if err := m.write(chunk); err != nil {
+		return err
+	}
+	m.index = append(m.index, indexEntry{flags: flags, offset: uint32(offset), size: uint32(len(data))})
+	m.maxLen = max(m.maxLen, uint32(len(data)))
+	m.slots++
+	return nil
+}
+
+// writeHeader пишет RIFF/hdrl и начало LIST movi. Поля, зависящие от числа кадров, исправляются в Close.
+func (m *MJPEGWriter) writeHeader() error {
+	u32 := binary.LittleEndian.AppendUint32
+	u16 := binary.LittleEndian.AppendUint16
+	var h []byte
+
+	h = append(h, "RIFF"...)
+	m.riffSizePos = int64(len(h))
+	h = u32(h, 0)
+	h = append(h, "AVI "...)
+
+	h = append(h, "LIST"...)
+	h = u32(h, 4+(8+56)+(8+4+(8+56)+(8+40)))
+	h = append(h, "hdrl"...)
+
+	h = append(h, "avih"...)
+	h = u32(h, 56)
+	h = u32(h, uint32(1000000/m.fps)) // dwMicroSecPerFrame
+	h = u32(h, 0)                     // dwMaxBytesPerSec
+	h = u32(h, 0)                     // dwPaddingGranularity
+	h = u32(h, avifHasIndex)          // dwFlags
+	m.totalFramesAt = int64(len(h))
+	h = u32(h, 0) // dwTotalFrames
+	h = u32(h, 0) // dwInitialFrames
+	h = u32(h, 1) // dwStreams
+	h = u32(h, 0) // dwSuggestedBufferSize
+	h = u32(h, uint32(m.width))
+	h = u32(h, uint32(m.height))
+	h = append(h, make([]byte, 16)...) // dwReserved
+
+	h = append(h, "LIST"...)
+	h = u32(h, 4+(8+56)+(8+40))
+	h = append(h, "strl"...)
+
+	h = append(h, "strh"...)
+	h = u32(h, 56)
+	h = append(h, "vids"...)
+	h = append(h, "MJPG"...)
+	h = u32(h, 0)             // dwFlags
+	h = u16(h, 0)             // wPriority
+	h = u16(h, 0)             // wLanguage
+	h = u32(h, 0)             // dwInitialFrames
+	h = u32(h, 1)             // dwScale
+	h = u32(h, uint32(m.fps)) // dwRate
+	h = u32(h, 0)             // dwStart
+	m.lengthAt = int64(len(h))
+	h = u32(h, 0)          // dwLength
+	h = u32(h, 0)          // dwSuggestedBufferSize
+	h = u32(h, 0xFFFFFFFF) // dwQuality
+	h = u32(h, 0)          // dwSampleSize
+	h = u16(h, 0)
+	h = u16(h, 0)
+	h = u16(h, uint16(m.width))
+	h = u16(h, uint16(m.height))
+
+	h = append(h, "strf"...)
+	h = u32(h, 40)
+	h = u32(h, 40) // biSize
+	h = u32(h, uint32(m.width))
+	h = u32(h, uint32(m.height))
+	h = u16(h, 1)  // biPlanes
+	h = u16(h, 24) // biBitCount
+	h = append(h, "MJPG"...)
+	h = u32(h, uint32(m.width*m.height*3)) // biSizeImage
+	h = u32(h, 0)
+	h = u32(h, 0)
+	h = u32(h, 0)
+	h = u32(h, 0)
+
+	h = append(h, "LIST"...)
+	m.moviSizePos = int64(len(h))
+	h = u32(h, 0)
+	m.moviStart = int64(len(h))
+	h = append(h, "movi"...)
+
+	if err := m.write(h); err != nil {
+		return err
+	}
+	m.headerWritten = true
+	return nil
+}
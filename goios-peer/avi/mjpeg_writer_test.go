@@ -0,0 +1,222 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func u32At(t *testing.T, data []byte, at int) uint32 {
+	t.Helper()
+	if at+4 > len(data) {
+		t.Fatalf("offset %d is beyond the file size %d", at, len(data))
+	}
+	return binary.LittleEndian.Uint32(data[at:])
+}
+
+func expectFourCC(t *testing.T, data []byte, at int, want string) {
+	t.Helper()
+	if got := string(data[at : at+4]); got != want {
+		t.Fatalf("fourcc at %d = %q, want %q", at, got, want)
+	}
+}
+
+func TestMJPEGWriterLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.avi")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	frameA := []byte{0xFF, 0xD8, 0x01, 0xFF, 0xD9} // нечётная длина — чанк дополняется нулём
+	frameB := []byte{0xFF, 0xD8, 0xFF, 0xD9}
+	w := NewMJPEGWriter(f, 10)
+	if err := w.WriteFrame(frameA, 320, 240, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrame(frameB, 320, 240, 250*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Слот 2 уже занят кадром B, этот кадр отбрасывается.
+	if err := w.WriteFrame(frameA, 320, 240, 260*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Extend(500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrame(frameA, 320, 240, time.Second); err != ErrClosed {
+		t.Fatalf("WriteFrame after Close = %v, want ErrClosed", err)
+	}
+	if w.Frames() != 2 {
+		t.Fatalf("Frames() = %d, want 2", w.Frames())
+	}
+	if w.Duration() != 500*time.Millisecond {
+		t.Fatalf("Duration() = %s, want 500ms", w.Duration())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Слоты: 0 — A, 1 — пустой, 2 — B, 3 и 4 — пустые до Extend(500ms).
+	const slots = 5
+
+	expectFourCC(t, data, 0, "RIFF")
+	if got := u32At(t, data, 4); int(got) != len(data)-8 {
+		t.Fatalf("RIFF size = %d, want %d", got, len(data)-8)
+	}
+	expectFourCC(t, data, 8, "AVI ")
+
+	expectFourCC(t, data, 12, "LIST")
+	hdrlSize := int(u32At(t, data, 16))
+	expectFourCC(t, data, 20, "hdrl")
+	hdrlEnd := 20 + hdrlSize
+
+	avih := 24
+	expectFourCC(t, data, avih, "avih")
+	if got := u32At(t, data, avih+4); got != 56 {
+		t.Fatalf("avih size = %d, want 56", got)
+	}
+	if got := u32At(t, data, avih+8); got != 100000 {
+		t.Fatalf("dwMicroSecPerFrame = %d, want 100000", got)
+	}
+	if got := u32At(t, data, avih+8+12); got&avifHasIndex == 0 {
+		t.Fatalf("avih flags = %#x, AVIF_HASINDEX is missing", got)
+	}
+	if got := u32At(t, data, avih+8+16); got != slots {
+		t.Fatalf("dwTotalFrames = %d, want %d", got, slots)
+	}
+	if w, h := u32At(t, data, avih+8+32), u32At(t, data, avih+8+36); w != 320 || h != 240 {
+		t.Fatalf("avih size = %dx%d, want 320x240", w, h)
+	}
+
+	strl := avih + 8 + 56
+	expectFourCC(t, data, strl, "LIST")
+	if got := 8 + int(u32At(t, data, strl+4)); strl+got != hdrlEnd {
+		t.Fatalf("LIST strl ends at %d, hdrl ends at %d", strl+got, hdrlEnd)
+	}
+	expectFourCC(t, data, strl+8, "strl")
+	strh := strl + 12
+	expectFourCC(t, data, strh, "strh")
+	if got := u32At(t, data, strh+4); got != 56 {
+		t.Fatalf("strh size = %d, want 56", got)
+	}
+	expectFourCC(t, data, strh+8, "vids")
+	expectFourCC(t, data, strh+12, "MJPG")
+	if scale, rate := u32At(t, data, strh+8+20), u32At(t, data, strh+8+24); scale != 1 || rate != 10 {
+		t.Fatalf("strh rate = %d/%d, want 10/1", rate, scale)
+	}
+	if got := u32At(t, data, strh+8+32); got != slots {
+		t.Fatalf("strh dwLength = %d, want %d", got, slots)
+	}
+	if got := u32At(t, data, strh+8+36); int(got) != len(frameA) {
+		t.Fatalf("strh dwSuggestedBufferSize = %d, want %d", got, len(frameA))
+	}
+	strf := strh + 8 + 56
+	expectFourCC(t, data, strf, "strf")
+	if strf+8+40 != hdrlEnd {
+		t.Fatalf("strf ends at %d, hdrl ends at %d", strf+8+40, hdrlEnd)
+	}
+
+	movi := hdrlEnd
+	expectFourCC(t, data, movi, "LIST")
+	moviEnd := movi + 8 + int(u32At(t, data, movi+4))
+	expectFourCC(t, data, movi+8, "movi")
+	moviStart := movi + 8
+
+	expectFourCC(t, data, moviEnd, "idx1")
+	if got := u32At(t, data, moviEnd+4); got != 16*slots {
+		t.Fatalf("idx1 size = %d, want %d", got, 16*slots)
+	}
+	if moviEnd+8+16*slots != len(data) {
+		t.Fatalf("idx1 ends at %d, file size is %d", moviEnd+8+16*slots, len(data))
+	}
+
+	want := [][]byte{frameA, nil, frameB, nil, nil}
+	next := moviStart + 4
+	for i, frame := range want {
+		entry := moviEnd + 8 + 16*i
+		expectFourCC(t, data, entry, "00dc")
+		flags, offset, size := u32At(t, data, entry+4), int(u32At(t, data, entry+8)), int(u32At(t, data, entry+12))
+		if moviStart+offset != next {
+			t.Fatalf("idx1[%d] points to %d, chunk is at %d", i, moviStart+offset, next)
+		}
+		if size != len(frame) {
+			t.Fatalf("idx1[%d] size = %d, want %d", i, size, len(frame))
+		}
+		if wantKey := frame != nil; (flags&aviifKeyframe != 0) != wantKey {
+			t.Fatalf("idx1[%d] flags = %#x, keyframe expected %v", i, flags, wantKey)
+		}
+		expectFourCC(t, data, next, "00dc")
+		if got := int(u32At(t, data, next+4)); got != len(frame) {
+			t.Fatalf("chunk %d size = %d, want %d", i, got, len(frame))
+		}
+		if !bytes.Equal(data[next+8:next+8+size], frame) {
+			t.Fatalf("chunk %d data does not match the frame", i)
+		}
+		next += 8 + size + size%2
+	}
+	if next != moviEnd {
+		t.Fatalf("movi chunks end at %d, LIST movi ends at %d", next, moviEnd)
+	}
+}
+
+func TestMJPEGWriterSizeLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limit.avi")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	const maxSize = 1024
+	frame := make([]byte, 100)
+	w := NewMJPEGWriter(f, 10)
+	w.maxSize = maxSize
+	written := 0
+	for i := 0; ; i++ {
+		err := w.WriteFrame(frame, 320, 240, time.Duration(i)*100*time.Millisecond)
+		if err == ErrFileTooLarge {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		written++
+		if i > maxSize {
+			t.Fatal("writer did not stop at the size limit")
+		}
+	}
+	if written == 0 {
+		t.Fatal("no frames fit under the limit")
+	}
+	if err := w.Extend(time.Hour); err != ErrFileTooLarge {
+		t.Fatalf("Extend past the limit = %v, want ErrFileTooLarge", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxSize {
+		t.Fatalf("file size %d exceeds the limit %d", len(data), maxSize)
+	}
+	if got := u32At(t, data, 4); int(got) != len(data)-8 {
+		t.Fatalf("RIFF size = %d, want %d", got, len(data)-8)
+	}
+	if w.Frames() != written {
+		t.Fatalf("Frames() = %d, want %d", w.Frames(), written)
+	}
+	idx1 := len(data) - 8 - 16*w.slots
+	expectFourCC(t, data, idx1, "idx1")
+}
@@ -18,6 +18,6 @@ func ConvertToJSONString(data interface{}) string {
 
 func ExitIfError(msg string, err error) {
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Fatalf(msg)
+		log.WithFields(log.Fields{"err": err}).Fatal(msg)
 	}
 }
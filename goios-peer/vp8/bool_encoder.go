@@ -0,0 +1,74 @@
+package vp8
+
+// boolEncoder — арифметический кодер булевых значений из раздела 7 RFC 6386.
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder(capacity int) *boolEncoder {
+	return &boolEncoder{out: make([]byte, 0, capacity), rng: 255, bitCount: 24}
+}
+
+// addOne переносит единицу в уже записанные байты.
+func (e *boolEncoder) addOne() {
+	i := len(e.out) - 1
+	for i >= 0 && e.out[i] == 255 {
+		e.out[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.out[i]++
+	}
+}
+
+// writeBool кодирует bit, для которого вероятность нуля равна prob/256.
+func (e *boolEncoder) writeBool(prob uint8, bit bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeLiteral пишет n младших битов v, начиная со старшего, с вероятностью 1/2.
+func (e *boolEncoder) writeLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.writeBool(128, v&(1<<uint(i)) != 0)
+	}
+}
+
+// flush дописывает оставшиеся биты и возвращает закодированные данные.
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.addOne()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
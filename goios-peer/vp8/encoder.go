@@ -0,0 +1,503 @@
+package vp8
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+)
+
+// MaxSize — максимальная ширина и высота кадра VP8.
+const MaxSize = 1<<14 - 1
+
+// ErrInvalidSize возвращается для пустого кадра или кадра больше MaxSize.
+var ErrInvalidSize = errors.New("vp8: invalid frame size")
+
+// Режимы предсказания 16x16 и 8x8.
+const (
+	predDC = iota
+	predVE
+	predHE
+	predTM
+	nPredModes
+)
+
+// Encoder кодирует изображения в поток VP8 (RFC 6386). Первый кадр и кадр после смены размера
+// или ForceKeyFrame — ключевые, остальные — межкадровые: макроблок либо предсказывается
+// из того же места предыдущего кадра (нулевой вектор движения), либо кодируется внутрикадрово.
+// Для экрана этого достаточно: неизменившиеся области передаются почти бесплатно.
+// Используются только режимы предсказания 16x16 и 8x8 без фильтра деблокинга.
+// Encoder не потокобезопасен, но переиспользует буферы между кадрами.
+type Encoder struct {
+	qi    int
+	quant quantizer
+
+	width, height int
+	mbw, mbh      int
+
+	// Исходные и восстановленные плоскости, дополненные до целого числа макроблоков.
+	// ref — восстановленный предыдущий кадр, из которого предсказываются межкадровые макроблоки,
+	// last — его исходные пиксели: макроблок, который не изменился, пропускается без остатка.
+	src, rec, ref, last planes
+	hasRef              bool
+	forceKey            bool
+	mbs                 []macroblock
+}
+
+type planes struct {
+	y, u, v          []uint8
+	yStride, cStride int
+}
+
+type quantizer struct {
+	y1, y2, uv [2]int32
+}
+
+// macroblock хранит выбранные режимы и квантованные коэффициенты в порядке обхода:
+// блоки 0-15 — яркость, 16-19 — U, 20-23 — V, 24 — Y2. inter означает предсказание
+// из предыдущего кадра с нулевым вектором, тогда yMode и uvMode не используются.
+type macroblock struct {
+	inter  bool
+	yMode  uint8
+	uvMode uint8
+	skip   bool
+	levels [25][16]int16
+}
+
+// NewEncoder создаёт кодировщик с качеством от 1 до 100.
+func NewEncoder(quality int) *Encoder {
+	quality = min(max(quality, 1), 100)
+	qi := (100 - quality) * 127 / 99
+	e := &Encoder{qi: qi}
+	e.quant.y1 = [2]int32{int32(dequantTableDC[qi]), int32(dequantTableAC[qi])}
+	e.quant.y2 = [2]int32{int32(dequantTableDC[qi]) * 2, max(int32(dequantTableAC[qi])*155/100, 8)}
+	e.quant.uv = [2]int32{int32(dequantTableDC[min(qi, 117)]), int32(dequantTableAC[qi])}
+	return e
+}
+
+// ForceKeyFrame делает следующий кадр ключевым, например когда получатель потерял пакеты.
+func (e *Encoder) ForceKeyFrame() {
+	e.forceKey = true
+}
+
+// Encode кодирует img в очередной кадр потока. Размер кадра может меняться между вызовами,
+// кадр нового размера всегда ключевой.
+func (e *Encoder) Encode(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > MaxSize || b.Dy() > MaxSize {
+		return nil, ErrInvalidSize
+	}
+	e.resize(b.Dx(), b.Dy())
+	e.load(img)
+	key := e.forceKey || !e.hasRef
+	e.forceKey = false
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby, &e.mbs[mby*e.mbw+mbx], key)
+		}
+	}
+	data := e.write(key)
+	e.rec, e.ref = e.ref, e.rec
+	e.src, e.last = e.last, e.src
+	e.hasRef = true
+	return data, nil
+}
+
+func (e *Encoder) resize(width, height int) {
+	if e.width == width && e.height == height {
+		return
+	}
+	e.width, e.height = width, height
+	e.mbw, e.mbh = (width+15)/16, (height+15)/16
+	e.src = newPlanes(e.mbw, e.mbh)
+	e.rec = newPlanes(e.mbw, e.mbh)
+	e.ref = newPlanes(e.mbw, e.mbh)
+	e.last = newPlanes(e.mbw, e.mbh)
+	e.hasRef = false
+	e.mbs = make([]macroblock, e.mbw*e.mbh)
+}
+
+func newPlanes(mbw, mbh int) planes {
+	return planes{
+		y:       make([]uint8, mbw*16*mbh*16),
+		u:       make([]uint8, mbw*8*mbh*8),
+		v:       make([]uint8, mbw*8*mbh*8),
+		yStride: mbw * 16,
+		cStride: mbw * 8,
+	}
+}
+
+// Таблицы перевода из полного диапазона JPEG в ограниченный диапазон BT.601, который ожидают декодеры VP8.
+var lumaRange, chromaRange [256]uint8
+
+func init() {
+	for i := range lumaRange {
+		lumaRange[i] = uint8(16 + (i*219+127)/255)
+		chromaRange[i] = uint8(128 + ((i-128)*224+127*sign(i-128))/255)
+	}
+}
+
+func sign(v int) int {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+// load переводит img в плоскости YUV 4:2:0 и дополняет их повтором крайних пикселей.
+func (e *Encoder) load(img image.Image) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cw, ch := (w+1)/2, (h+1)/2
+	p := &e.src
+	switch m := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			row := m.Y[m.YOffset(b.Min.X, b.Min.Y+y):]
+			dst := p.y[y*p.yStride:]
+			for x := 0; x < w; x++ {
+				dst[x] = lumaRange[row[x]]
+			}
+		}
+		for y := 0; y < ch; y++ {
+			for x := 0; x < cw; x++ {
+				i := m.COffset(b.Min.X+2*x, b.Min.Y+2*y)
+				p.u[y*p.cStride+x] = chromaRange[m.Cb[i]]
+				p.v[y*p.cStride+x] = chromaRange[m.Cr[i]]
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < h; y++ {
+			row := m.Pix[m.PixOffset(b.Min.X, b.Min.Y+y):]
+			dst := p.y[y*p.yStride:]
+			for x := 0; x < w; x++ {
+				dst[x] = lumaRange[row[x]]
+			}
+		}
+		for y := 0; y < ch; y++ {
+			for x := 0; x < cw; x++ {
+				p.u[y*p.cStride+x] = 128
+				p.v[y*p.cStride+x] = 128
+			}
+		}
+	default:
+		for y := 0; y < ch; y++ {
+			for x := 0; x < cw; x++ {
+				// Цветность берётся из среднего цвета квадрата 2x2.
+				var sr, sg, sb, n uint32
+				for dy := 0; dy < 2 && 2*y+dy < h; dy++ {
+					for dx := 0; dx < 2 && 2*x+dx < w; dx++ {
+						r, g, bl, _ := img.At(b.Min.X+2*x+dx, b.Min.Y+2*y+dy).RGBA()
+						luma, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+						p.y[(2*y+dy)*p.yStride+2*x+dx] = lumaRange[luma]
+						sr, sg, sb, n = sr+r>>8, sg+g>>8, sb+bl>>8, n+1
+					}
+				}
+				_, cb, cr := color.RGBToYCbCr(uint8(sr/n), uint8(sg/n), uint8(sb/n))
+				p.u[y*p.cStride+x] = chromaRange[cb]
+				p.v[y*p.cStride+x] = chromaRange[cr]
+			}
+		}
+	}
+	pad(p.y, p.yStride, w, h, e.mbh*16)
+	pad(p.u, p.cStride, cw, ch, e.mbh*8)
+	pad(p.v, p.cStride, cw, ch, e.mbh*8)
+}
+
+// pad заполняет область за пределами w x h повтором последнего столбца и строки.
+func pad(pix []uint8, stride, w, h, rows int) {
+	for y := 0; y < h; y++ {
+		row := pix[y*stride : (y+1)*stride]
+		for x := w; x < stride; x++ {
+			row[x] = row[w-1]
+		}
+	}
+	last := pix[(h-1)*stride : h*stride]
+	for y := h; y < rows; y++ {
+		copy(pix[y*stride:(y+1)*stride], last)
+	}
+}
+
+// edges — соседние восстановленные пиксели блока, по которым строится предсказание.
+// Как и в декодере, строка над кадром равна 127, а столбец слева от него — 129.
+type edges struct {
+	above   [16]uint8
+	left    [16]uint8
+	corner  uint8
+	hasTop  bool
+	hasLeft bool
+}
+
+func loadEdges(pix []uint8, stride, x, y, size int) edges {
+	ed := edges{hasTop: y > 0, hasLeft: x > 0}
+	switch {
+	case y == 0:
+		ed.corner = 127
+	case x == 0:
+		ed.corner = 129
+	default:
+		ed.corner = pix[(y-1)*stride+x-1]
+	}
+	for i := 0; i < size; i++ {
+		ed.above[i] = 127
+		if y > 0 {
+			ed.above[i] = pix[(y-1)*stride+x+i]
+		}
+		ed.left[i] = 129
+		if x > 0 {
+			ed.left[i] = pix[(y+i)*stride+x-1]
+		}
+	}
+	return ed
+}
+
+// predict заполняет dst (size x size построчно) предсказанием в режиме mode.
+func predict(dst []uint8, ed *edges, mode uint8, size int) {
+	switch mode {
+	case predDC:
+		var sum, n int
+		if ed.hasTop {
+			for i := 0; i < size; i++ {
+				sum += int(ed.above[i])
+			}
+			n += size
+		}
+		if ed.hasLeft {
+			for i := 0; i < size; i++ {
+				sum += int(ed.left[i])
+			}
+			n += size
+		}
+		v := uint8(128)
+		if n > 0 {
+			v = uint8((sum + n/2) / n)
+		}
+		for i := range dst[:size*size] {
+			dst[i] = v
+		}
+	case predVE:
+		for y := 0; y < size; y++ {
+			copy(dst[y*size:(y+1)*size], ed.above[:size])
+		}
+	case predHE:
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				dst[y*size+x] = ed.left[y]
+			}
+		}
+	case predTM:
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				dst[y*size+x] = clip8(int32(ed.left[y]) + int32(ed.above[x]) - int32(ed.corner))
+			}
+		}
+	}
+}
+
+// unchanged сообщает, совпадает ли исходный макроблок с тем же макроблоком предыдущего кадра.
+func (e *Encoder) unchanged(yOff, cOff int) bool {
+	src, last := &e.src, &e.last
+	for y := 0; y < 16; y++ {
+		row := yOff + y*src.yStride
+		if !bytes.Equal(src.y[row:row+16], last.y[row:row+16]) {
+			return false
+		}
+	}
+	for y := 0; y < 8; y++ {
+		row := cOff + y*src.cStride
+		if !bytes.Equal(src.u[row:row+8], last.u[row:row+8]) || !bytes.Equal(src.v[row:row+8], last.v[row:row+8]) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyBlock копирует блок size x size с шагом stride в dst построчно.
+func copyBlock(dst []uint8, pix []uint8, stride, size int) {
+	for y := 0; y < size; y++ {
+		copy(dst[y*size:(y+1)*size], pix[y*stride:y*stride+size])
+	}
+}
+
+// sad возвращает сумму модулей разности блока src (шаг stride) и предсказания pred.
+func sad(src []uint8, stride int, pred []uint8, size int) int {
+	total := 0
+	for y := 0; y < size; y++ {
+		row := src[y*stride:]
+		for x := 0; x < size; x++ {
+			d := int(row[x]) - int(pred[y*size+x])
+			if d < 0 {
+				d = -d
+			}
+			total += d
+		}
+	}
+	return total
+}
+
+// quantize возвращает уровень коэффициента. Для AC используется мёртвая зона чуть шире
+// округления: мелкие коэффициенты обнуляются и кадр получается заметно меньше.
+func quantize(c, q int32, dc bool) int16 {
+	bias := q * 3 / 8
+	if dc {
+		bias = q / 2
+	}
+	neg := c < 0
+	if neg {
+		c = -c
+	}
+	level := min((c+bias)/q, maxLevel)
+	if neg {
+		level = -level
+	}
+	return int16(level)
+}
+
+// maxLevel — наибольший уровень, который кодируется токеном категории 6.
+const maxLevel = 67 + 2047
+
+// encodeMacroblock выбирает предсказание макроблока, квантует остаток и восстанавливает
+// макроблок в rec. В межкадровом кадре предсказание из предыдущего кадра выбирается,
+// если его ошибка не больше ошибки лучшего внутрикадрового.
+func (e *Encoder) encodeMacroblock(mbx, mby int, mb *macroblock, key bool) {
+	*mb = macroblock{}
+	src, rec, ref := &e.src, &e.rec, &e.ref
+	yOff := mby*16*src.yStride + mbx*16
+	cOff := mby*8*src.cStride + mbx*8
+
+	if !key && e.unchanged(yOff, cOff) {
+		// Повторное кодирование ошибки квантования только добавило бы шум, поэтому
+		// макроблок копируется из предыдущего кадра как есть.
+		mb.inter, mb.skip = true, true
+		for y := 0; y < 16; y++ {
+			copy(rec.y[yOff+y*rec.yStride:yOff+y*rec.yStride+16], ref.y[yOff+y*ref.yStride:])
+		}
+		for y := 0; y < 8; y++ {
+			copy(rec.u[cOff+y*rec.cStride:cOff+y*rec.cStride+8], ref.u[cOff+y*ref.cStride:])
+			copy(rec.v[cOff+y*rec.cStride:cOff+y*rec.cStride+8], ref.v[cOff+y*ref.cStride:])
+		}
+		return
+	}
+
+	// Яркость: режим 16x16 с наименьшей ошибкой предсказания.
+	yEdges := loadEdges(rec.y, rec.yStride, mbx*16, mby*16, 16)
+	var pred, best [256]uint8
+	bestCost := -1
+	for mode := uint8(0); mode < nPredModes; mode++ {
+		predict(pred[:], &yEdges, mode, 16)
+		if cost := sad(src.y[yOff:], src.yStride, pred[:], 16); bestCost < 0 || cost < bestCost {
+			bestCost, best, mb.yMode = cost, pred, mode
+		}
+	}
+
+	// Цветность: общий режим 8x8 для U и V.
+	uEdges := loadEdges(rec.u, rec.cStride, mbx*8, mby*8, 8)
+	vEdges := loadEdges(rec.v, rec.cStride, mbx*8, mby*8, 8)
+	var uPred, vPred, uBest, vBest [64]uint8
+	chromaCost := -1
+	for mode := uint8(0); mode < nPredModes; mode++ {
+		predict(uPred[:], &uEdges, mode, 8)
+		predict(vPred[:], &vEdges, mode, 8)
+		cost := sad(src.u[cOff:], src.cStride, uPred[:], 8) + sad(src.v[cOff:], src.cStride, vPred[:], 8)
+		if chromaCost < 0 || cost < chromaCost {
+			chromaCost, uBest, vBest, mb.uvMode = cost, uPred, vPred, mode
+		}
+	}
+
+	if !key {
+		copyBlock(pred[:], ref.y[yOff:], ref.yStride, 16)
+		copyBlock(uPred[:], ref.u[cOff:], ref.cStride, 8)
+		copyBlock(vPred[:], ref.v[cOff:], ref.cStride, 8)
+		cost := sad(src.y[yOff:], src.yStride, pred[:], 16) +
+			sad(src.u[cOff:], src.cStride, uPred[:], 8) + sad(src.v[cOff:], src.cStride, vPred[:], 8)
+		if cost <= bestCost+chromaCost {
+			mb.inter, mb.yMode, mb.uvMode = true, 0, 0
+			best, uBest, vBest = pred, uPred, vPred
+		}
+	}
+
+	var residual, coeffs [16]int32
+	var dcs [16]int32
+	var blockCoeffs [16][16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := (n%4)*4, (n/4)*4
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				residual[y*4+x] = int32(src.y[yOff+(by+y)*src.yStride+bx+x]) - int32(best[(by+y)*16+bx+x])
+			}
+		}
+		forwardDCT(&residual, &blockCoeffs[n])
+		dcs[n] = blockCoeffs[n][0]
+	}
+	forwardWHT(&dcs, &coeffs)
+	var y2 [16]int16
+	for i := 0; i < 16; i++ {
+		z := zigzag[i]
+		level := quantize(coeffs[z], e.quant.y2[btoi(z > 0)], z == 0)
+		mb.levels[24][i] = level
+		y2[z] = int16(int32(level) * e.quant.y2[btoi(z > 0)])
+	}
+	var dc [16]int16
+	inverseWHT(&y2, &dc)
+	for n := 0; n < 16; n++ {
+		var deq [16]int16
+		deq[0] = dc[n]
+		for i := 1; i < 16; i++ {
+			z := zigzag[i]
+			level := quantize(blockCoeffs[n][z], e.quant.y1[1], false)
+			mb.levels[n][i] = level
+			deq[z] = int16(int32(level) * e.quant.y1[1])
+		}
+		bx, by := (n%4)*4, (n/4)*4
+		out := rec.y[yOff+by*rec.yStride+bx:]
+		for y := 0; y < 4; y++ {
+			copy(out[y*rec.yStride:y*rec.yStride+4], best[(by+y)*16+bx:(by+y)*16+bx+4])
+		}
+		inverseDCT(&deq, out, rec.yStride)
+	}
+
+	e.encodeChroma(src.u[cOff:], rec.u[cOff:], src.cStride, &uBest, mb.levels[16:20])
+	e.encodeChroma(src.v[cOff:], rec.v[cOff:], src.cStride, &vBest, mb.levels[20:24])
+
+	mb.skip = true
+	for i := range mb.levels {
+		for _, level := range mb.levels[i] {
+			if level != 0 {
+				mb.skip = false
+			}
+		}
+	}
+}
+
+// encodeChroma кодирует четыре блока 4x4 одной плоскости цветности и восстанавливает их в rec.
+func (e *Encoder) encodeChroma(src, rec []uint8, stride int, pred *[64]uint8, levels [][16]int16) {
+	var residual, coeffs [16]int32
+	for n := 0; n < 4; n++ {
+		bx, by := (n%2)*4, (n/2)*4
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				residual[y*4+x] = int32(src[(by+y)*stride+bx+x]) - int32(pred[(by+y)*8+bx+x])
+			}
+		}
+		forwardDCT(&residual, &coeffs)
+		var deq [16]int16
+		for i := 0; i < 16; i++ {
+			z := zigzag[i]
+			level := quantize(coeffs[z], e.quant.uv[btoi(z > 0)], z == 0)
+			levels[n][i] = level
+			deq[z] = int16(int32(level) * e.quant.uv[btoi(z > 0)])
+		}
+		out := rec[by*stride+bx:]
+		for y := 0; y < 4; y++ {
+			copy(out[y*stride:y*stride+4], pred[(by+y)*8+bx:(by+y)*8+bx+4])
+		}
+		inverseDCT(&deq, out, stride)
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,323 @@
+package vp8
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	xvp8 "golang.org/x/image/vp8"
+)
+
+// testImage рисует градиент с прямоугольниками, чтобы в кадре были и гладкие области, и резкие края.
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 96, A: 255})
+		}
+	}
+	fill(img, image.Rect(width/8, height/6, width/2, height/3), color.RGBA{R: 240, G: 240, B: 240, A: 255})
+	fill(img, image.Rect(width/2, height/2, width*7/8, height*5/6), color.RGBA{R: 20, G: 40, B: 200, A: 255})
+	return img
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func decodeKeyFrame(t *testing.T, data []byte) *image.YCbCr {
+	t.Helper()
+	d := xvp8.NewDecoder()
+	d.Init(bytes.NewReader(data), len(data))
+	fh, err := d.DecodeFrameHeader()
+	if err != nil {
+		t.Fatalf("DecodeFrameHeader: %v", err)
+	}
+	if !fh.KeyFrame {
+		t.Fatal("frame is not a key frame")
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	return img
+}
+
+// expectReconstruction проверяет, что декодер получил те же пиксели, что восстановил кодировщик:
+// от этого зависит предсказание следующих кадров.
+func expectReconstruction(t *testing.T, e *Encoder, img *image.YCbCr) {
+	t.Helper()
+	if img.Rect.Dx() != e.width || img.Rect.Dy() != e.height {
+		t.Fatalf("decoded size %dx%d, want %dx%d", img.Rect.Dx(), img.Rect.Dy(), e.width, e.height)
+	}
+	for y := 0; y < e.height; y++ {
+		for x := 0; x < e.width; x++ {
+			if got, want := img.Y[y*img.YStride+x], e.ref.y[y*e.ref.yStride+x]; got != want {
+				t.Fatalf("Y(%d,%d) = %d, encoder reconstructed %d", x, y, got, want)
+			}
+		}
+	}
+	for y := 0; y < (e.height+1)/2; y++ {
+		for x := 0; x < (e.width+1)/2; x++ {
+			i := y*img.CStride + x
+			if img.Cb[i] != e.ref.u[y*e.ref.cStride+x] || img.Cr[i] != e.ref.v[y*e.ref.cStride+x] {
+				t.Fatalf("chroma (%d,%d) differs from the encoder reconstruction", x, y)
+			}
+		}
+	}
+}
+
+// meanError возвращает среднюю ошибку яркости последнего восстановленного кадра относительно исходного.
+func meanError(e *Encoder, r image.Rectangle) float64 {
+	total, n := 0, 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			d := int(e.ref.y[y*e.ref.yStride+x]) - int(e.last.y[y*e.last.yStride+x])
+			total += max(d, -d)
+			n++
+		}
+	}
+	return float64(total) / float64(n)
+}
+
+func TestKeyFrameRoundTrip(t *testing.T) {
+	// Размер не кратен 16, чтобы проверить дополнение до целых макроблоков.
+	const width, height = 100, 70
+	e := NewEncoder(80)
+	data, err := e.Encode(testImage(width, height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]&1 != 0 {
+		t.Fatal("first frame must be a key frame")
+	}
+	expectReconstruction(t, e, decodeKeyFrame(t, data))
+	if got := meanError(e, image.Rect(0, 0, width, height)); got > 4 {
+		t.Fatalf("mean luma error %.2f, want at most 4", got)
+	}
+}
+
+func TestEncodeRejectsInvalidSize(t *testing.T) {
+	if _, err := NewEncoder(80).Encode(image.NewRGBA(image.Rect(0, 0, 0, 10))); err != ErrInvalidSize {
+		t.Fatalf("Encode of an empty image = %v, want ErrInvalidSize", err)
+	}
+}
+
+// boolDecoder — декодер из раздела 7.3 RFC 6386 для проверки первого раздела межкадровых кадров.
+type boolDecoder struct {
+	data     []byte
+	value    uint32
+	rng      uint32
+	bitCount int
+}
+
+func newBoolDecoder(data []byte) *boolDecoder {
+	d := &boolDecoder{data: data, rng: 255}
+	for i := 0; i < 2; i++ {
+		d.value <<= 8
+		if len(d.data) > 0 {
+			d.value |= uint32(d.data[0])
+			d.data = d.data[1:]
+		}
+	}
+	return d
+}
+
+func (d *boolDecoder) readBool(prob uint8) bool {
+	split := 1 + ((d.rng-1)*uint32(prob))>>8
+	bigSplit := split << 8
+	bit := d.value >= bigSplit
+	if bit {
+		d.rng -= split
+		d.value -= bigSplit
+	} else {
+		d.rng = split
+	}
+	for d.rng < 128 {
+		d.value <<= 1
+		d.rng <<= 1
+		d.bitCount++
+		if d.bitCount == 8 {
+			d.bitCount = 0
+			if len(d.data) > 0 {
+				d.value |= uint32(d.data[0])
+				d.data = d.data[1:]
+			}
+		}
+	}
+	return bit
+}
+
+func (d *boolDecoder) readLiteral(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(btoi(d.readBool(128)))
+	}
+	return v
+}
+
+// parsedMacroblock — признаки макроблока, прочитанные из межкадрового кадра.
+type parsedMacroblock struct {
+	skip, inter bool
+}
+
+// parseInterFrame читает заголовок межкадрового кадра и режимы макроблоков так, как их читает декодер.
+func parseInterFrame(t *testing.T, e *Encoder, data []byte) []parsedMacroblock {
+	t.Helper()
+	if data[0]&1 != 1 {
+		t.Fatal("frame is not an inter frame")
+	}
+	tag := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+	firstLen := int(tag >> 5)
+	if 3+firstLen > len(data) {
+		t.Fatalf("first partition size %d exceeds the frame", firstLen)
+	}
+	d := newBoolDecoder(data[3 : 3+firstLen])
+	expect := func(name string, got, want uint32) {
+		t.Helper()
+		if got != want {
+			t.Fatalf("%s = %d, want %d", name, got, want)
+		}
+	}
+	expect("segmentation_enabled", d.readLiteral(1), 0)
+	expect("filter_type", d.readLiteral(1), 0)
+	expect("loop_filter_level", d.readLiteral(6), 0)
+	expect("sharpness_level", d.readLiteral(3), 0)
+	expect("loop_filter_adj_enable", d.readLiteral(1), 0)
+	expect("log2_nbr_of_dct_partitions", d.readLiteral(2), 0)
+	expect("y_ac_qi", d.readLiteral(7), uint32(e.qi))
+	for i := 0; i < 5; i++ {
+		expect("delta update", d.readLiteral(1), 0)
+	}
+	expect("refresh_golden_frame", d.readLiteral(1), 0)
+	expect("refresh_alternate_frame", d.readLiteral(1), 0)
+	expect("copy_buffer_to_golden", d.readLiteral(2), 0)
+	expect("copy_buffer_to_alternate", d.readLiteral(2), 0)
+	expect("sign_bias_golden", d.readLiteral(1), 0)
+	expect("sign_bias_alternate", d.readLiteral(1), 0)
+	expect("refresh_entropy_probs", d.readLiteral(1), 0)
+	expect("refresh_last", d.readLiteral(1), 1)
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, p := range tokenProbUpdateProb[i][j][k] {
+					if d.readBool(p) {
+						t.Fatal("unexpected token probability update")
+					}
+				}
+			}
+		}
+	}
+	expect("mb_no_coeff_skip", d.readLiteral(1), 1)
+	probSkipFalse := uint8(d.readLiteral(8))
+	probIntra := uint8(d.readLiteral(8))
+	probLastRead := uint8(d.readLiteral(8))
+	d.readLiteral(8) // prob_gf
+	expect("intra_16x16_prob_update_flag", d.readLiteral(1), 0)
+	expect("intra_chroma_prob_update_flag", d.readLiteral(1), 0)
+	for i := range mvUpdateProb {
+		for _, p := range mvUpdateProb[i] {
+			if d.readBool(p) {
+				t.Fatal("unexpected motion vector probability update")
+			}
+		}
+	}
+
+	mbs := make([]parsedMacroblock, len(e.mbs))
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &mbs[mby*e.mbw+mbx]
+			mb.skip = d.readBool(probSkipFalse)
+			mb.inter = d.readBool(probIntra)
+			if !mb.inter {
+				// Режимы внутрикадрового макроблока: дерево яркости и цветности, раздел 16.2.
+				if d.readBool(probInterY16DC) {
+					if d.readBool(probInterY16VE) {
+						d.readBool(probInterY16TM)
+					} else {
+						d.readBool(probInterY16VEHE)
+					}
+				}
+				if d.readBool(probInterUVDC) && d.readBool(probInterUVVE) {
+					d.readBool(probInterUVHE)
+				}
+				continue
+			}
+			if d.readBool(probLastRead) {
+				t.Fatalf("macroblock %d,%d references a golden or altref frame", mbx, mby)
+			}
+			if d.readBool(modeContexts[e.zeroMVContext(mbx, mby)][0]) {
+				t.Fatalf("macroblock %d,%d uses a non-zero motion vector", mbx, mby)
+			}
+		}
+	}
+	return mbs
+}
+
+func TestInterFrames(t *testing.T) {
+	const width, height = 96, 64
+	e := NewEncoder(80)
+	img := testImage(width, height)
+	key, err := e.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Неизменившийся экран: все макроблоки берутся из предыдущего кадра без остатка.
+	prev := append([]uint8(nil), e.ref.y...)
+	same, err := e.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(same) >= len(key)/10 {
+		t.Fatalf("unchanged frame is %d bytes, key frame %d", len(same), len(key))
+	}
+	for i, mb := range parseInterFrame(t, e, same) {
+		if !mb.inter || !mb.skip {
+			t.Fatalf("macroblock %d of an unchanged frame: inter %v, skip %v", i, mb.inter, mb.skip)
+		}
+	}
+	if !bytes.Equal(prev, e.ref.y) {
+		t.Fatal("unchanged frame changed the reconstruction")
+	}
+
+	// Изменилась одна область: макроблоки вне неё пропускаются, а сама область кодируется.
+	changed := image.Rect(40, 20, 60, 44)
+	fill(img, changed, color.RGBA{R: 255, G: 200, A: 255})
+	data, err := e.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mb := range parseInterFrame(t, e, data) {
+		if mb.inter != e.mbs[i].inter || mb.skip != e.mbs[i].skip {
+			t.Fatalf("macroblock %d parsed as inter %v skip %v, encoded inter %v skip %v", i, mb.inter, mb.skip, e.mbs[i].inter, e.mbs[i].skip)
+		}
+		mbRect := image.Rect(i%e.mbw*16, i/e.mbw*16, i%e.mbw*16+16, i/e.mbw*16+16)
+		if !mbRect.Overlaps(changed) && !(mb.inter && mb.skip) {
+			t.Fatalf("unchanged macroblock %d is coded", i)
+		}
+	}
+	if got := meanError(e, changed); got > 4 {
+		t.Fatalf("mean luma error in the changed area %.2f, want at most 4", got)
+	}
+
+	// После ForceKeyFrame кадр снова декодируется сам по себе.
+	e.ForceKeyFrame()
+	data, err = e.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReconstruction(t, e, decodeKeyFrame(t, data))
+
+	// Смена размера тоже начинается с ключевого кадра.
+	data, err = e.Encode(testImage(48, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReconstruction(t, e, decodeKeyFrame(t, data))
+}
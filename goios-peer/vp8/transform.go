@@ -0,0 +1,132 @@
+package vp8
+
+// Прямые преобразования повторяют эталонный кодировщик libvpx. Обратные должны совпадать
+// с декодером бит в бит, потому что восстановленные пиксели служат предсказанием
+// для следующих макроблоков: они взяты из разделов 14.3 и 14.4 RFC 6386.
+
+// forwardDCT преобразует остаток 4x4 (построчно) в коэффициенты DCT.
+func forwardDCT(in *[16]int32, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[i*4 : i*4+4]
+		a := (ip[0] + ip[3]) * 8
+		b := (ip[1] + ip[2]) * 8
+		c := (ip[1] - ip[2]) * 8
+		d := (ip[0] - ip[3]) * 8
+		tmp[i*4+0] = a + b
+		tmp[i*4+2] = a - b
+		tmp[i*4+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[i*4+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217 + d*5352 + 12000) >> 16
+		if d != 0 {
+			out[4+i]++
+		}
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// forwardWHT преобразует DC-коэффициенты 16 блоков яркости в коэффициенты блока Y2.
+func forwardWHT(in *[16]int32, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[i*4 : i*4+4]
+		a := (ip[0] + ip[2]) * 4
+		d := (ip[1] + ip[3]) * 4
+		c := (ip[1] - ip[3]) * 4
+		b := (ip[0] - ip[2]) * 4
+		tmp[i*4+0] = a + d
+		if a != 0 {
+			tmp[i*4+0]++
+		}
+		tmp[i*4+1] = b + c
+		tmp[i*4+2] = b - c
+		tmp[i*4+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[8+i]
+		d := tmp[4+i] + tmp[12+i]
+		c := tmp[4+i] - tmp[12+i]
+		b := tmp[i] - tmp[8+i]
+		for j, v := range [4]int32{a + d, b + c, b - c, a - d} {
+			if v < 0 {
+				v++
+			}
+			out[j*4+i] = (v + 3) >> 3
+		}
+	}
+}
+
+// inverseDCT добавляет к предсказанию pix (шаг stride) обратное DCT коэффициентов coeff.
+func inverseDCT(coeff *[16]int16, pix []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2).
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2).
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := int32(coeff[i]) + int32(coeff[8+i])
+		b := int32(coeff[i]) - int32(coeff[8+i])
+		c := (int32(coeff[4+i])*c2)>>16 - (int32(coeff[12+i])*c1)>>16
+		d := (int32(coeff[4+i])*c1)>>16 + (int32(coeff[12+i])*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := pix[j*stride : j*stride+4]
+		row[0] = clip8(int32(row[0]) + (a+d)>>3)
+		row[1] = clip8(int32(row[1]) + (b+c)>>3)
+		row[2] = clip8(int32(row[2]) + (b-c)>>3)
+		row[3] = clip8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// inverseWHT восстанавливает из блока Y2 DC-коэффициенты 16 блоков яркости.
+func inverseWHT(in *[16]int16, dc *[16]int16) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := int32(in[i]) + int32(in[12+i])
+		a1 := int32(in[4+i]) + int32(in[8+i])
+		a2 := int32(in[4+i]) - int32(in[8+i])
+		a3 := int32(in[i]) - int32(in[12+i])
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		d := m[i*4] + 3
+		a0 := d + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := d - m[3+i*4]
+		dc[i*4+0] = int16((a0 + a1) >> 3)
+		dc[i*4+1] = int16((a3 + a2) >> 3)
+		dc[i*4+2] = int16((a0 - a1) >> 3)
+		dc[i*4+3] = int16((a3 - a2) >> 3)
+	}
+}
+
+func clip8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,325 @@
+package vp8
+
+// Вероятности дерева режимов ключевого кадра, раздел 11.2, и межкадрового кадра по умолчанию, раздел 16.1.
+const (
+	probInterY16DC   = 112
+	probInterY16VE   = 86
+	probInterY16VEHE = 140
+	probInterY16TM   = 37
+	probInterUVDC    = 162
+	probInterUVVE    = 101
+	probInterUVHE    = 204
+
+	probY16        = 145
+	probY16DCVE    = 156
+	probY16DC      = 163
+	probY16HE      = 128
+	probUVDC       = 142
+	probUVVE       = 114
+	probUVHE       = 183
+	probCat1       = 159
+	probCat2High   = 165
+	probCat2Low    = 145
+	probSign       = 128
+	maxFirstPart   = 1<<19 - 1
+	frameHeaderLen = 10
+	// Межкадровый кадр начинается только с трёхбайтового тега, раздел 9.1.
+	interFrameHeaderLen = 3
+	// Все межкадровые макроблоки ссылаются на предыдущий кадр, поэтому вероятность
+	// выбора другого опорного кадра минимальна.
+	probLast = 255
+	probGF   = 128
+)
+
+// write собирает кадр: заголовок, первый раздел с параметрами и режимами макроблоков
+// и единственный раздел с токенами коэффициентов.
+func (e *Encoder) write(key bool) []byte {
+	skipped, intra := 0, 0
+	for i := range e.mbs {
+		if e.mbs[i].skip {
+			skipped++
+		}
+		if !e.mbs[i].inter {
+			intra++
+		}
+	}
+	// Вероятность того, что макроблок не пропущен.
+	probSkipFalse := uint8(min(max((len(e.mbs)-skipped)*256/len(e.mbs), 1), 254))
+	// Вероятность того, что макроблок межкадрового кадра кодируется внутрикадрово.
+	probIntra := uint8(min(max(intra*256/len(e.mbs), 1), 254))
+
+	header := newBoolEncoder(256 + len(e.mbs))
+	if key {
+		header.writeLiteral(0, 1) // цветовое пространство
+		header.writeLiteral(0, 1) // ограничение значений пикселей
+	}
+	header.writeLiteral(0, 1) // сегментация
+	header.writeLiteral(0, 1) // тип фильтра
+	header.writeLiteral(0, 6) // уровень фильтра: деблокинг выключен
+	header.writeLiteral(0, 3) // резкость
+	header.writeLiteral(0, 1) // поправки фильтра
+	header.writeLiteral(0, 2) // один раздел токенов
+	header.writeLiteral(uint32(e.qi), 7)
+	for i := 0; i < 5; i++ {
+		header.writeLiteral(0, 1) // поправки квантователя
+	}
+	if !key {
+		header.writeLiteral(0, 1) // refresh_golden_frame
+		header.writeLiteral(0, 1) // refresh_alternate_frame
+		header.writeLiteral(0, 2) // copy_buffer_to_golden
+		header.writeLiteral(0, 2) // copy_buffer_to_alternate
+		header.writeLiteral(0, 1) // sign_bias_golden
+		header.writeLiteral(0, 1) // sign_bias_alternate
+	}
+	header.writeLiteral(0, 1) // refresh_entropy_probs
+	if !key {
+		header.writeLiteral(1, 1) // refresh_last
+	}
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for l := range tokenProbUpdateProb[i][j][k] {
+					header.writeBool(tokenProbUpdateProb[i][j][k][l], false)
+				}
+			}
+		}
+	}
+	header.writeLiteral(1, 1)
+	header.writeLiteral(uint32(probSkipFalse), 8)
+	if !key {
+		header.writeLiteral(uint32(probIntra), 8)
+		header.writeLiteral(probLast, 8)
+		header.writeLiteral(probGF, 8)
+		header.writeLiteral(0, 1) // intra_16x16_prob_update_flag
+		header.writeLiteral(0, 1) // intra_chroma_prob_update_flag
+		for i := range mvUpdateProb {
+			for _, p := range mvUpdateProb[i] {
+				header.writeBool(p, false)
+			}
+		}
+	}
+
+	tokens := newBoolEncoder(len(e.mbs) * 64)
+	// Ненулевые контексты блоков сверху (по столбцам макроблоков) и слева.
+	// Индексы: 0-3 — яркость, 4-5 — U, 6-7 — V, 8 — Y2.
+	above := make([][9]uint8, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		var left [9]uint8
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			header.writeBool(probSkipFalse, mb.skip)
+			switch {
+			case key:
+				writeModes(header, mb)
+			case mb.inter:
+				header.writeBool(probIntra, true)
+				header.writeBool(probLast, false)
+				// Режим ZEROMV: первая ветвь дерева режимов вектора движения.
+				header.writeBool(modeContexts[e.zeroMVContext(mbx, mby)][0], false)
+			default:
+				header.writeBool(probIntra, false)
+				writeInterFrameModes(header, mb)
+			}
+			if mb.skip {
+				left = [9]uint8{}
+				above[mbx] = [9]uint8{}
+				continue
+			}
+			writeMacroblockTokens(tokens, mb, &left, &above[mbx])
+		}
+	}
+
+	first := header.flush()
+	second := tokens.flush()
+	if !key {
+		out := make([]byte, interFrameHeaderLen, interFrameHeaderLen+len(first)+len(second))
+		// Межкадровый кадр, версия 0, показывать кадр, размер первого раздела.
+		tag := uint32(1) | uint32(1)<<4 | uint32(min(len(first), maxFirstPart))<<5
+		out[0], out[1], out[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+		out = append(out, first...)
+		return append(out, second...)
+	}
+	out := make([]byte, frameHeaderLen, frameHeaderLen+len(first)+len(second))
+	// Ключевой кадр, версия 0, показывать кадр, размер первого раздела.
+	tag := uint32(1)<<4 | uint32(min(len(first), maxFirstPart))<<5
+	out[0], out[1], out[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	out[3], out[4], out[5] = 0x9d, 0x01, 0x2a
+	out[6], out[7] = byte(e.width), byte(e.width>>8)
+	out[8], out[9] = byte(e.height), byte(e.height>>8)
+	out = append(out, first...)
+	return append(out, second...)
+}
+
+// zeroMVContext считает контекст режима вектора движения, как find_near_mvs в разделе 18.3:
+// соседние межкадровые макроблоки с нулевым вектором сверху и слева дают по 2, сверху слева — 1.
+// Макроблоки за краем кадра считаются внутрикадровыми.
+func (e *Encoder) zeroMVContext(mbx, mby int) int {
+	ctx := 0
+	if mby > 0 && e.mbs[(mby-1)*e.mbw+mbx].inter {
+		ctx += 2
+	}
+	if mbx > 0 && e.mbs[mby*e.mbw+mbx-1].inter {
+		ctx += 2
+	}
+	if mbx > 0 && mby > 0 && e.mbs[(mby-1)*e.mbw+mbx-1].inter {
+		ctx++
+	}
+	return ctx
+}
+
+func writeModes(enc *boolEncoder, mb *macroblock) {
+	enc.writeBool(probY16, true)
+	switch mb.yMode {
+	case predDC, predVE:
+		enc.writeBool(probY16DCVE, false)
+		enc.writeBool(probY16DC, mb.yMode == predVE)
+	default:
+		enc.writeBool(probY16DCVE, true)
+		enc.writeBool(probY16HE, mb.yMode == predTM)
+	}
+	enc.writeBool(probUVDC, mb.uvMode != predDC)
+	if mb.uvMode != predDC {
+		enc.writeBool(probUVVE, mb.uvMode != predVE)
+		if mb.uvMode != predVE {
+			enc.writeBool(probUVHE, mb.uvMode == predTM)
+		}
+	}
+}
+
+// writeInterFrameModes пишет внутрикадровые режимы макроблока межкадрового кадра:
+// у дерева режимов яркости другой порядок, чем у ключевого кадра, раздел 16.2.
+func writeInterFrameModes(enc *boolEncoder, mb *macroblock) {
+	enc.writeBool(probInterY16DC, mb.yMode != predDC)
+	if mb.yMode != predDC {
+		enc.writeBool(probInterY16VE, mb.yMode == predTM)
+		if mb.yMode == predTM {
+			enc.writeBool(probInterY16TM, false)
+		} else {
+			enc.writeBool(probInterY16VEHE, mb.yMode == predHE)
+		}
+	}
+	enc.writeBool(probInterUVDC, mb.uvMode != predDC)
+	if mb.uvMode != predDC {
+		enc.writeBool(probInterUVVE, mb.uvMode != predVE)
+		if mb.uvMode != predVE {
+			enc.writeBool(probInterUVHE, mb.uvMode == predTM)
+		}
+	}
+}
+
+// writeMacroblockTokens пишет коэффициенты макроблока в порядке декодера: Y2, 16 блоков яркости, U, V.
+func writeMacroblockTokens(enc *boolEncoder, mb *macroblock, left, above *[9]uint8) {
+	nz := writeBlockTokens(enc, &mb.levels[24], planeY2, left[8]+above[8], 0)
+	left[8], above[8] = nz, nz
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			nz := writeBlockTokens(enc, &mb.levels[y*4+x], planeY1WithY2, left[y]+above[x], 1)
+			left[y], above[x] = nz, nz
+		}
+	}
+	for c := 0; c < 2; c++ {
+		base := 4 + c*2
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				nz := writeBlockTokens(enc, &mb.levels[16+c*4+y*2+x], planeUV, left[base+y]+above[base+x], 0)
+				left[base+y], above[base+x] = nz, nz
+			}
+		}
+	}
+}
+
+// writeBlockTokens кодирует уровни блока начиная с позиции first и возвращает 1,
+// если в блоке есть ненулевые коэффициенты.
+func writeBlockTokens(enc *boolEncoder, levels *[16]int16, plane int, ctx uint8, first int) uint8 {
+	probs := &defaultTokenProb[plane]
+	last := -1
+	for i := 15; i >= first; i-- {
+		if levels[i] != 0 {
+			last = i
+			break
+		}
+	}
+	p := &probs[bands[first]][ctx]
+	if last < 0 {
+		enc.writeBool(p[0], false)
+		return 0
+	}
+	enc.writeBool(p[0], true)
+	for i := first; i < 16; i++ {
+		v := int(levels[i])
+		if v < 0 {
+			v = -v
+		}
+		if v == 0 {
+			enc.writeBool(p[1], false)
+			p = &probs[bands[i+1]][0]
+			continue
+		}
+		enc.writeBool(p[1], true)
+		writeValue(enc, p, v)
+		if v == 1 {
+			p = &probs[bands[i+1]][1]
+		} else {
+			p = &probs[bands[i+1]][2]
+		}
+		enc.writeBool(probSign, levels[i] < 0)
+		if i == 15 {
+			break
+		}
+		if i == last {
+			enc.writeBool(p[0], false)
+			break
+		}
+		enc.writeBool(p[0], true)
+	}
+	return 1
+}
+
+// writeValue кодирует модуль ненулевого коэффициента деревом токенов из раздела 13.2.
+func writeValue(enc *boolEncoder, p *[nProb]uint8, v int) {
+	if v == 1 {
+		enc.writeBool(p[2], false)
+		return
+	}
+	enc.writeBool(p[2], true)
+	if v <= 4 {
+		enc.writeBool(p[3], false)
+		if v == 2 {
+			enc.writeBool(p[4], false)
+			return
+		}
+		enc.writeBool(p[4], true)
+		enc.writeBool(p[5], v == 4)
+		return
+	}
+	enc.writeBool(p[3], true)
+	if v <= 10 {
+		enc.writeBool(p[6], false)
+		if v <= 6 {
+			enc.writeBool(p[7], false)
+			enc.writeBool(probCat1, v == 6)
+			return
+		}
+		enc.writeBool(p[7], true)
+		extra := v - 7
+		enc.writeBool(probCat2High, extra&2 != 0)
+		enc.writeBool(probCat2Low, extra&1 != 0)
+		return
+	}
+	enc.writeBool(p[6], true)
+	cat := 0
+	for cat < 3 && v >= 3+(8<<(cat+1)) {
+		cat++
+	}
+	enc.writeBool(p[8], cat >= 2)
+	enc.writeBool(p[9+cat/2], cat&1 != 0)
+	tab := &cat3456[cat]
+	bits := 0
+	for tab[bits] != 0 {
+		bits++
+	}
+	extra := v - (3 + (8 << cat))
+	for i := 0; i < bits; i++ {
+		enc.writeBool(tab[i], extra&(1<<(bits-1-i)) != 0)
+	}
+}